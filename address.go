@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Address policies of a host, what to do with an address in one of the
+// special ranges.
+const (
+	policyReject = "reject"
+	policyIgnore = "ignore"
+	policyAccept = "accept"
+)
+
+// addrPolicies are the valid address policies, the default first.
+var addrPolicies = []string{policyReject, policyIgnore, policyAccept}
+
+// errBadAddr is returned for an address that does not parse or is
+// rejected by the address policy of the host.
+var errBadAddr = errors.New("bad address")
+
+var (
+	cgnatRange = netip.MustParsePrefix("100.64.0.0/10")
+	docRanges  = []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("3fff::/20"),
+	}
+)
+
+// checkAddrPolicy returns the address policy s, the default if it is
+// empty.
+func checkAddrPolicy(s string) (string, error) {
+	if s == "" {
+		return addrPolicies[0], nil
+	}
+	if !slices.Contains(addrPolicies, s) {
+		return "", fmt.Errorf("address policy must be one of %v", addrPolicies)
+	}
+	return s, nil
+}
+
+// parseAddr parses s as an IPv6 address if v6 is set, as an IPv4 address
+// otherwise, and returns it in canonical form. IPv4-mapped IPv6 addresses
+// count as IPv4. Unspecified and multicast addresses are refused.
+func parseAddr(s string, v6 bool) (netip.Addr, error) {
+	name := "ipaddr"
+	if v6 {
+		name = "ip6addr"
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: %s %q does not parse", errBadAddr, name, s)
+	}
+	if v6 && (!addr.Is6() || addr.Is4In6()) || !v6 && !addr.Unmap().Is4() {
+		return netip.Addr{}, fmt.Errorf("%w: %s %s is of the wrong family", errBadAddr, name, addr)
+	}
+	if addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("%w: %s %s has a zone", errBadAddr, name, addr)
+	}
+	addr = addr.Unmap()
+	if addr.IsUnspecified() || addr.IsMulticast() {
+		return netip.Addr{}, fmt.Errorf("%w: %s %s is not a host address", errBadAddr, name, addr)
+	}
+	return addr, nil
+}
+
+// addrRange returns the name of the special range addr is in, or "" if it
+// is a public address.
+func addrRange(addr netip.Addr) string {
+	switch {
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsLinkLocalUnicast():
+		return "link-local"
+	case addr.Is4() && addr.IsPrivate():
+		return "private"
+	case addr.IsPrivate():
+		return "ULA"
+	case cgnatRange.Contains(addr):
+		return "CGNAT"
+	}
+	for _, prefix := range docRanges {
+		if prefix.Contains(addr) {
+			return "documentation"
+		}
+	}
+	return ""
+}
+
+// checkAddrs parses and normalises the reported addresses of a host and
+// applies its address policy. An address dropped by the ignore policy is
+// returned as "" and described in warning. Malformed and rejected
+// addresses are reported as an error wrapping errBadAddr.
+func checkAddrs(policy, ipaddr, ip6addr string) (string, string, string, error) {
+	var warnings []string
+	addrs := []string{ipaddr, ip6addr}
+	for i, s := range addrs {
+		if s == "" {
+			continue
+		}
+		addr, err := parseAddr(s, i == 1)
+		if err != nil {
+			return "", "", "", err
+		}
+		addrs[i] = addr.String()
+		class := addrRange(addr)
+		if class == "" || policy == policyAccept {
+			continue
+		}
+		msg := fmt.Sprintf("%s %s is in a %s range", []string{"ipaddr", "ip6addr"}[i], addr, class)
+		if policy != policyIgnore {
+			return "", "", "", fmt.Errorf("%w: %s", errBadAddr, msg)
+		}
+		warnings = append(warnings, "ignored "+msg)
+		addrs[i] = ""
+	}
+	return addrs[0], addrs[1], strings.Join(warnings, ", "), nil
+}
+
+// hostAddrs parses and normalises addresses entered through the admin
+// interface, the API or the command line. They are not subject to the
+// address policy. Empty addresses are returned as nil.
+func hostAddrs(ipaddr, ip6addr string) (*string, *string, error) {
+	ipaddr, ip6addr, _, err := checkAddrs(policyAccept, ipaddr, ip6addr)
+	return optional(ipaddr), optional(ip6addr), err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		policy          string
+		ipaddr, ip6addr string
+		wantIP, wantIP6 string
+		wantWarning     string
+		wantErr         string
+	}{
+		{policy: policyReject, ipaddr: "8.8.8.8", ip6addr: "2001:4860:0::01", wantIP: "8.8.8.8", wantIP6: "2001:4860::1"},
+		{policy: policyReject, ipaddr: "::ffff:8.8.8.8", wantIP: "8.8.8.8"},
+		{policy: policyReject},
+		{policy: policyReject, ipaddr: "8.8.8", wantErr: `ipaddr "8.8.8" does not parse`},
+		{policy: policyReject, ipaddr: "2001:4860::1", wantErr: "ipaddr 2001:4860::1 is of the wrong family"},
+		{policy: policyReject, ip6addr: "8.8.8.8", wantErr: "ip6addr 8.8.8.8 is of the wrong family"},
+		{policy: policyReject, ip6addr: "::ffff:8.8.8.8", wantErr: "is of the wrong family"},
+		{policy: policyReject, ip6addr: "fe80::1%eth0", wantErr: "has a zone"},
+		{policy: policyAccept, ipaddr: "0.0.0.0", wantErr: "is not a host address"},
+		{policy: policyAccept, ip6addr: "ff02::1", wantErr: "is not a host address"},
+		{policy: policyReject, ipaddr: "192.168.1.1", wantErr: "ipaddr 192.168.1.1 is in a private range"},
+		{policy: policyReject, ipaddr: "100.64.0.1", wantErr: "in a CGNAT range"},
+		{policy: policyReject, ipaddr: "127.0.0.1", wantErr: "in a loopback range"},
+		{policy: policyReject, ipaddr: "169.254.1.1", wantErr: "in a link-local range"},
+		{policy: policyReject, ipaddr: "192.0.2.1", wantErr: "in a documentation range"},
+		{policy: policyReject, ip6addr: "fd00::1", wantErr: "in a ULA range"},
+		{policy: policyReject, ip6addr: "2001:db8::1", wantErr: "in a documentation range"},
+		{policy: policyAccept, ipaddr: "192.168.1.1", ip6addr: "fd00::1", wantIP: "192.168.1.1", wantIP6: "fd00::1"},
+		{policy: policyIgnore, ipaddr: "10.0.0.1", ip6addr: "2001:4860::1", wantIP6: "2001:4860::1",
+			wantWarning: "ignored ipaddr 10.0.0.1 is in a private range"},
+		{policy: policyIgnore, ipaddr: "10.0.0.1", ip6addr: "fe80::1",
+			wantWarning: "ignored ipaddr 10.0.0.1 is in a private range, ignored ip6addr fe80::1 is in a link-local range"},
+		{policy: policyIgnore, ipaddr: "garbage", wantErr: "does not parse"},
+	} {
+		ip, ip6, warning, err := checkAddrs(tc.policy, tc.ipaddr, tc.ip6addr)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) || !errors.Is(err, errBadAddr) {
+				t.Errorf("%s %q %q: got error %v, want %q", tc.policy, tc.ipaddr, tc.ip6addr, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || ip != tc.wantIP || ip6 != tc.wantIP6 || warning != tc.wantWarning {
+			t.Errorf("%s %q %q: got %q %q %q %v, want %q %q %q", tc.policy, tc.ipaddr, tc.ip6addr,
+				ip, ip6, warning, err, tc.wantIP, tc.wantIP6, tc.wantWarning)
+		}
+	}
+}
+
+func TestCheckAddrPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", policyReject, true},
+		{policyIgnore, policyIgnore, true},
+		{policyAccept, policyAccept, true},
+		{"drop", "", false},
+	} {
+		got, err := checkAddrPolicy(tc.in)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("%q: got %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
@@ -1,30 +1,115 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"html/template"
 	"log/slog"
+	"mime"
 	"net/http"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
 
 //go:embed templates/*.html
 var templateFS embed.FS
 
+// historyPageSize is the number of address changes per page on the host
+// page.
+const historyPageSize = 20
+
 type AdminHandler struct {
-	DB *sqlx.DB
+	DB    *sqlx.DB
+	Queue *Queue
+	// Limiter is the rate limiter of the update requests, shown with the
+	// limits the CGI program keeps in the database.
+	Limiter *Limiter
+	// AuthHeader names the request header a reverse proxy passes the
+	// authenticated user in. If it is empty, users log in with the
+	// passwords in the users table.
+	AuthHeader string
+	// SessionMaxAge is how long a login lasts.
+	SessionMaxAge time.Duration
+	// InsecureCookie allows the session and CSRF cookies over plain HTTP.
+	InsecureCookie bool
+
+	mux *http.ServeMux
+	cop *http.CrossOriginProtection
 }
 
-func NewAdminHandler(db *sqlx.DB) *AdminHandler {
-	return &AdminHandler{DB: db}
+func NewAdminHandler(db *sqlx.DB, queue *Queue, limiter *Limiter) *AdminHandler {
+	h := &AdminHandler{
+		DB:             db,
+		Queue:          queue,
+		Limiter:        limiter,
+		AuthHeader:     os.Getenv("ADMIN_AUTH_HEADER"),
+		SessionMaxAge:  12 * time.Hour,
+		InsecureCookie: os.Getenv("SESSION_COOKIE_SECURE") == "false",
+	}
+	if d, err := time.ParseDuration(os.Getenv("SESSION_MAX_AGE")); err == nil && d > 0 {
+		h.SessionMaxAge = d
+	}
+	if proxies := trustedProxies(); h.AuthHeader != "" && len(proxies.prefixes) == 0 && !proxies.unix {
+		slog.Warn("ADMIN_AUTH_HEADER is set without TRUSTED_PROXIES, the admin interface rejects every request")
+	}
+	h.cop = http.NewCrossOriginProtection()
+	for _, origin := range strings.Fields(os.Getenv("ADMIN_TRUSTED_ORIGINS")) {
+		err := h.cop.AddTrustedOrigin(origin)
+		if err != nil {
+			slog.Error("ADMIN_TRUSTED_ORIGINS", "origin", origin, "err", err)
+		}
+	}
+	// Every route names its methods, anything else is answered with 405
+	// Method Not Allowed by the mux. GET routes must not change anything.
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("GET /admin/{$}", h.handleHosts)
+	h.mux.HandleFunc("GET /admin/login", h.handleLogin)
+	h.mux.HandleFunc("POST /admin/login", h.handleLogin)
+	h.mux.HandleFunc("POST /admin/logout", h.handleLogout)
+	h.mux.HandleFunc("GET /admin/host/new", h.handleHostNew)
+	h.mux.HandleFunc("POST /admin/host/new", h.handleHostNew)
+	h.mux.HandleFunc("GET /admin/host/{id}", h.handleHostEdit)
+	h.mux.HandleFunc("POST /admin/host/{id}", h.handleHostEdit)
+	h.mux.HandleFunc("DELETE /admin/host/{id}", h.handleHostEdit)
+	h.mux.HandleFunc("POST /admin/host/{id}/push", h.handleHostPush)
+	h.mux.HandleFunc("POST /admin/host/{id}/token", h.handleHostToken)
+	h.mux.HandleFunc("POST /admin/host/{id}/records", h.handleRecordAdd)
+	h.mux.HandleFunc("POST /admin/host/{id}/devices", h.handleDeviceAdd)
+	h.mux.HandleFunc("GET /admin/host/{id}/history.csv", h.handleHostHistory)
+	h.mux.HandleFunc("GET /admin/host/{id}/history.json", h.handleHostHistory)
+	h.mux.HandleFunc("POST /admin/records/{id}/inherit", h.handleRecordInherit)
+	h.mux.HandleFunc("DELETE /admin/records/{id}", h.handleRecordDelete)
+	h.mux.HandleFunc("DELETE /admin/devices/{id}", h.handleDeviceDelete)
+	h.mux.HandleFunc("GET /admin/limits", h.handleLimits)
+	h.mux.HandleFunc("DELETE /admin/limits", h.handleLimitReset)
+	h.mux.HandleFunc("POST /admin/updates", h.handleUpdates)
+	h.mux.HandleFunc("DELETE /admin/updates/{id}", h.handleUpdates)
+	h.mux.HandleFunc("GET /admin/updates/{id}", h.handleUpdateRow)
+	h.mux.HandleFunc("GET /admin/updates/{id}/edit", h.handleUpdateRow)
+	h.mux.HandleFunc("POST /admin/updates/{id}", h.handleUpdateSave)
+	h.mux.HandleFunc("POST /admin/updates/{id}/enabled", h.handleUpdateEnabled)
+	h.mux.HandleFunc("POST /admin/updates/{id}/up", h.handleUpdateMove)
+	h.mux.HandleFunc("POST /admin/updates/{id}/down", h.handleUpdateMove)
+	h.mux.HandleFunc("GET /admin/updates/{id}/clone", h.handleUpdateClone)
+	h.mux.HandleFunc("POST /admin/updates/{id}/clone", h.handleUpdateClone)
+	h.mux.HandleFunc("POST /admin/updates/{id}/test", h.handleUpdateApply)
+	h.mux.HandleFunc("POST /admin/updates/{id}/run", h.handleUpdateApply)
+	return h
 }
 
-func (h *AdminHandler) render(w http.ResponseWriter, tmplName string, data any) {
+func (h *AdminHandler) render(w http.ResponseWriter, r *http.Request, tmplName string, data map[string]any) {
+	data["User"] = adminUser(r.Context())
+	data["SessionAuth"] = h.AuthHeader == ""
+	data["CSRFToken"] = h.csrfToken(w, r)
 	tmpl, err := template.ParseFS(templateFS, "templates/layout.html", "templates/"+tmplName)
 	if err != nil {
 		slog.Error("template parse error", "err", err)
@@ -50,41 +135,125 @@ func (h *AdminHandler) renderBlock(w http.ResponseWriter, tmplName string, block
 	}
 }
 
+// ServeHTTP rejects cross-origin requests and requests that change state
+// without a valid CSRF token, sends unauthenticated users to the login page
+// and then dispatches to the route.
 func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/admin")
-	if path == "" || path == "/" {
-		h.handleHosts(w, r)
-		return
-	}
-	if strings.HasPrefix(path, "/host/new") {
-		h.handleHostNew(w, r)
+	err := h.cop.Check(r)
+	if err != nil {
+		slog.Warn("admin cross-origin request", "method", r.Method, "path", r.URL.Path, "remote", remoteHost(r), "err", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	if strings.HasPrefix(path, "/host/") {
-		token := strings.TrimPrefix(path, "/host/")
-		h.handleHostEdit(w, r, token)
+	if !checkCSRF(r) {
+		slog.Warn("admin CSRF token mismatch", "method", r.Method, "path", r.URL.Path, "remote", remoteHost(r))
+		http.Error(w, "Forbidden: invalid CSRF token, reload the page", http.StatusForbidden)
 		return
 	}
-	if strings.HasPrefix(path, "/updates") {
-		h.handleUpdates(w, r)
-		return
+	if r.URL.Path != "/admin/login" {
+		user, err := h.authenticate(r)
+		if err != nil {
+			slog.Error("authenticate", "err", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if user == "" {
+			h.requireLogin(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
 	}
-	http.NotFound(w, r)
+	h.mux.ServeHTTP(w, r)
 }
 
 func (h *AdminHandler) handleHosts(w http.ResponseWriter, r *http.Request) {
-	var hosts []Host
-	err := h.DB.SelectContext(r.Context(), &hosts, "SELECT * FROM hosts ORDER BY created DESC")
+	hosts, err := hostStatuses(r.Context(), h.DB)
 	if err != nil {
 		slog.Error("Select hosts", "err", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	h.render(w, "hosts.html", map[string]any{
+	var drifts []HostDrift
+	err = h.DB.SelectContext(r.Context(), &drifts, "SELECT * FROM host_drift")
+	if err != nil {
+		slog.Error("Select drift", "err", err)
+	}
+	driftByHost := make(map[int64]HostDrift)
+	for _, drift := range drifts {
+		driftByHost[drift.HostId] = drift
+	}
+	h.render(w, r, "hosts.html", map[string]any{
 		"Hosts": hosts,
+		"Drift": driftByHost,
 	})
 }
 
+// limitRow is a limited or locked out source address or token on the
+// limits page.
+type limitRow struct {
+	LimitState
+	// Name is the host of a token, empty if it is unknown.
+	Name   string
+	Locked bool
+}
+
+// handleLimits shows the rate limit configuration and the source addresses
+// and tokens currently limited or locked out.
+func (h *AdminHandler) handleLimits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	states, err := h.Limiter.States(ctx)
+	if err != nil {
+		slog.Error("Limiter states", "err", err)
+	}
+	cgiStates, err := h.Limiter.dbView(h.DB).States(ctx)
+	if err != nil {
+		slog.Error("Select rate limits", "err", err)
+	}
+	var tokens []struct {
+		TokenHash string `db:"token_hash"`
+		Name      string
+	}
+	err = h.DB.SelectContext(ctx, &tokens, "SELECT t.token_hash, h.name FROM host_tokens t JOIN hosts h ON h.id = t.host_id")
+	if err != nil {
+		slog.Error("Select tokens", "err", err)
+	}
+	names := make(map[string]string)
+	for _, t := range tokens {
+		names[t.TokenHash] = t.Name
+	}
+	now := time.Now()
+	var rows []limitRow
+	for _, st := range append(states, cgiStates...) {
+		row := limitRow{LimitState: st, Locked: st.Locked(now)}
+		if st.IsToken() {
+			row.Name = names[st.Subject()]
+		}
+		rows = append(rows, row)
+	}
+	h.render(w, r, "limits.html", map[string]any{
+		"Limiter": h.Limiter,
+		"Limits":  rows,
+	})
+}
+
+// handleLimitReset lifts the limits and the lockout of the key in the
+// query.
+func (h *AdminHandler) handleLimitReset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := r.URL.Query().Get("key")
+	err := h.Limiter.Reset(ctx, key)
+	if err == nil {
+		err = h.Limiter.dbView(h.DB).Reset(ctx, key)
+	}
+	if err != nil {
+		slog.Error("Reset limit", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin limit reset", "key", key, "user", adminUser(ctx))
+	w.WriteHeader(http.StatusOK) // HTMX will remove the element
+}
+
 func (h *AdminHandler) handleHostNew(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		err := r.ParseForm()
@@ -93,45 +262,82 @@ func (h *AdminHandler) handleHostNew(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		host := Host{
-			Name:   r.FormValue("name"),
-			Token:  r.FormValue("token"),
-			Domain: r.FormValue("domain"),
-			Zone:   r.FormValue("zone"),
+			Name:     r.FormValue("name"),
+			Domain:   r.FormValue("domain"),
+			Zone:     r.FormValue("zone"),
+			AutoAddr: r.FormValue("auto_addr") == "true",
 		}
-		if host.Token == "" {
-			host.Token = uuid.NewString()
+		host.CheckinInterval, err = parseCheckinInterval(r.FormValue("checkin_interval"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
 		}
-		
-		ip4 := r.FormValue("ip4addr")
-		if ip4 != "" {
-			host.Ip4addr = &ip4
+		host.Ip4addr, host.Ip6addr, err = hostAddrs(r.FormValue("ip4addr"), r.FormValue("ip6addr"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
 		}
-		ip6 := r.FormValue("ip6addr")
-		if ip6 != "" {
-			host.Ip6addr = &ip6
+		host.AddrPolicy, err = checkAddrPolicy(r.FormValue("addr_policy"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = setGuards(&host, r.FormValue("allowed_sources"), r.FormValue("require_source") == "true", r.FormValue("cert_fingerprint"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		_, err = h.DB.ExecContext(r.Context(), "INSERT INTO hosts (token, name, domain, zone, ip4addr, ip6addr) VALUES (?, ?, ?, ?, ?, ?)",
-			host.Token, host.Name, host.Domain, host.Zone, host.Ip4addr, host.Ip6addr)
-		
+		token, err := insertHost(r.Context(), h.DB, &host, r.FormValue("token"))
+		if errors.Is(err, errTokenInUse) || errors.Is(err, errTokenTooShort) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		if err != nil {
 			slog.Error("Insert host", "err", err)
 			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+		slog.Info("admin host created", "host", host.Name, "id", host.Id, "user", adminUser(r.Context()))
+		h.renderToken(w, r, &host, token, nil)
 		return
 	}
 
-	h.render(w, "host_edit.html", map[string]any{
+	h.render(w, r, "host_edit.html", map[string]any{
 		"IsNew": true,
-		"Host":  Host{},
+		"Host":  HostStatus{},
 	})
 }
 
-func (h *AdminHandler) handleHostEdit(w http.ResponseWriter, r *http.Request, token string) {
+// renderToken shows the token of host once, after the host was created or
+// its token rotated. Only the hash is stored, so it cannot be shown again.
+func (h *AdminHandler) renderToken(w http.ResponseWriter, r *http.Request, host *Host, token string, expires *time.Time) {
+	w.Header().Set("Cache-Control", "no-store")
+	h.render(w, r, "host_token.html", map[string]any{
+		"Host":    host,
+		"Token":   token,
+		"Expires": expires,
+	})
+}
+
+// pathHostID returns the host id in the path. If it is not a number, the
+// error has been sent and false is returned.
+func pathHostID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *AdminHandler) handleHostEdit(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathHostID(w, r)
+	if !ok {
+		return
+	}
 	if r.Method == "DELETE" {
-		_, err := h.DB.ExecContext(r.Context(), "DELETE FROM hosts WHERE token = ?", token)
+		_, err := deleteHost(r.Context(), h.DB, id)
 		if err != nil {
 			slog.Error("Delete host", "err", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
@@ -148,97 +354,194 @@ func (h *AdminHandler) handleHostEdit(w http.ResponseWriter, r *http.Request, to
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
-		
+
 		name := r.FormValue("name")
 		domain := r.FormValue("domain")
 		zone := r.FormValue("zone")
-		ip4 := r.FormValue("ip4addr")
-		ip6 := r.FormValue("ip6addr")
-		
-		var ip4ptr, ip6ptr *string
-		if ip4 != "" { ip4ptr = &ip4 }
-		if ip6 != "" { ip6ptr = &ip6 }
+		ip4ptr, ip6ptr, err := hostAddrs(r.FormValue("ip4addr"), r.FormValue("ip6addr"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		checkin, err := parseCheckinInterval(r.FormValue("checkin_interval"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		policy, err := checkAddrPolicy(r.FormValue("addr_policy"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		_, err = h.DB.ExecContext(r.Context(), "UPDATE hosts SET name=?, domain=?, zone=?, ip4addr=?, ip6addr=? WHERE token=?",
-			name, domain, zone, ip4ptr, ip6ptr, token)
-		
+		host := Host{Id: id, Name: name, Domain: domain, Zone: zone, Ip4addr: ip4ptr, Ip6addr: ip6ptr, CheckinInterval: checkin,
+			AutoAddr: r.FormValue("auto_addr") == "true", AddrPolicy: policy}
+		err = setGuards(&host, r.FormValue("allowed_sources"), r.FormValue("require_source") == "true", r.FormValue("cert_fingerprint"))
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = saveHost(r.Context(), h.DB, &host, sourceAdmin, remoteHost(r))
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
 		if err != nil {
 			slog.Error("Update host", "err", err)
 			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		http.Redirect(w, r, "/admin/host/"+token, http.StatusSeeOther)
+		http.Redirect(w, r, "/admin/host/"+strconv.FormatInt(id, 10), http.StatusSeeOther)
 		return
 	}
 
-	var host Host
-	err := h.DB.GetContext(r.Context(), &host, "SELECT * FROM hosts WHERE token = ?", token)
+	var host HostStatus
+	err := h.DB.GetContext(r.Context(), &host.Host, "SELECT * FROM hosts WHERE id = ?", id)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	err = h.DB.GetContext(r.Context(), &host.Seen, "SELECT * FROM host_seen WHERE host_id = ?", id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("Select seen", "err", err)
+	}
 
 	var updates []Update
-	err = h.DB.SelectContext(r.Context(), &updates, "SELECT * FROM updates WHERE token = ?", token)
+	err = h.DB.SelectContext(r.Context(), &updates, "SELECT * FROM updates WHERE host_id = ? ORDER BY position, id", id)
 	if err != nil {
 		slog.Error("Select updates", "err", err)
 	}
 
-	h.render(w, "host_edit.html", map[string]any{
-		"IsNew":   false,
-		"Host":    host,
-		"Updates": updates,
+	var runs []Run
+	err = h.DB.SelectContext(r.Context(), &runs, "SELECT * FROM update_runs WHERE host_id = ? ORDER BY update_id, id DESC", id)
+	if err != nil {
+		slog.Error("Select runs", "err", err)
+	}
+	runsByUpdate := make(map[int64][]Run)
+	for _, run := range runs {
+		if len(runsByUpdate[run.UpdateId]) < 10 {
+			runsByUpdate[run.UpdateId] = append(runsByUpdate[run.UpdateId], run)
+		}
+	}
+
+	drift, err := hostDrift(r.Context(), h.DB, id)
+	if err != nil {
+		slog.Error("Select drift", "err", err)
+	}
+
+	tokens, err := hostTokens(r.Context(), h.DB, id)
+	if err != nil {
+		slog.Error("Select tokens", "err", err)
+	}
+
+	records, err := hostRecords(r.Context(), h.DB, id)
+	if err != nil {
+		slog.Error("Select records", "err", err)
+	}
+
+	devices, err := lanDevices(r.Context(), h.DB, id)
+	if err != nil {
+		slog.Error("Select devices", "err", err)
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(page, 1)
+	history, err := ipHistory(r.Context(), h.DB, id, historyPageSize+1, (page-1)*historyPageSize)
+	if err != nil {
+		slog.Error("Select history", "err", err)
+	}
+	hasMore := len(history) > historyPageSize
+	if hasMore {
+		history = history[:historyPageSize]
+	}
+
+	h.render(w, r, "host_edit.html", map[string]any{
+		"IsNew":    false,
+		"Host":     host,
+		"Drift":    drift,
+		"Tokens":   tokens,
+		"Records":  records,
+		"Devices":  devices,
+		"Grace":    tokenGracePeriod().String(),
+		"History":  history,
+		"Page":     page,
+		"PrevPage": page - 1,
+		"NextPage": page + 1,
+		"HasMore":  hasMore,
+		"Updates":  updates,
+		"Runs":     runsByUpdate,
+		"Updaters": UpdaterNames(),
 	})
 }
 
+// updateFromForm returns the update method described by the posted form.
+func updateFromForm(r *http.Request) Update {
+	hostID, _ := strconv.ParseInt(r.PostFormValue("host_id"), 10, 64)
+	u := Update{
+		HostId: hostID,
+		Cmd:    r.PostFormValue("cmd"),
+		Args:   r.PostFormValue("args"),
+	}
+	if apiKey := r.PostFormValue("api_key"); apiKey != "" {
+		u.ApiKey = &apiKey
+	}
+	if config := r.PostFormValue("config"); config != "" {
+		u.Config = &config
+	}
+	if recordID, err := strconv.ParseInt(r.PostFormValue("record_id"), 10, 64); err == nil {
+		u.RecordId = &recordID
+	}
+	return u
+}
+
+// pathUpdate returns the update method named by the id in the path. If
+// there is none, the error has been sent and nil is returned.
+func (h *AdminHandler) pathUpdate(w http.ResponseWriter, r *http.Request) *Update {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil
+	}
+	var u Update
+	err = h.DB.GetContext(r.Context(), &u, "SELECT * FROM updates WHERE id = ?", id)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	return &u
+}
+
 func (h *AdminHandler) handleUpdates(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		err := r.ParseForm()
+		u := updateFromForm(r)
+		err := validateUpdate(&u)
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 			return
 		}
-		token := r.FormValue("token")
-		cmd := r.FormValue("cmd")
-		args := r.FormValue("args")
-		apiKey := r.FormValue("api_key")
-		
-		var apiKeyPtr *string
-		if apiKey != "" {
-			apiKeyPtr = &apiKey
+		if checkRecord(r.Context(), h.DB, &u) != nil {
+			http.Error(w, "Unknown record", http.StatusUnprocessableEntity)
+			return
 		}
-
-		res, err := h.DB.ExecContext(r.Context(), "INSERT INTO updates (token, cmd, args, api_key) VALUES (?, ?, ?, ?)",
-			token, cmd, args, apiKeyPtr)
+		u.Enabled = true
+		err = insertUpdate(r.Context(), h.DB, &u)
 		if err != nil {
 			slog.Error("Insert update", "err", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		id, _ := res.LastInsertId()
-		
 		// Return the new row
-		update := Update{
-			Id: id,
-			Token: token,
-			Cmd: cmd,
-			Args: args,
-			ApiKey: apiKeyPtr,
-			Modified: time.Now(),
-			Created: time.Now(),
-		}
-		h.renderBlock(w, "host_edit.html", "update_row", update)
+		h.renderBlock(w, "host_edit.html", "update_row", u)
 		return
 	}
 
 	if r.Method == "DELETE" {
-		idStr := strings.TrimPrefix(r.URL.Path, "/admin/updates/")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 		if err != nil {
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
-		_, err = h.DB.ExecContext(r.Context(), "DELETE FROM updates WHERE id = ?", id)
+		_, err = deleteUpdate(r.Context(), h.DB, id)
 		if err != nil {
 			slog.Error("Delete update", "err", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
@@ -247,4 +550,504 @@ func (h *AdminHandler) handleUpdates(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK) // HTMX will remove the element
 		return
 	}
-}
\ No newline at end of file
+}
+
+// handleUpdateRow renders the row of an update method, or with /edit the
+// form to edit it in place.
+func (h *AdminHandler) handleUpdateRow(w http.ResponseWriter, r *http.Request) {
+	u := h.pathUpdate(w, r)
+	if u == nil {
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/edit") {
+		h.renderBlock(w, "host_edit.html", "update_edit_row", map[string]any{
+			"Update":   u,
+			"Updaters": UpdaterNames(),
+		})
+		return
+	}
+	h.renderBlock(w, "host_edit.html", "update_row", u)
+}
+
+// handleUpdateSave changes the method, args, API key variable and config of
+// an update method. It keeps its id, so its runs stay attached to it.
+func (h *AdminHandler) handleUpdateSave(w http.ResponseWriter, r *http.Request) {
+	u := h.pathUpdate(w, r)
+	if u == nil {
+		return
+	}
+	changed := updateFromForm(r)
+	u.Cmd, u.Args, u.ApiKey, u.Config = changed.Cmd, changed.Args, changed.ApiKey, changed.Config
+	err := validateUpdate(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	_, err = h.DB.ExecContext(r.Context(), "UPDATE updates SET cmd = ?, args = ?, api_key = ?, config = ? WHERE id = ?",
+		u.Cmd, u.Args, u.ApiKey, u.Config, u.Id)
+	if err != nil {
+		slog.Error("Update update", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin update method changed", "update", u.Id, "cmd", u.Cmd, "user", adminUser(r.Context()))
+	h.renderBlock(w, "host_edit.html", "update_row", u)
+}
+
+// handleUpdateEnabled switches an update method on or off. Disabled update
+// methods are not queued, jobs already queued for them are dropped.
+func (h *AdminHandler) handleUpdateEnabled(w http.ResponseWriter, r *http.Request) {
+	u := h.pathUpdate(w, r)
+	if u == nil {
+		return
+	}
+	u.Enabled = r.PostFormValue("enabled") == "true"
+	err := h.setUpdateEnabled(r.Context(), u)
+	if err != nil {
+		slog.Error("Update update", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.renderBlock(w, "host_edit.html", "update_row", u)
+}
+
+// setUpdateEnabled stores whether u is enabled and drops the jobs still
+// waiting for it when it is disabled.
+func (h *AdminHandler) setUpdateEnabled(ctx context.Context, u *Update) error {
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "UPDATE updates SET enabled = ? WHERE id = ?", u.Enabled, u.Id)
+	if err != nil {
+		return err
+	}
+	if !u.Enabled {
+		_, err = tx.ExecContext(ctx, "DELETE FROM jobs WHERE update_id = ? AND state = ?", u.Id, jobPending)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleUpdateMove moves an update method one place up or down among those
+// of its host and renders the reordered list.
+func (h *AdminHandler) handleUpdateMove(w http.ResponseWriter, r *http.Request) {
+	u := h.pathUpdate(w, r)
+	if u == nil {
+		return
+	}
+	ctx := r.Context()
+	updates, err := h.moveUpdate(ctx, u, strings.HasSuffix(r.URL.Path, "/up"))
+	if err != nil {
+		slog.Error("Move update", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.renderBlock(w, "host_edit.html", "update_rows", updates)
+}
+
+// moveUpdate swaps u with its neighbour and numbers the update methods of
+// the host from 1 again. It returns them in their new order.
+func (h *AdminHandler) moveUpdate(ctx context.Context, u *Update, up bool) ([]Update, error) {
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var updates []Update
+	err = tx.SelectContext(ctx, &updates, "SELECT * FROM updates WHERE host_id = ? ORDER BY position, id", u.HostId)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(updates, func(other Update) bool { return other.Id == u.Id })
+	j := i + 1
+	if up {
+		j = i - 1
+	}
+	if i >= 0 && j >= 0 && j < len(updates) {
+		updates[i], updates[j] = updates[j], updates[i]
+	}
+	for i := range updates {
+		updates[i].Position = int64(i + 1)
+		_, err = tx.ExecContext(ctx, "UPDATE updates SET position = ? WHERE id = ?", updates[i].Position, updates[i].Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return updates, tx.Commit()
+}
+
+// handleUpdateClone asks for the host to copy an update method to, and
+// adds the copy as the last update method of that host.
+func (h *AdminHandler) handleUpdateClone(w http.ResponseWriter, r *http.Request) {
+	u := h.pathUpdate(w, r)
+	if u == nil {
+		return
+	}
+	ctx := r.Context()
+	if r.Method == "GET" {
+		var hosts []Host
+		err := h.DB.SelectContext(ctx, &hosts, "SELECT * FROM hosts ORDER BY name")
+		if err != nil {
+			slog.Error("Select hosts", "err", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		h.renderBlock(w, "host_edit.html", "clone_form", map[string]any{
+			"Update": u,
+			"Hosts":  hosts,
+		})
+		return
+	}
+	var target Host
+	err := h.DB.GetContext(ctx, &target, "SELECT * FROM hosts WHERE id = ?", r.PostFormValue("target"))
+	if err != nil {
+		http.Error(w, "Unknown host", http.StatusUnprocessableEntity)
+		return
+	}
+	clone := *u
+	if target.Id != u.HostId {
+		// The record belongs to the original host.
+		clone.RecordId = nil
+	}
+	clone.HostId = target.Id
+	// Stored before its updater checked it, or the updater changed.
+	err = validateUpdate(&clone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	err = insertUpdate(ctx, h.DB, &clone)
+	if err != nil {
+		slog.Error("Clone update", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin update method cloned", "update", u.Id, "clone", clone.Id, "host", target.Name, "user", adminUser(ctx))
+	h.renderBlock(w, "host_edit.html", "clone_result", map[string]any{
+		"Update": u,
+		"Id":     clone.Id,
+		"Host":   target,
+	})
+}
+
+// handleUpdateApply serves /admin/updates/{id}/test and /admin/updates/{id}/run.
+// Test renders what the update method would do with the current addresses
+// of its host without executing it, run executes it right away and records
+// the run like a queued execution. Both are done for every domain the
+// update method applies to.
+func (h *AdminHandler) handleUpdateApply(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	var u Update
+	err = h.DB.GetContext(r.Context(), &u, "SELECT * FROM updates WHERE id = ?", id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var host Host
+	err = h.DB.GetContext(r.Context(), &host, "SELECT * FROM hosts WHERE id = ?", u.HostId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	targets, err := updateTargets(r.Context(), h.DB, &host, &u)
+	if err != nil {
+		slog.Error("Select records", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	dryRun := strings.HasSuffix(r.URL.Path, "/test")
+	for _, target := range targets {
+		// There is no reporting request, so the update method sees the host
+		// unchanged and a form as the FRITZ!Box would send it.
+		old := *target
+		run, err := applyUpdate(r.Context(), h.DB, target, &u, &old, hostForm(target), dryRun)
+		if err != nil {
+			slog.Warn("admin apply update", "update", u.Id, "domain", target.Domain, "dryRun", dryRun, "err", err)
+		}
+		h.renderBlock(w, "host_edit.html", "update_result", map[string]any{
+			"Update": u,
+			"Run":    run,
+			"DryRun": dryRun,
+		})
+	}
+}
+
+// handleRecordAdd adds a record to the host and returns to the host page.
+func (h *AdminHandler) handleRecordAdd(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathHostID(w, r)
+	if !ok {
+		return
+	}
+	rec := HostRecord{
+		HostId:  id,
+		Domain:  r.PostFormValue("domain"),
+		Zone:    r.PostFormValue("zone"),
+		Inherit: r.PostFormValue("inherit") == "true",
+	}
+	err := insertRecord(r.Context(), h.DB, &rec)
+	switch {
+	case errors.Is(err, errNoDomain), errors.Is(err, errRecordExists):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		// Most likely the host does not exist.
+		slog.Error("Insert record", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin record added", "host", id, "domain", rec.Domain, "user", adminUser(r.Context()))
+	http.Redirect(w, r, "/admin/host/"+strconv.FormatInt(id, 10)+"#records", http.StatusSeeOther)
+}
+
+// pathRecord returns the record named by the id in the path. If there is
+// none, the error has been sent and nil is returned.
+func (h *AdminHandler) pathRecord(w http.ResponseWriter, r *http.Request) *HostRecord {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil
+	}
+	rec, err := hostRecord(r.Context(), h.DB, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	return rec
+}
+
+// handleRecordInherit switches whether a record is updated by the update
+// methods of its host as well.
+func (h *AdminHandler) handleRecordInherit(w http.ResponseWriter, r *http.Request) {
+	rec := h.pathRecord(w, r)
+	if rec == nil {
+		return
+	}
+	rec.Inherit = r.PostFormValue("inherit") == "true"
+	err := saveRecord(r.Context(), h.DB, rec)
+	if err != nil {
+		slog.Error("Update record", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.renderBlock(w, "host_edit.html", "record_row", rec)
+}
+
+// handleRecordDelete removes a record together with its update methods.
+func (h *AdminHandler) handleRecordDelete(w http.ResponseWriter, r *http.Request) {
+	rec := h.pathRecord(w, r)
+	if rec == nil {
+		return
+	}
+	err := deleteRecord(r.Context(), h.DB, rec.Id)
+	if err != nil {
+		slog.Error("Delete record", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin record deleted", "host", rec.HostId, "domain", rec.Domain, "user", adminUser(r.Context()))
+	w.WriteHeader(http.StatusOK) // HTMX will remove the element
+}
+
+// handleDeviceAdd adds a LAN device to the host.
+func (h *AdminHandler) handleDeviceAdd(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathHostID(w, r)
+	if !ok {
+		return
+	}
+	var host Host
+	err := h.DB.GetContext(r.Context(), &host, "SELECT * FROM hosts WHERE id = ?", id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	dev := LanDevice{
+		Domain:  r.PostFormValue("domain"),
+		Zone:    r.PostFormValue("zone"),
+		Ether:   optional(r.PostFormValue("ether")),
+		IfaceId: optional(r.PostFormValue("iface_id")),
+	}
+	err = insertLanDevice(r.Context(), h.DB, h.Queue, &host, &dev)
+	switch {
+	case errors.Is(err, errNoDomain), errors.Is(err, errDeviceExists), errors.Is(err, errDeviceIID), errors.Is(err, errBadAddr):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		slog.Error("Insert device", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin device added", "host", id, "domain", dev.Domain, "user", adminUser(r.Context()))
+	http.Redirect(w, r, "/admin/host/"+strconv.FormatInt(id, 10)+"#devices", http.StatusSeeOther)
+}
+
+// handleDeviceDelete removes a LAN device.
+func (h *AdminHandler) handleDeviceDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	dev, err := lanDevice(r.Context(), h.DB, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = deleteLanDevice(r.Context(), h.DB, dev.Id)
+	if err != nil {
+		slog.Error("Delete device", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin device deleted", "host", dev.HostId, "domain", dev.Domain, "user", adminUser(r.Context()))
+	w.WriteHeader(http.StatusOK) // HTMX will remove the element
+}
+
+// enqueueDevices queues the update methods of host for each of its LAN
+// devices that has an address.
+func (h *AdminHandler) enqueueDevices(ctx context.Context, tx *sqlx.Tx, host *Host) error {
+	devs, err := lanDevices(ctx, tx, host.Id)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		if dev.Ip6addr == nil {
+			continue
+		}
+		err = h.Queue.EnqueueDevice(ctx, tx, host, &dev, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleHostPush queues every update method of the host, whether or not
+// its addresses changed.
+func (h *AdminHandler) handleHostPush(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathHostID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		slog.Error("BeginTxx", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var host Host
+	err = tx.GetContext(ctx, &host, "SELECT * FROM hosts WHERE id = ?", id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var count int
+	err = h.Queue.Enqueue(ctx, tx, &host, hostForm(&host))
+	if err == nil {
+		err = h.enqueueDevices(ctx, tx, &host)
+	}
+	if err == nil {
+		err = tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM jobs WHERE host_id = ? AND state = ?", id, jobPending)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		slog.Error("Push host", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.Queue.Notify()
+	h.renderBlock(w, "host_edit.html", "push_result", count)
+}
+
+// handleHostToken gives the host a new token and shows it once. The old
+// token keeps working for the grace period posted, e.g. "24h", so that
+// the router can be reconfigured.
+func (h *AdminHandler) handleHostToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathHostID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	grace := tokenGracePeriod()
+	if s := r.PostFormValue("grace"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			http.Error(w, "Bad Request: invalid grace period "+s, http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	var host Host
+	err := h.DB.GetContext(ctx, &host, "SELECT * FROM hosts WHERE id = ?", id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	token, err := rotateHostToken(ctx, h.DB, id, grace)
+	if err != nil {
+		slog.Error("Rotate token", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin host token rotated", "host", host.Name, "id", id, "grace", grace, "user", adminUser(ctx))
+	var expires *time.Time
+	if grace > 0 {
+		t := time.Now().Add(grace)
+		expires = &t
+	}
+	h.renderToken(w, r, &host, token, expires)
+}
+
+// handleHostHistory exports the complete address history of a host as CSV
+// or JSON.
+func (h *AdminHandler) handleHostHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathHostID(w, r)
+	if !ok {
+		return
+	}
+	format := "csv"
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		format = "json"
+	}
+	var host Host
+	err := h.DB.GetContext(r.Context(), &host, "SELECT * FROM hosts WHERE id = ?", id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := ipHistory(r.Context(), h.DB, id, -1, 0)
+	if err != nil {
+		slog.Error("Select history", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	filename := host.Name + "-history." + format
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if history == nil {
+			history = []IPChange{}
+		}
+		json.NewEncoder(w).Encode(history)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"changed", "old_ip4addr", "ip4addr", "old_ip6addr", "ip6addr", "source", "remote_addr"})
+	for _, c := range history {
+		cw.Write([]string{c.Changed.UTC().Format(time.RFC3339), deref(c.OldIp4addr), deref(c.Ip4addr),
+			deref(c.OldIp6addr), deref(c.Ip6addr), c.Source, c.RemoteAddr})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAdmin returns an admin handler on a new test database that
+// trusts the user in the X-User header set by serveAdmin.
+func newTestAdmin(t *testing.T) *AdminHandler {
+	t.Helper()
+	setTrustedProxies(t, "192.0.2.1")
+	db := newTestDB(t)
+	h := NewAdminHandler(db, NewQueue(db), NewLimiter())
+	h.AuthHeader = "X-User"
+	return h
+}
+
+// serveAdmin sends a request with form as body and a valid CSRF token
+// from the trusted proxy to h.
+func serveAdmin(h *AdminHandler, method, target string, form url.Values) *httptest.ResponseRecorder {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set("csrf_token", csrfTokenFor("s"))
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-User", "admin")
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "s"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestUpdateEnabled(t *testing.T) {
+	ctx := context.Background()
+	h := newTestAdmin(t)
+	host := newTestHost(t, h.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	_, err := h.DB.ExecContext(ctx, `INSERT INTO updates (host_id, cmd, args)
+		VALUES (?1, 'GET', 'https://example.org/a'), (?1, 'GET', 'https://example.org/b')`, host.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, h.Queue, &Host{Id: host.Id})
+	// The running job of the disabled update method is left to finish.
+	_, err = h.DB.ExecContext(ctx, "UPDATE jobs SET state = ? WHERE update_id = 1", jobRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, h.Queue, &Host{Id: host.Id})
+	w := serveAdmin(h, http.MethodPost, "/admin/updates/1/enabled", url.Values{"enabled": {"false"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	var jobs []Job
+	if err := h.DB.SelectContext(ctx, &jobs, "SELECT * FROM jobs ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].UpdateId != 1 || jobs[0].State != jobRunning || jobs[1].UpdateId != 2 {
+		t.Errorf("got jobs %+v, want the running one of update 1 and the one of update 2", jobs)
+	}
+	var enabled bool
+	h.DB.GetContext(ctx, &enabled, "SELECT enabled FROM updates WHERE id = 1")
+	if enabled {
+		t.Error("update method still enabled")
+	}
+	if w := serveAdmin(h, http.MethodPost, "/admin/updates/1/enabled", url.Values{"enabled": {"true"}}); w.Code != http.StatusOK {
+		t.Fatalf("got status %d enabling, want 200", w.Code)
+	}
+	h.DB.GetContext(ctx, &enabled, "SELECT enabled FROM updates WHERE id = 1")
+	if !enabled {
+		t.Error("update method not enabled again")
+	}
+}
+
+func TestUpdateSave(t *testing.T) {
+	ctx := context.Background()
+	h := newTestAdmin(t)
+	host := newTestHost(t, h.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	_, err := h.DB.ExecContext(ctx, `INSERT INTO updates (host_id, cmd, args) VALUES (?1, 'GET', 'https://example.org/');
+		INSERT INTO update_runs (host_id, update_id, domain, args, started, finished, success)
+			VALUES (?1, 1, 'home.example.org', '', ?2, ?2, 1)`,
+		host.Id, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAdmin(h, http.MethodGet, "/admin/updates/1/edit", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "https://example.org/") {
+		t.Errorf("got %d for the edit form, want it with the args", w.Code)
+	}
+	for _, tc := range []struct {
+		name string
+		form url.Values
+		want int
+	}{
+		{"unknown method", url.Values{"cmd": {"nope"}, "args": {"x"}}, http.StatusUnprocessableEntity},
+		{"invalid config", url.Values{"cmd": {"http"}, "args": {"https://example.org/"}, "config": {`{"method": "DELETE"}`}},
+			http.StatusUnprocessableEntity},
+		{"valid", url.Values{"cmd": {"http"}, "args": {"https://example.org/{{.Host.Domain}}"}, "api_key": {"TOKEN"},
+			"config": {`{"method": "POST"}`}}, http.StatusOK},
+	} {
+		if w := serveAdmin(h, http.MethodPost, "/admin/updates/1", tc.form); w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+	var u Update
+	if err := h.DB.GetContext(ctx, &u, "SELECT * FROM updates WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if u.Cmd != "http" || u.Args != "https://example.org/{{.Host.Domain}}" || deref(u.ApiKey) != "TOKEN" || deref(u.Config) != `{"method": "POST"}` {
+		t.Errorf("got %s %s %s %s, want the valid change", u.Cmd, u.Args, deref(u.ApiKey), deref(u.Config))
+	}
+	var runs int
+	h.DB.GetContext(ctx, &runs, "SELECT COUNT(*) FROM update_runs WHERE update_id = 1")
+	if runs != 1 {
+		t.Errorf("got %d runs of the changed update method, want them kept", runs)
+	}
+}
+
+// updateOrder returns the ids of the update methods of the host with id
+// by position, and whether the positions are 1, 2, 3...
+func updateOrder(t *testing.T, h *AdminHandler, id int64) ([]int64, bool) {
+	t.Helper()
+	var updates []Update
+	err := h.DB.SelectContext(context.Background(), &updates, "SELECT * FROM updates WHERE host_id = ? ORDER BY position, id", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	numbered := true
+	for i, u := range updates {
+		ids = append(ids, u.Id)
+		numbered = numbered && u.Position == int64(i+1)
+	}
+	return ids, numbered
+}
+
+func TestUpdateMove(t *testing.T) {
+	h := newTestAdmin(t)
+	host := newTestHost(t, h.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	// Positions as left by older versions.
+	_, err := h.DB.ExecContext(context.Background(), `INSERT INTO updates (host_id, cmd, args, position)
+		VALUES (?1, 'GET', 'https://example.org/1', 0), (?1, 'GET', 'https://example.org/2', 0), (?1, 'GET', 'https://example.org/3', 5)`, host.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		move string
+		want []int64
+	}{
+		{"/admin/updates/3/up", []int64{1, 3, 2}},
+		{"/admin/updates/1/up", []int64{1, 3, 2}},
+		{"/admin/updates/1/down", []int64{3, 1, 2}},
+		{"/admin/updates/2/down", []int64{3, 1, 2}},
+	} {
+		w := serveAdmin(h, http.MethodPost, tc.move, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", tc.move, w.Code)
+		}
+		got, numbered := updateOrder(t, h, host.Id)
+		if !slices.Equal(got, tc.want) || !numbered {
+			t.Errorf("%s: got order %v, numbered %v, want %v", tc.move, got, numbered, tc.want)
+		}
+		// The list is rendered in the new order.
+		body := w.Body.String()
+		if strings.Index(body, "/admin/updates/1/up") > strings.Index(body, "/admin/updates/2/up") {
+			t.Errorf("%s: list not rendered in the new order", tc.move)
+		}
+	}
+}
+
+func TestUpdateClone(t *testing.T) {
+	ctx := context.Background()
+	h := newTestAdmin(t)
+	home := newTestHost(t, h.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	office := newTestHost(t, h.DB, Host{Name: "office", Domain: "office.example.org", Zone: "example.org"}, "")
+	_, err := h.DB.ExecContext(ctx, `INSERT INTO host_records (host_id, domain, zone) VALUES (?1, 'www.example.org', 'example.org');
+		INSERT INTO updates (host_id, cmd, args) VALUES (?2, 'GET', 'https://example.org/office');
+		INSERT INTO updates (host_id, record_id, cmd, args, api_key, config, enabled)
+			VALUES (?1, 1, 'http', 'https://example.org/{{.Host.Domain}}', 'TOKEN', '{"method": "POST"}', 0);
+		INSERT INTO updates (host_id, cmd, args) VALUES (?1, 'broken', '')`, home.Id, office.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAdmin(h, http.MethodGet, "/admin/updates/2/clone", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "office") {
+		t.Errorf("got %d for the clone form, want it with the hosts", w.Code)
+	}
+	for _, tc := range []struct {
+		name       string
+		update     string
+		target     int64
+		want       int
+		wantRecord bool
+	}{
+		{name: "other host", update: "2", target: office.Id, want: http.StatusOK},
+		{name: "same host", update: "2", target: home.Id, want: http.StatusOK, wantRecord: true},
+		{name: "unknown host", update: "2", target: 999, want: http.StatusUnprocessableEntity},
+		{name: "invalid update method", update: "3", target: office.Id, want: http.StatusUnprocessableEntity},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var before int64
+			h.DB.GetContext(ctx, &before, "SELECT MAX(id) FROM updates")
+			w := serveAdmin(h, http.MethodPost, "/admin/updates/"+tc.update+"/clone", url.Values{"target": {strconv.FormatInt(tc.target, 10)}})
+			if w.Code != tc.want {
+				t.Fatalf("got status %d, want %d", w.Code, tc.want)
+			}
+			var clone Update
+			err := h.DB.GetContext(ctx, &clone, "SELECT * FROM updates WHERE id > ?", before)
+			if tc.want != http.StatusOK {
+				if err == nil {
+					t.Errorf("got clone %d, want none", clone.Id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clone.HostId != tc.target || (clone.RecordId != nil) != tc.wantRecord || clone.Cmd != "http" ||
+				clone.Args != "https://example.org/{{.Host.Domain}}" || deref(clone.ApiKey) != "TOKEN" ||
+				deref(clone.Config) != `{"method": "POST"}` || clone.Enabled {
+				t.Errorf("got clone %+v", clone)
+			}
+			ids, _ := updateOrder(t, h, tc.target)
+			if ids[len(ids)-1] != clone.Id {
+				t.Errorf("got order %v, want the clone %d last", ids, clone.Id)
+			}
+		})
+	}
+}
@@ -0,0 +1,915 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// apiPrefix is where the JSON API is served.
+const apiPrefix = "/api/v1"
+
+// APIHost is a host as read and written through the JSON API. The token is
+// only included when the host is created, it is not stored in plaintext.
+type APIHost struct {
+	Id              int64     `json:"id"`
+	Token           string    `json:"token,omitempty"`
+	Name            string    `json:"name"`
+	Domain          string    `json:"domain"`
+	Zone            string    `json:"zone"`
+	Ip4addr         *string   `json:"ip4addr"`
+	Ip6addr         *string   `json:"ip6addr"`
+	CheckinInterval string    `json:"checkin_interval"`
+	AutoAddr        bool      `json:"auto_addr"`
+	AddrPolicy      string    `json:"addr_policy"`
+	Ip6LanPrefix    *string   `json:"ip6lanprefix"`
+	AllowedSources  []string  `json:"allowed_sources"`
+	RequireSource   bool      `json:"require_source"`
+	CertFingerprint *string   `json:"cert_fingerprint"`
+	Modified        time.Time `json:"modified"`
+	Created         time.Time `json:"created"`
+}
+
+// APIHostInput creates or replaces a host. The token is generated if it is
+// empty on creation, it is only changed by rotating it.
+type APIHostInput struct {
+	Token           string   `json:"token,omitempty"`
+	Name            string   `json:"name"`
+	Domain          string   `json:"domain"`
+	Zone            string   `json:"zone,omitempty"`
+	Ip4addr         *string  `json:"ip4addr,omitempty"`
+	Ip6addr         *string  `json:"ip6addr,omitempty"`
+	CheckinInterval string   `json:"checkin_interval,omitempty"`
+	AutoAddr        bool     `json:"auto_addr,omitempty"`
+	AddrPolicy      string   `json:"addr_policy,omitempty"`
+	AllowedSources  []string `json:"allowed_sources,omitempty"`
+	RequireSource   bool     `json:"require_source,omitempty"`
+	CertFingerprint string   `json:"cert_fingerprint,omitempty"`
+}
+
+// APIRecord is a further domain of a host as read through the JSON API.
+type APIRecord struct {
+	Id       int64     `json:"id"`
+	Domain   string    `json:"domain"`
+	Zone     string    `json:"zone"`
+	Inherit  bool      `json:"inherit"`
+	Modified time.Time `json:"modified"`
+	Created  time.Time `json:"created"`
+}
+
+// APIRecordInput creates or replaces a record. It inherits the update
+// methods of the host unless inherit is false, an empty zone is taken from
+// the host. The domain of a record can not be changed.
+type APIRecordInput struct {
+	Domain  string `json:"domain"`
+	Zone    string `json:"zone,omitempty"`
+	Inherit *bool  `json:"inherit,omitempty"`
+}
+
+// APILanDevice is a device in the LAN of a host as read through the JSON
+// API. Its address is derived from the LAN prefix of the host.
+type APILanDevice struct {
+	Id       int64     `json:"id"`
+	Domain   string    `json:"domain"`
+	Zone     string    `json:"zone"`
+	Ether    *string   `json:"ether,omitempty"`
+	IfaceId  *string   `json:"iface_id,omitempty"`
+	Ip6addr  *string   `json:"ip6addr"`
+	Modified time.Time `json:"modified"`
+	Created  time.Time `json:"created"`
+}
+
+// APILanDeviceInput adds a LAN device. Exactly one of ether, a MAC address,
+// and iface_id, a static interface identifier like ::1:2:3:4, is required.
+type APILanDeviceInput struct {
+	Domain  string  `json:"domain"`
+	Zone    string  `json:"zone,omitempty"`
+	Ether   *string `json:"ether,omitempty"`
+	IfaceId *string `json:"iface_id,omitempty"`
+}
+
+// APIUpdate is an update method as read and written through the JSON API.
+// RecordId is set for an update method of a record of the host.
+type APIUpdate struct {
+	Id       int64           `json:"id"`
+	HostId   int64           `json:"host_id"`
+	RecordId *int64          `json:"record_id"`
+	Cmd      string          `json:"cmd"`
+	Args     string          `json:"args"`
+	ApiKey   *string         `json:"api_key"`
+	Config   json.RawMessage `json:"config"`
+	Position int64           `json:"position"`
+	Enabled  bool            `json:"enabled"`
+	Modified time.Time       `json:"modified"`
+	Created  time.Time       `json:"created"`
+}
+
+// APIUpdateInput creates or replaces an update method. It is enabled unless
+// enabled is false, new update methods go last unless position is given.
+type APIUpdateInput struct {
+	RecordId *int64          `json:"record_id,omitempty"`
+	Cmd      string          `json:"cmd"`
+	Args     string          `json:"args,omitempty"`
+	ApiKey   *string         `json:"api_key,omitempty"`
+	Config   json.RawMessage `json:"config,omitempty"`
+	Enabled  *bool           `json:"enabled,omitempty"`
+	Position *int64          `json:"position,omitempty"`
+}
+
+// APITokenInput rotates the token of a host. The old token keeps working
+// for the grace period, e.g. "24h", TOKEN_GRACE_PERIOD if it is empty.
+type APITokenInput struct {
+	GracePeriod string `json:"grace_period,omitempty"`
+}
+
+// APIToken is the new token of a host. It is shown only once.
+type APIToken struct {
+	Token string `json:"token"`
+	// PreviousExpires is when the old token stops working, nil if it
+	// stopped right away.
+	PreviousExpires *time.Time `json:"previous_expires"`
+}
+
+// APIError is the body of every error response.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// noBody is the request or response type of operations without a body.
+type noBody struct{}
+
+// apiStatusError is returned by API operations to answer with a status
+// other than 500.
+type apiStatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiStatusError) Error() string {
+	return e.Message
+}
+
+func apiErrorf(status int, format string, args ...any) error {
+	return &apiStatusError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// apiOp is an operation of the JSON API. The same description is used to
+// route requests and to generate the OpenAPI document.
+type apiOp struct {
+	Method   string
+	Path     string
+	Id       string
+	Scope    string
+	Summary  string
+	Status   int
+	Query    []string
+	Request  reflect.Type
+	Response reflect.Type
+	handler  http.HandlerFunc
+}
+
+// apiRoute describes the operation pattern ("GET /hosts") implemented by fn.
+// The request body is decoded into Req and the result encoded as JSON with
+// status, noBody stands for no body in either direction.
+func apiRoute[Req, Resp any](pattern, id, scope, summary string, status int, fn func(r *http.Request, req *Req) (Resp, error)) apiOp {
+	method, path, _ := strings.Cut(pattern, " ")
+	op := apiOp{Method: method, Path: path, Id: id, Scope: scope, Summary: summary, Status: status}
+	hasRequest := reflect.TypeFor[Req]() != reflect.TypeFor[noBody]()
+	if hasRequest {
+		op.Request = reflect.TypeFor[Req]()
+	}
+	if reflect.TypeFor[Resp]() != reflect.TypeFor[noBody]() {
+		op.Response = reflect.TypeFor[Resp]()
+	}
+	op.handler = func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if hasRequest {
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&req)
+			if err != nil {
+				writeAPIError(w, r, apiErrorf(http.StatusBadRequest, "invalid request body: %v", err))
+				return
+			}
+		}
+		resp, err := fn(r, &req)
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+		if op.Response == nil {
+			w.WriteHeader(status)
+			return
+		}
+		writeJSON(w, status, resp)
+	}
+	return op
+}
+
+// withQuery documents the query parameters of the operation.
+func (op apiOp) withQuery(params ...string) apiOp {
+	op.Query = params
+	return op
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	var statusErr *apiStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		writeJSON(w, statusErr.Status, APIError{Error: statusErr.Message})
+	case errors.Is(err, sql.ErrNoRows):
+		writeJSON(w, http.StatusNotFound, APIError{Error: "not found"})
+	default:
+		slog.ErrorContext(r.Context(), "api", "method", r.Method, "path", r.URL.Path, "err", err)
+		writeJSON(w, http.StatusInternalServerError, APIError{Error: "internal error"})
+	}
+}
+
+type apiKeyKey struct{}
+
+// APIHandler serves the JSON API under /api/v1. Requests are authenticated
+// with API keys sent as bearer tokens, except for the OpenAPI document.
+type APIHandler struct {
+	DB    *sqlx.DB
+	Queue *Queue
+
+	ops    []apiOp
+	scopes map[string]string
+	mux    *http.ServeMux
+}
+
+func NewAPIHandler(db *sqlx.DB, queue *Queue) *APIHandler {
+	h := &APIHandler{DB: db, Queue: queue}
+	h.ops = []apiOp{
+		apiRoute("GET /hosts", "listHosts", scopeRead, "List all hosts", http.StatusOK, h.listHosts),
+		apiRoute("POST /hosts", "createHost", scopeWrite, "Create a host", http.StatusCreated, h.createHost),
+		apiRoute("GET /hosts/{host}", "getHost", scopeRead, "Get a host", http.StatusOK, h.getHost),
+		apiRoute("PUT /hosts/{host}", "replaceHost", scopeWrite, "Replace the settings and addresses of a host", http.StatusOK, h.replaceHost),
+		apiRoute("DELETE /hosts/{host}", "deleteHost", scopeWrite, "Delete a host with its update methods and history", http.StatusNoContent, h.deleteHost),
+		apiRoute("POST /hosts/{host}/token", "rotateToken", scopeWrite, "Give a host a new token, the old one keeps working for a grace period", http.StatusCreated, h.rotateToken),
+		apiRoute("GET /hosts/{host}/records", "listRecords", scopeRead, "List the further domains of a host", http.StatusOK, h.listRecords),
+		apiRoute("POST /hosts/{host}/records", "createRecord", scopeWrite, "Add a domain to a host", http.StatusCreated, h.createRecord),
+		apiRoute("GET /hosts/{host}/records/{id}", "getRecord", scopeRead, "Get a domain of a host", http.StatusOK, h.getRecord),
+		apiRoute("PUT /hosts/{host}/records/{id}", "replaceRecord", scopeWrite, "Replace the zone and inherit setting of a domain", http.StatusOK, h.replaceRecord),
+		apiRoute("DELETE /hosts/{host}/records/{id}", "deleteRecord", scopeWrite, "Delete a domain of a host with its update methods", http.StatusNoContent, h.deleteRecord),
+		apiRoute("GET /hosts/{host}/devices", "listDevices", scopeRead, "List the LAN devices of a host", http.StatusOK, h.listDevices),
+		apiRoute("POST /hosts/{host}/devices", "createDevice", scopeWrite, "Add a LAN device to a host", http.StatusCreated, h.createDevice),
+		apiRoute("GET /hosts/{host}/devices/{id}", "getDevice", scopeRead, "Get a LAN device of a host", http.StatusOK, h.getDevice),
+		apiRoute("DELETE /hosts/{host}/devices/{id}", "deleteDevice", scopeWrite, "Delete a LAN device of a host", http.StatusNoContent, h.deleteDevice),
+		apiRoute("GET /hosts/{host}/updates", "listUpdates", scopeRead, "List the update methods of a host", http.StatusOK, h.listUpdates),
+		apiRoute("POST /hosts/{host}/updates", "createUpdate", scopeWrite, "Add an update method to a host", http.StatusCreated, h.createUpdate),
+		apiRoute("GET /hosts/{host}/updates/{id}", "getUpdate", scopeRead, "Get an update method", http.StatusOK, h.getUpdate),
+		apiRoute("PUT /hosts/{host}/updates/{id}", "replaceUpdate", scopeWrite, "Replace an update method", http.StatusOK, h.replaceUpdate),
+		apiRoute("DELETE /hosts/{host}/updates/{id}", "deleteUpdate", scopeWrite, "Delete an update method", http.StatusNoContent, h.deleteUpdate),
+		apiRoute("GET /hosts/{host}/history", "listHistory", scopeRead, "List the address changes of a host, newest first", http.StatusOK, h.listHistory).
+			withQuery("limit", "offset"),
+		apiRoute("GET /hosts/{host}/runs", "listRuns", scopeRead, "List the runs of the update methods of a host, newest first", http.StatusOK, h.listRuns).
+			withQuery("limit", "offset", "update_id"),
+		apiRoute("GET /openapi.json", "openAPI", "", "This OpenAPI document", http.StatusOK, h.openAPI),
+	}
+	h.scopes = make(map[string]string)
+	h.mux = http.NewServeMux()
+	for _, op := range h.ops {
+		pattern := op.Method + " " + apiPrefix + op.Path
+		h.scopes[pattern] = op.Scope
+		h.mux.HandleFunc(pattern, op.handler)
+	}
+	return h
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, pattern := h.mux.Handler(r)
+	scope := h.scopes[pattern]
+	if pattern == "" || scope == "" {
+		h.mux.ServeHTTP(w, r)
+		return
+	}
+	key, err := requestAPIKey(r, h.DB)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if key == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fritzdyn"`)
+		writeJSON(w, http.StatusUnauthorized, APIError{Error: "missing or invalid API key"})
+		return
+	}
+	if !key.HasScope(scope) {
+		writeJSON(w, http.StatusForbidden, APIError{Error: "API key lacks the " + scope + " scope"})
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, key))
+	h.mux.ServeHTTP(w, r)
+}
+
+// apiKeyName returns the name of the API key the request was made with.
+func apiKeyName(ctx context.Context) string {
+	if key, ok := ctx.Value(apiKeyKey{}).(*APIKey); ok {
+		return key.Name
+	}
+	return ""
+}
+
+func apiHost(host *Host) APIHost {
+	ah := APIHost{
+		Id:              host.Id,
+		Name:            host.Name,
+		Domain:          host.Domain,
+		Zone:            host.Zone,
+		Ip4addr:         host.Ip4addr,
+		Ip6addr:         host.Ip6addr,
+		CheckinInterval: host.CheckinDuration(),
+		AutoAddr:        host.AutoAddr,
+		AddrPolicy:      host.AddrPolicy,
+		Ip6LanPrefix:    host.Ip6LanPrefix,
+		AllowedSources:  []string{},
+		RequireSource:   host.RequireSource,
+		CertFingerprint: host.CertFingerprint,
+		Modified:        host.Modified,
+		Created:         host.Created,
+	}
+	if host.AllowedSources != "" {
+		ah.AllowedSources = strings.Split(host.AllowedSources, ",")
+	}
+	return ah
+}
+
+func apiRecord(rec *HostRecord) APIRecord {
+	return APIRecord{
+		Id:       rec.Id,
+		Domain:   rec.Domain,
+		Zone:     rec.Zone,
+		Inherit:  rec.Inherit,
+		Modified: rec.Modified,
+		Created:  rec.Created,
+	}
+}
+
+func apiLanDevice(dev *LanDevice) APILanDevice {
+	return APILanDevice{
+		Id:       dev.Id,
+		Domain:   dev.Domain,
+		Zone:     dev.Zone,
+		Ether:    dev.Ether,
+		IfaceId:  dev.IfaceId,
+		Ip6addr:  dev.Ip6addr,
+		Modified: dev.Modified,
+		Created:  dev.Created,
+	}
+}
+
+func apiUpdate(u *Update) APIUpdate {
+	au := APIUpdate{
+		Id:       u.Id,
+		HostId:   u.HostId,
+		RecordId: u.RecordId,
+		Cmd:      u.Cmd,
+		Args:     u.Args,
+		ApiKey:   u.ApiKey,
+		Position: u.Position,
+		Enabled:  u.Enabled,
+		Modified: u.Modified,
+		Created:  u.Created,
+	}
+	if u.Config != nil && json.Valid([]byte(*u.Config)) {
+		au.Config = json.RawMessage(*u.Config)
+	}
+	return au
+}
+
+// hostFromInput checks in and returns the host it describes.
+func hostFromInput(in *APIHostInput) (*Host, error) {
+	if in.Name == "" || in.Domain == "" {
+		return nil, apiErrorf(http.StatusUnprocessableEntity, "name and domain are required")
+	}
+	host := &Host{Name: in.Name, Domain: in.Domain, Zone: in.Zone, AutoAddr: in.AutoAddr}
+	var err error
+	host.Ip4addr, host.Ip6addr, err = hostAddrs(deref(in.Ip4addr), deref(in.Ip6addr))
+	if err != nil {
+		return nil, apiErrorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	host.AddrPolicy, err = checkAddrPolicy(in.AddrPolicy)
+	if err != nil {
+		return nil, apiErrorf(http.StatusUnprocessableEntity, "addr_policy: %v", err)
+	}
+	host.CheckinInterval, err = parseCheckinInterval(in.CheckinInterval)
+	if err != nil {
+		return nil, apiErrorf(http.StatusUnprocessableEntity, "checkin_interval: %v", err)
+	}
+	err = setGuards(host, strings.Join(in.AllowedSources, ","), in.RequireSource, in.CertFingerprint)
+	if err != nil {
+		return nil, apiErrorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	return host, nil
+}
+
+// updateFromInput fills u from in and checks the result.
+func updateFromInput(ctx context.Context, q sqlx.QueryerContext, u *Update, in *APIUpdateInput) error {
+	u.RecordId = in.RecordId
+	err := checkRecord(ctx, q, u)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiErrorf(http.StatusUnprocessableEntity, "record_id %d is not a record of the host", *in.RecordId)
+	}
+	if err != nil {
+		return err
+	}
+	u.Cmd = in.Cmd
+	u.Args = in.Args
+	u.ApiKey = in.ApiKey
+	if in.ApiKey != nil && *in.ApiKey == "" {
+		u.ApiKey = nil
+	}
+	u.Config = nil
+	if len(in.Config) > 0 && string(in.Config) != "null" {
+		var buf bytes.Buffer
+		err := json.Compact(&buf, in.Config)
+		if err != nil {
+			return apiErrorf(http.StatusUnprocessableEntity, "config: %v", err)
+		}
+		config := buf.String()
+		u.Config = &config
+	}
+	u.Enabled = in.Enabled == nil || *in.Enabled
+	err = validateUpdate(u)
+	if err != nil {
+		return apiErrorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	return nil
+}
+
+// pageParams returns the limit and offset query parameters.
+func pageParams(r *http.Request) (limit, offset int, err error) {
+	limit = 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > 1000 {
+			return 0, 0, apiErrorf(http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+	}
+	if s := r.URL.Query().Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, apiErrorf(http.StatusBadRequest, "offset must not be negative")
+		}
+	}
+	return limit, offset, nil
+}
+
+// pathHostID returns the host id in the path. The host may not exist.
+func (h *APIHandler) pathHostID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("host"), 10, 64)
+	if err != nil {
+		return 0, sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (h *APIHandler) pathHost(r *http.Request) (*Host, error) {
+	id, err := h.pathHostID(r)
+	if err != nil {
+		return nil, err
+	}
+	var host Host
+	err = h.DB.GetContext(r.Context(), &host, "SELECT * FROM hosts WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return &host, nil
+}
+
+func (h *APIHandler) pathUpdate(r *http.Request) (*Update, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	hostID, err := h.pathHostID(r)
+	if err != nil {
+		return nil, err
+	}
+	var u Update
+	err = h.DB.GetContext(r.Context(), &u, "SELECT * FROM updates WHERE id = ? AND host_id = ?", id, hostID)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (h *APIHandler) pathRecord(r *http.Request) (*HostRecord, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	hostID, err := h.pathHostID(r)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := hostRecord(r.Context(), h.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	if rec.HostId != hostID {
+		return nil, sql.ErrNoRows
+	}
+	return rec, nil
+}
+
+func (h *APIHandler) pathDevice(r *http.Request) (*LanDevice, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	hostID, err := h.pathHostID(r)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := lanDevice(r.Context(), h.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	if dev.HostId != hostID {
+		return nil, sql.ErrNoRows
+	}
+	return dev, nil
+}
+
+func (h *APIHandler) listHosts(r *http.Request, _ *noBody) ([]APIHost, error) {
+	var hosts []Host
+	err := h.DB.SelectContext(r.Context(), &hosts, "SELECT * FROM hosts ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]APIHost, 0, len(hosts))
+	for _, host := range hosts {
+		result = append(result, apiHost(&host))
+	}
+	return result, nil
+}
+
+func (h *APIHandler) createHost(r *http.Request, in *APIHostInput) (APIHost, error) {
+	host, err := hostFromInput(in)
+	if err != nil {
+		return APIHost{}, err
+	}
+	ctx := r.Context()
+	token, err := insertHost(ctx, h.DB, host, in.Token)
+	switch {
+	case errors.Is(err, errTokenInUse):
+		return APIHost{}, apiErrorf(http.StatusConflict, "a host with this token exists")
+	case errors.Is(err, errTokenTooShort):
+		return APIHost{}, apiErrorf(http.StatusUnprocessableEntity, "%v", err)
+	case err != nil:
+		return APIHost{}, err
+	}
+	slog.InfoContext(ctx, "api host created", "host", host.Name, "id", host.Id, "key", apiKeyName(ctx))
+	result := apiHost(host)
+	result.Token = token
+	return result, nil
+}
+
+func (h *APIHandler) getHost(r *http.Request, _ *noBody) (APIHost, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return APIHost{}, err
+	}
+	return apiHost(host), nil
+}
+
+func (h *APIHandler) replaceHost(r *http.Request, in *APIHostInput) (APIHost, error) {
+	if in.Token != "" {
+		return APIHost{}, apiErrorf(http.StatusUnprocessableEntity, "the token of a host is changed by rotating it")
+	}
+	id, err := h.pathHostID(r)
+	if err != nil {
+		return APIHost{}, err
+	}
+	host, err := hostFromInput(in)
+	if err != nil {
+		return APIHost{}, err
+	}
+	host.Id = id
+	ctx := r.Context()
+	err = saveHost(ctx, h.DB, host, sourceAPI, remoteHost(r))
+	if err != nil {
+		return APIHost{}, err
+	}
+	return h.getHost(r, nil)
+}
+
+func (h *APIHandler) deleteHost(r *http.Request, _ *noBody) (noBody, error) {
+	id, err := h.pathHostID(r)
+	if err != nil {
+		return noBody{}, err
+	}
+	ctx := r.Context()
+	found, err := deleteHost(ctx, h.DB, id)
+	if err != nil {
+		return noBody{}, err
+	}
+	if !found {
+		return noBody{}, sql.ErrNoRows
+	}
+	slog.InfoContext(ctx, "api host deleted", "id", id, "key", apiKeyName(ctx))
+	return noBody{}, nil
+}
+
+func (h *APIHandler) rotateToken(r *http.Request, in *APITokenInput) (APIToken, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return APIToken{}, err
+	}
+	grace := tokenGracePeriod()
+	if in.GracePeriod != "" {
+		grace, err = time.ParseDuration(in.GracePeriod)
+		if err != nil || grace < 0 {
+			return APIToken{}, apiErrorf(http.StatusUnprocessableEntity, "invalid grace_period %q", in.GracePeriod)
+		}
+	}
+	ctx := r.Context()
+	token, err := rotateHostToken(ctx, h.DB, host.Id, grace)
+	if err != nil {
+		return APIToken{}, err
+	}
+	slog.InfoContext(ctx, "api host token rotated", "host", host.Name, "id", host.Id, "grace", grace, "key", apiKeyName(ctx))
+	result := APIToken{Token: token}
+	if grace > 0 {
+		expires := time.Now().UTC().Add(grace)
+		result.PreviousExpires = &expires
+	}
+	return result, nil
+}
+
+func (h *APIHandler) listUpdates(r *http.Request, _ *noBody) ([]APIUpdate, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return nil, err
+	}
+	var updates []Update
+	err = h.DB.SelectContext(r.Context(), &updates, "SELECT * FROM updates WHERE host_id = ? ORDER BY position, id", host.Id)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]APIUpdate, 0, len(updates))
+	for _, u := range updates {
+		result = append(result, apiUpdate(&u))
+	}
+	return result, nil
+}
+
+func (h *APIHandler) createUpdate(r *http.Request, in *APIUpdateInput) (APIUpdate, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	ctx := r.Context()
+	u := Update{HostId: host.Id}
+	err = updateFromInput(ctx, h.DB, &u, in)
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	err = insertUpdate(ctx, h.DB, &u)
+	if err == nil && in.Position != nil {
+		u.Position = *in.Position
+		_, err = h.DB.ExecContext(ctx, "UPDATE updates SET position = ? WHERE id = ?", u.Position, u.Id)
+	}
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	slog.InfoContext(ctx, "api update method created", "update", u.Id, "host", host.Name, "key", apiKeyName(ctx))
+	return apiUpdate(&u), nil
+}
+
+func (h *APIHandler) getUpdate(r *http.Request, _ *noBody) (APIUpdate, error) {
+	u, err := h.pathUpdate(r)
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	return apiUpdate(u), nil
+}
+
+func (h *APIHandler) replaceUpdate(r *http.Request, in *APIUpdateInput) (APIUpdate, error) {
+	u, err := h.pathUpdate(r)
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	ctx := r.Context()
+	err = updateFromInput(ctx, h.DB, u, in)
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	if in.Position != nil {
+		u.Position = *in.Position
+	}
+	_, err = h.DB.ExecContext(ctx, "UPDATE updates SET record_id = ?, cmd = ?, args = ?, api_key = ?, config = ?, enabled = ?, position = ? WHERE id = ?",
+		u.RecordId, u.Cmd, u.Args, u.ApiKey, u.Config, u.Enabled, u.Position, u.Id)
+	if err != nil {
+		return APIUpdate{}, err
+	}
+	slog.InfoContext(ctx, "api update method changed", "update", u.Id, "key", apiKeyName(ctx))
+	return h.getUpdate(r, nil)
+}
+
+func (h *APIHandler) deleteUpdate(r *http.Request, _ *noBody) (noBody, error) {
+	u, err := h.pathUpdate(r)
+	if err != nil {
+		return noBody{}, err
+	}
+	ctx := r.Context()
+	_, err = deleteUpdate(ctx, h.DB, u.Id)
+	if err != nil {
+		return noBody{}, err
+	}
+	slog.InfoContext(ctx, "api update method deleted", "update", u.Id, "key", apiKeyName(ctx))
+	return noBody{}, nil
+}
+
+func (h *APIHandler) listRecords(r *http.Request, _ *noBody) ([]APIRecord, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := hostRecords(r.Context(), h.DB, host.Id)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]APIRecord, 0, len(recs))
+	for _, rec := range recs {
+		result = append(result, apiRecord(&rec))
+	}
+	return result, nil
+}
+
+func (h *APIHandler) createRecord(r *http.Request, in *APIRecordInput) (APIRecord, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return APIRecord{}, err
+	}
+	ctx := r.Context()
+	rec := HostRecord{HostId: host.Id, Domain: in.Domain, Zone: in.Zone, Inherit: in.Inherit == nil || *in.Inherit}
+	err = insertRecord(ctx, h.DB, &rec)
+	switch {
+	case errors.Is(err, errNoDomain):
+		return APIRecord{}, apiErrorf(http.StatusUnprocessableEntity, "%v", err)
+	case errors.Is(err, errRecordExists):
+		return APIRecord{}, apiErrorf(http.StatusConflict, "%v", err)
+	case err != nil:
+		return APIRecord{}, err
+	}
+	slog.InfoContext(ctx, "api record created", "record", rec.Id, "host", host.Name, "domain", rec.Domain, "key", apiKeyName(ctx))
+	return apiRecord(&rec), nil
+}
+
+func (h *APIHandler) getRecord(r *http.Request, _ *noBody) (APIRecord, error) {
+	rec, err := h.pathRecord(r)
+	if err != nil {
+		return APIRecord{}, err
+	}
+	return apiRecord(rec), nil
+}
+
+func (h *APIHandler) replaceRecord(r *http.Request, in *APIRecordInput) (APIRecord, error) {
+	rec, err := h.pathRecord(r)
+	if err != nil {
+		return APIRecord{}, err
+	}
+	if in.Domain != "" && in.Domain != rec.Domain {
+		return APIRecord{}, apiErrorf(http.StatusUnprocessableEntity, "the domain of a record can not be changed")
+	}
+	rec.Zone = in.Zone
+	rec.Inherit = in.Inherit == nil || *in.Inherit
+	ctx := r.Context()
+	err = saveRecord(ctx, h.DB, rec)
+	if err != nil {
+		return APIRecord{}, err
+	}
+	slog.InfoContext(ctx, "api record changed", "record", rec.Id, "key", apiKeyName(ctx))
+	return apiRecord(rec), nil
+}
+
+func (h *APIHandler) deleteRecord(r *http.Request, _ *noBody) (noBody, error) {
+	rec, err := h.pathRecord(r)
+	if err != nil {
+		return noBody{}, err
+	}
+	ctx := r.Context()
+	err = deleteRecord(ctx, h.DB, rec.Id)
+	if err != nil {
+		return noBody{}, err
+	}
+	slog.InfoContext(ctx, "api record deleted", "record", rec.Id, "domain", rec.Domain, "key", apiKeyName(ctx))
+	return noBody{}, nil
+}
+
+func (h *APIHandler) listDevices(r *http.Request, _ *noBody) ([]APILanDevice, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := lanDevices(r.Context(), h.DB, host.Id)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]APILanDevice, 0, len(devs))
+	for _, dev := range devs {
+		result = append(result, apiLanDevice(&dev))
+	}
+	return result, nil
+}
+
+func (h *APIHandler) createDevice(r *http.Request, in *APILanDeviceInput) (APILanDevice, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return APILanDevice{}, err
+	}
+	ctx := r.Context()
+	dev := LanDevice{Domain: in.Domain, Zone: in.Zone, Ether: in.Ether, IfaceId: in.IfaceId}
+	err = insertLanDevice(ctx, h.DB, h.Queue, host, &dev)
+	switch {
+	case errors.Is(err, errNoDomain), errors.Is(err, errDeviceIID), errors.Is(err, errBadAddr):
+		return APILanDevice{}, apiErrorf(http.StatusUnprocessableEntity, "%v", err)
+	case errors.Is(err, errDeviceExists):
+		return APILanDevice{}, apiErrorf(http.StatusConflict, "%v", err)
+	case err != nil:
+		return APILanDevice{}, err
+	}
+	slog.InfoContext(ctx, "api device created", "device", dev.Id, "host", host.Name, "domain", dev.Domain, "key", apiKeyName(ctx))
+	return apiLanDevice(&dev), nil
+}
+
+func (h *APIHandler) getDevice(r *http.Request, _ *noBody) (APILanDevice, error) {
+	dev, err := h.pathDevice(r)
+	if err != nil {
+		return APILanDevice{}, err
+	}
+	return apiLanDevice(dev), nil
+}
+
+func (h *APIHandler) deleteDevice(r *http.Request, _ *noBody) (noBody, error) {
+	dev, err := h.pathDevice(r)
+	if err != nil {
+		return noBody{}, err
+	}
+	ctx := r.Context()
+	err = deleteLanDevice(ctx, h.DB, dev.Id)
+	if err != nil {
+		return noBody{}, err
+	}
+	slog.InfoContext(ctx, "api device deleted", "device", dev.Id, "domain", dev.Domain, "key", apiKeyName(ctx))
+	return noBody{}, nil
+}
+
+func (h *APIHandler) listHistory(r *http.Request, _ *noBody) ([]IPChange, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return nil, err
+	}
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+	history, err := ipHistory(r.Context(), h.DB, host.Id, limit, offset)
+	if history == nil {
+		history = []IPChange{}
+	}
+	return history, err
+}
+
+func (h *APIHandler) listRuns(r *http.Request, _ *noBody) ([]Run, error) {
+	host, err := h.pathHost(r)
+	if err != nil {
+		return nil, err
+	}
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT * FROM update_runs WHERE host_id = ?"
+	args := []any{host.Id}
+	if s := r.URL.Query().Get("update_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid update_id")
+		}
+		query += " AND update_id = ?"
+		args = append(args, id)
+	}
+	runs := []Run{}
+	err = h.DB.SelectContext(r.Context(), &runs, query+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	return runs, err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serveAPI sends a request with body and the API key as bearer token, if
+// any, to h.
+func serveAPI(h *APIHandler, method, path, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIScopes(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	h := NewAPIHandler(db, NewQueue(db))
+	newTestHost(t, db, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	_, reader, err := createAPIKey(ctx, db, "reader", scopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writer, err := createAPIKey(ctx, db, "writer", scopeWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revoked, err := createAPIKey(ctx, db, "revoked", "read,write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeAPIKey(ctx, db, revokedKey.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		want   int
+	}{
+		{name: "read with read key", method: http.MethodGet, path: "/hosts", key: reader, want: http.StatusOK},
+		{name: "read with write key", method: http.MethodGet, path: "/hosts", key: writer, want: http.StatusOK},
+		{name: "no key", method: http.MethodGet, path: "/hosts", want: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/hosts", key: apiKeyPrefix + "unknown", want: http.StatusUnauthorized},
+		{name: "host token", method: http.MethodGet, path: "/hosts", key: testToken, want: http.StatusUnauthorized},
+		{name: "revoked key", method: http.MethodGet, path: "/hosts", key: revoked, want: http.StatusUnauthorized},
+		{name: "write with read key", method: http.MethodPost, path: "/hosts", key: reader,
+			body: `{"name": "office", "domain": "office.example.org"}`, want: http.StatusForbidden},
+		{name: "write with write key", method: http.MethodPost, path: "/hosts", key: writer,
+			body: `{"name": "office", "domain": "office.example.org"}`, want: http.StatusCreated},
+		{name: "delete with read key", method: http.MethodDelete, path: "/hosts/1", key: reader, want: http.StatusForbidden},
+		{name: "OpenAPI without key", method: http.MethodGet, path: "/openapi.json", want: http.StatusOK},
+		{name: "unrouted", method: http.MethodGet, path: "/nope", key: writer, want: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveAPI(h, tc.method, tc.path, tc.key, tc.body)
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+			if tc.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+	var hosts int
+	db.GetContext(ctx, &hosts, "SELECT COUNT(*) FROM hosts")
+	if hosts != 2 {
+		t.Errorf("got %d hosts, want only the write key to create one", hosts)
+	}
+	// Every operation checks its scope before it looks at the request.
+	for _, op := range h.ops {
+		if op.Scope == "" {
+			continue
+		}
+		path := pathParamPattern.ReplaceAllString(op.Path, "1")
+		if w := serveAPI(h, op.Method, path, "", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without key: got status %d, want 401", op.Method, path, w.Code)
+		}
+		if op.Scope != scopeWrite {
+			continue
+		}
+		if w := serveAPI(h, op.Method, path, reader, "{}"); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with read key: got status %d, want 403", op.Method, path, w.Code)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	db := newTestDB(t)
+	h := NewAPIHandler(db, NewQueue(db))
+	w := serveAPI(h, http.MethodGet, "/openapi.json", "", "")
+	var doc struct {
+		OpenAPI    string `json:"openapi"`
+		Servers    []struct{ URL string }
+		Paths      map[string]map[string]map[string]any
+		Components struct {
+			Schemas         map[string]map[string]any
+			SecuritySchemes map[string]any
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" || len(doc.Servers) != 1 || doc.Servers[0].URL != apiPrefix || doc.Components.SecuritySchemes["apiKey"] == nil {
+		t.Errorf("got document %+v", doc)
+	}
+	var ids []string
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			ids = append(ids, op["operationId"].(string))
+			desc, _ := op["description"].(string)
+			security, _ := op["security"].([]any)
+			if path == "/openapi.json" {
+				if len(security) != 0 {
+					t.Errorf("%s %s: got security %v, want none", method, path, security)
+				}
+				continue
+			}
+			wantScope := scopeRead
+			if method != "get" {
+				wantScope = scopeWrite
+			}
+			if len(security) != 1 || !strings.Contains(desc, "the "+wantScope+" scope") {
+				t.Errorf("%s %s: got security %v and %q, want the %s scope", method, path, security, desc, wantScope)
+			}
+		}
+	}
+	var want []string
+	for _, op := range h.ops {
+		want = append(want, op.Id)
+	}
+	slices.Sort(ids)
+	slices.Sort(want)
+	if !slices.Equal(ids, want) {
+		t.Errorf("got operations %q, want %q", ids, want)
+	}
+	history := doc.Paths["/hosts/{host}/history"]["get"]
+	var params []string
+	for _, p := range history["parameters"].([]any) {
+		params = append(params, p.(map[string]any)["name"].(string))
+	}
+	if !slices.Equal(params, []string{"host", "limit", "offset"}) {
+		t.Errorf("got history parameters %q", params)
+	}
+	host := doc.Components.Schemas["APIHost"]
+	required, _ := host["required"].([]any)
+	if !slices.Contains(required, any("id")) || slices.Contains(required, any("token")) {
+		t.Errorf("got required APIHost properties %v, want id and not token", required)
+	}
+	ip4addr, _ := host["properties"].(map[string]any)["ip4addr"].(map[string]any)
+	if ip4addr["type"] != "string" || ip4addr["nullable"] != true {
+		t.Errorf("got ip4addr schema %v, want a nullable string", ip4addr)
+	}
+}
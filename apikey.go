@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// API key scopes. A key with the write scope may also read.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to find.
+const apiKeyPrefix = "fdk_"
+
+// APIKey grants access to the JSON API. Only the SHA-256 hash of the key
+// is stored, it is shown once when the key is created.
+type APIKey struct {
+	Id       int64
+	Name     string
+	KeyHash  string `db:"key_hash"`
+	Scopes   string
+	LastUsed *time.Time `db:"last_used"`
+	Revoked  *time.Time
+	Created  time.Time
+}
+
+// HasScope reports whether the key grants scope.
+func (k *APIKey) HasScope(scope string) bool {
+	scopes := strings.Fields(k.Scopes)
+	return slices.Contains(scopes, scope) || scope == scopeRead && slices.Contains(scopes, scopeWrite)
+}
+
+// parseScopes checks a comma or space separated list of scopes.
+func parseScopes(s string) (string, error) {
+	scopes := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(scopes) == 0 {
+		return "", errors.New("no scope given")
+	}
+	for _, scope := range scopes {
+		if scope != scopeRead && scope != scopeWrite {
+			return "", fmt.Errorf("unknown scope %q, use %s or %s", scope, scopeRead, scopeWrite)
+		}
+	}
+	slices.Sort(scopes)
+	return strings.Join(slices.Compact(scopes), " "), nil
+}
+
+// createAPIKey stores a new API key and returns it together with the key
+// itself.
+func createAPIKey(ctx context.Context, db *sqlx.DB, name, scopes string) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("name is empty")
+	}
+	scopes, err := parseScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + rand.Text() + rand.Text()
+	var k APIKey
+	err = db.GetContext(ctx, &k, "INSERT INTO api_keys (name, key_hash, scopes) VALUES (?, ?, ?) RETURNING *",
+		name, hashToken(key), scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	return &k, key, nil
+}
+
+// lookupAPIKey returns the API key for key, or nil if there is no such key
+// or it was revoked. The time it was last used is updated.
+func lookupAPIKey(ctx context.Context, db *sqlx.DB, key string) (*APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, nil
+	}
+	var k APIKey
+	err := db.GetContext(ctx, &k, "UPDATE api_keys SET last_used = ? WHERE key_hash = ? AND revoked IS NULL RETURNING *",
+		time.Now().UTC(), hashToken(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// requestAPIKey returns the API key sent as bearer token with r, or nil if
+// there is none or it is not valid.
+func requestAPIKey(r *http.Request, db *sqlx.DB) (*APIKey, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	return lookupAPIKey(r.Context(), db, strings.TrimSpace(token))
+}
+
+// revokeAPIKey revokes the API key with id. The row is kept, so it is still
+// known who used the key.
+func revokeAPIKey(ctx context.Context, db *sqlx.DB, id int64) error {
+	res, err := db.ExecContext(ctx, "UPDATE api_keys SET revoked = ? WHERE id = ? AND revoked IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no active API key %d", id)
+	}
+	return nil
+}
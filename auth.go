@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie     = "fritzdyn_session"
+	minPasswordLength = 8
+)
+
+// User is an administrator of fritzdyn.
+type User struct {
+	Id           int64
+	Username     string
+	PasswordHash string `db:"password_hash"`
+	Modified     time.Time
+	Created      time.Time
+}
+
+type userKey struct{}
+
+// adminUser returns the name of the user authenticated for the request.
+func adminUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// setUserPassword creates the user or, if it exists, replaces its password.
+func setUserPassword(ctx context.Context, db *sqlx.DB, username, password string) error {
+	if username == "" {
+		return errors.New("username is empty")
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO users (username, password_hash) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash`, username, string(hash))
+	if err != nil {
+		return err
+	}
+	// Log out everywhere after a password change.
+	_, err = db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = (SELECT id FROM users WHERE username = ?)", username)
+	return err
+}
+
+// dummyHash is compared against when the user does not exist, so that
+// unknown users take as long as wrong passwords.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("fritzdyn"), bcrypt.DefaultCost)
+	return hash
+})
+
+// checkPassword returns the user if username and password match.
+func checkPassword(ctx context.Context, db *sqlx.DB, username, password string) (*User, error) {
+	var user User
+	err := db.GetContext(ctx, &user, "SELECT * FROM users WHERE username = ?", username)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+// hashToken returns the SHA-256 hash of a secret token. Sessions, API keys
+// and host tokens are only stored hashed, so a leaked database does not
+// leak them.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession stores a new session for user and returns the cookie value.
+// Expired sessions are removed on the way.
+func createSession(ctx context.Context, db *sqlx.DB, user *User, maxAge time.Duration) (string, error) {
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE expires < ?", time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	token := rand.Text() + rand.Text()
+	_, err = db.ExecContext(ctx, "INSERT INTO sessions (id, user_id, expires) VALUES (?, ?, ?)",
+		hashToken(token), user.Id, time.Now().UTC().Add(maxAge))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sessionUser returns the name of the user of the session with the cookie
+// value token, or "" if there is no such session or it expired.
+func sessionUser(ctx context.Context, db *sqlx.DB, token string) (string, error) {
+	var username string
+	err := db.GetContext(ctx, &username, `SELECT users.username FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE sessions.id = ? AND sessions.expires > ?`, hashToken(token), time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return username, err
+}
+
+// authenticate returns the user making the request. With AuthHeader set,
+// the reverse proxy in front of fritzdyn is trusted to have authenticated
+// the user and to pass the name in that header. The header is only
+// believed from one of the TRUSTED_PROXIES, anyone else could set it.
+func (h *AdminHandler) authenticate(r *http.Request) (string, error) {
+	if h.AuthHeader != "" {
+		user := r.Header.Get(h.AuthHeader)
+		if user != "" && !fromTrustedProxy(r) {
+			slog.Warn("admin auth header from untrusted peer", "header", h.AuthHeader, "remote", remoteHost(r))
+			return "", nil
+		}
+		return user, nil
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	return sessionUser(r.Context(), h.DB, cookie.Value)
+}
+
+// requireLogin sends unauthenticated requests to the login page. htmx
+// requests are redirected through the HX-Redirect header.
+func (h *AdminHandler) requireLogin(w http.ResponseWriter, r *http.Request) {
+	if h.AuthHeader != "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	target := "/admin/login"
+	if r.Method == http.MethodGet {
+		target += "?next=" + url.QueryEscape(r.URL.RequestURI())
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", target)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// loginNext returns the page to go to after the login, only pages of the
+// admin interface are accepted.
+func loginNext(next string) string {
+	if strings.HasPrefix(next, "/admin/") && !strings.Contains(next, "\\") {
+		return next
+	}
+	return "/admin/"
+}
+
+func (h *AdminHandler) setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/admin/",
+		MaxAge:   maxAge,
+		Secure:   !h.InsecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h *AdminHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if h.AuthHeader != "" {
+		http.NotFound(w, r)
+		return
+	}
+	data := map[string]any{
+		"Next": r.FormValue("next"),
+	}
+	if r.Method == http.MethodPost {
+		username := r.PostFormValue("username")
+		user, err := checkPassword(r.Context(), h.DB, username, r.PostFormValue("password"))
+		if err != nil {
+			slog.Error("checkPassword", "err", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			slog.Warn("admin login failed", "username", username, "remote", remoteHost(r))
+			data["Username"] = username
+			data["Error"] = "Invalid username or password."
+			w.WriteHeader(http.StatusUnauthorized)
+			h.render(w, r, "login.html", data)
+			return
+		}
+		token, err := createSession(r.Context(), h.DB, user, h.SessionMaxAge)
+		if err != nil {
+			slog.Error("createSession", "err", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("admin login", "username", user.Username, "remote", remoteHost(r))
+		h.setSessionCookie(w, token, int(h.SessionMaxAge/time.Second))
+		http.Redirect(w, r, loginNext(r.FormValue("next")), http.StatusSeeOther)
+		return
+	}
+	h.render(w, r, "login.html", data)
+}
+
+func (h *AdminHandler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		_, err = h.DB.ExecContext(r.Context(), "DELETE FROM sessions WHERE id = ?", hashToken(cookie.Value))
+		if err != nil {
+			slog.Error("Delete session", "err", err)
+		}
+	}
+	h.setSessionCookie(w, "", -1)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	if err := setUserPassword(ctx, db, "admin", "short"); err == nil {
+		t.Error("short password accepted")
+	}
+	if err := setUserPassword(ctx, db, "", "long enough"); err == nil {
+		t.Error("empty username accepted")
+	}
+	if err := setUserPassword(ctx, db, "admin", "first password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"admin", "first password", true},
+		{"admin", "wrong password", false},
+		{"nobody", "first password", false},
+	} {
+		user, err := checkPassword(ctx, db, tc.username, tc.password)
+		if err != nil || (user != nil) != tc.ok {
+			t.Errorf("%s %s: got %v, %v, want ok %v", tc.username, tc.password, user, err, tc.ok)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	if err := setUserPassword(ctx, db, "admin", "first password"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := checkPassword(ctx, db, "admin", "first password")
+	if err != nil || user == nil {
+		t.Fatal(user, err)
+	}
+	session, err := createSession(ctx, db, user, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := createSession(ctx, db, user, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	db.GetContext(ctx, &stored, "SELECT COUNT(*) FROM sessions WHERE id = ?", session)
+	if stored != 0 {
+		t.Error("session token stored in plain text")
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"valid", session, "admin"},
+		{"expired", expired, ""},
+		{"unknown", "unknown", ""},
+	} {
+		got, err := sessionUser(ctx, db, tc.token)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+	// A new password logs out everywhere.
+	if err := setUserPassword(ctx, db, "admin", "second password"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sessionUser(ctx, db, session); got != "" {
+		t.Errorf("got %q after the password change, want no session", got)
+	}
+}
+
+func TestLoginNext(t *testing.T) {
+	for _, tc := range []struct{ next, want string }{
+		{"/admin/host/1", "/admin/host/1"},
+		{"", "/admin/"},
+		{"https://attacker.example/admin/", "/admin/"},
+		{"//attacker.example/admin/", "/admin/"},
+		{"/admin/\\attacker.example", "/admin/"},
+	} {
+		if got := loginNext(tc.next); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.next, got, tc.want)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	h := NewAdminHandler(newTestDB(t), nil, NewLimiter())
+	if err := setUserPassword(ctx, h.DB, "admin", "first password"); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "s"})
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := serve(http.MethodGet, "/admin/host/1", nil)
+	if loc := w.Header().Get("Location"); w.Code != http.StatusSeeOther || loc != "/admin/login?next=%2Fadmin%2Fhost%2F1" {
+		t.Errorf("got %d to %q without a session, want a redirect to the login", w.Code, loc)
+	}
+	w = serve(http.MethodPost, "/admin/login", url.Values{"csrf_token": {csrfTokenFor("s")}, "username": {"admin"},
+		"password": {"wrong password"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d for a wrong password, want 401", w.Code)
+	}
+	w = serve(http.MethodPost, "/admin/login", url.Values{"csrf_token": {csrfTokenFor("s")}, "username": {"admin"},
+		"password": {"first password"}, "next": {"/admin/"}})
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if w.Code != http.StatusSeeOther || session == nil || !session.HttpOnly || !session.Secure {
+		t.Fatalf("got %d and session cookie %v, want a redirect with a secure session cookie", w.Code, session)
+	}
+	if w = serve(http.MethodGet, "/admin/", nil, session); w.Code != http.StatusOK {
+		t.Errorf("got %d with the session, want 200", w.Code)
+	}
+	w = serve(http.MethodPost, "/admin/logout", url.Values{"csrf_token": {csrfTokenFor("s")}}, session)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("got %d for the logout, want 303", w.Code)
+	}
+	if w = serve(http.MethodGet, "/admin/", nil, session); w.Code != http.StatusSeeOther {
+		t.Errorf("got %d after the logout, want a redirect to the login", w.Code)
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.1,unix")
+	h := NewAdminHandler(newTestDB(t), nil, NewLimiter())
+	h.AuthHeader = "X-Forwarded-User"
+	for _, tc := range []struct {
+		name   string
+		remote string
+		user   string
+		want   int
+	}{
+		{name: "trusted proxy", remote: "10.0.0.1:1234", user: "admin", want: http.StatusOK},
+		{name: "unix socket", remote: "@", user: "admin", want: http.StatusOK},
+		{name: "trusted proxy without user", remote: "10.0.0.1:1234", want: http.StatusUnauthorized},
+		{name: "untrusted peer", remote: "10.0.0.2:1234", user: "admin", want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.user != "" {
+				r.Header.Set("X-Forwarded-User", tc.user)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
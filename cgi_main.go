@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"log/syslog"
@@ -31,9 +32,24 @@ func main() {
 		os.Exit(1)
 	}
 	defer fh.Close()
+	fh.Limiter.UseDB(fh.DB)
 	err = cgi.Serve(fh)
 	if err != nil {
 		slog.Error("cgi.Serve", "err", err)
 		os.Exit(1)
 	}
+	// Let the web server finish the response, then run the update
+	// methods that are due, including retries left by earlier invocations.
+	// Stale hosts are only noticed when some other host reports in.
+	os.Stdout.Close()
+	err = fh.Queue.Drain(context.Background())
+	if err != nil {
+		slog.Error("Drain", "err", err)
+		os.Exit(1)
+	}
+	err = checkStale(context.Background(), fh.DB)
+	if err != nil {
+		slog.Error("checkStale", "err", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,302 @@
+//go:build server
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const cliUsage = `usage: fritzdyn [command]
+
+Without a command the server is started. Commands:
+
+  serve                    start the server
+  host add [-token t] [-zone z] [-checkin 1h] [-ip4 a] [-ip6 a] [-auto]
+           [-addr-policy reject|ignore|accept] [-allow cidrs] [-require-source]
+           [-cert sha256] <name> <domain>
+                           create a host and print its token, it is only
+                           shown once
+  host list                list the hosts with their addresses and last check-in
+  host show <host>         show a host with its records and update methods
+  host rm <host>           delete a host
+  record add [-zone z] [-no-inherit] <host> <domain>
+                           add a further domain to a host and print its id
+  record list <host>       list the further domains of a host
+  record rm <id>           delete a record with its update methods
+  device add [-zone z] [-ether mac | -iface-id ::1] <host> <domain>
+                           add a LAN device published with an address in
+                           the LAN prefix of the host and print its id
+  device list <host>       list the LAN devices of a host
+  device rm <id>           delete a LAN device
+  update add [-api-key VAR] [-config JSON] [-disabled] [-record id] <host> <method> [args]
+                           add an update method to a host, or to one of
+                           its records, and print its id
+  update list <host>       list the update methods of a host
+  update rm <id>           delete an update method
+  run-updates [-dry-run] <host>
+                           run the update methods of a host and its
+                           records now
+  token gen                print a new random token
+  token rotate [-grace 168h] <host>
+                           give a host a new token and print it, the
+                           current one keeps working for the grace period
+  user add <username>      create an admin user
+  user passwd <username>   set the password of an admin user
+  user delete <username>   delete an admin user
+  apikey add <name> [scopes]
+                           create an API key, scopes are read (default)
+                           and/or write
+  apikey list              list the API keys
+  apikey revoke <id>       revoke an API key
+  db init                  create the database or bring it up to date
+  db backup <file>         write a consistent copy of the database to file
+  db migrate status        list the schema migrations and whether they are applied
+  db migrate up [version]  apply the pending migrations, up to version if given
+  db migrate down [version]
+                           revert the last migration, or all above version
+
+A <host> is given by its id, its name or one of its tokens. The server and the other
+commands apply pending migrations on their own. The password is read from
+the terminal, or from the first line of stdin if it is not a terminal.
+`
+
+// runCLI runs the command in args and returns the exit code.
+func runCLI(ctx context.Context, args []string) int {
+	err := cliCommand(ctx, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fritzdyn:", err)
+		return 1
+	}
+	return 0
+}
+
+func cliCommand(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "host":
+			return hostCommand(ctx, args[1:])
+		case "record":
+			return recordCommand(ctx, args[1:])
+		case "device":
+			return deviceCommand(ctx, args[1:])
+		case "update":
+			return updateCommand(ctx, args[1:])
+		case "run-updates":
+			return runUpdatesCommand(ctx, args[1:])
+		case "token":
+			return tokenCommand(ctx, args[1:])
+		case "db":
+			return dbCommand(ctx, args[1:])
+		case "user":
+			return userCommand(ctx, args[1:])
+		case "apikey":
+			return apiKeyCommand(ctx, args[1:])
+		case "migrate":
+			// Short for db migrate.
+			return migrateCommand(ctx, args[1:])
+		}
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return errors.New("invalid command")
+}
+
+func userCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	username := args[1]
+	switch args[0] {
+	case "add", "passwd":
+		var exists bool
+		err = fh.DB.GetContext(ctx, &exists, "SELECT COUNT(*) > 0 FROM users WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		if args[0] == "add" && exists {
+			return fmt.Errorf("user %s already exists", username)
+		}
+		if args[0] == "passwd" && !exists {
+			return fmt.Errorf("no user %s", username)
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		return setUserPassword(ctx, fh.DB, username, password)
+	case "delete":
+		res, err := fh.DB.ExecContext(ctx, "DELETE FROM users WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("no user %s", username)
+		}
+		return nil
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown user command %q", args[0])
+}
+
+func apiKeyCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	switch {
+	case args[0] == "add" && len(args) >= 2:
+		scopes := scopeRead
+		if len(args) == 3 {
+			scopes = args[2]
+		}
+		k, key, err := createAPIKey(ctx, fh.DB, args[1], scopes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "created API key %d %s (%s), it is only shown once:\n", k.Id, k.Name, k.Scopes)
+		fmt.Println(key)
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		var keys []APIKey
+		err = fh.DB.SelectContext(ctx, &keys, "SELECT * FROM api_keys ORDER BY id")
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			state := "never used"
+			if k.LastUsed != nil {
+				state = "last used " + k.LastUsed.Local().Format(time.DateTime)
+			}
+			if k.Revoked != nil {
+				state = "revoked " + k.Revoked.Local().Format(time.DateTime)
+			}
+			fmt.Printf("%4d %-20s %-10s %s\n", k.Id, k.Name, k.Scopes, state)
+		}
+		return nil
+	case args[0] == "revoke" && len(args) == 2:
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid API key id %q", args[1])
+		}
+		return revokeAPIKey(ctx, fh.DB, id)
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown apikey command %q", args[0])
+}
+
+// migrateCommand opens the database without migrating it, so that it can
+// be inspected and migrated down.
+func migrateCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	target := -1
+	if len(args) == 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		target = v
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	switch args[0] {
+	case "status":
+		all, err := migrations()
+		if err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(ctx, db)
+		if err != nil {
+			return err
+		}
+		appliedAt := make(map[int]time.Time)
+		for _, a := range applied {
+			appliedAt[a.Version] = a.Applied
+		}
+		for _, m := range all {
+			state := "pending"
+			if t, ok := appliedAt[m.Version]; ok {
+				state = "applied " + t.Local().Format(time.DateTime)
+			}
+			fmt.Printf("%04d %-20s %s\n", m.Version, m.Name, state)
+		}
+		if version := schemaVersion(applied); version > len(all) {
+			fmt.Printf("database is at version %d, newer than this binary\n", version)
+		}
+		return nil
+	case "up":
+		done, err := migrateUp(ctx, db, max(target, 0))
+		for _, m := range done {
+			fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+		}
+		return err
+	case "down":
+		if target < 0 {
+			applied, err := appliedMigrations(ctx, db)
+			if err != nil {
+				return err
+			}
+			target = schemaVersion(applied) - 1
+		}
+		done, err := migrateDown(ctx, db, target)
+		for _, m := range done {
+			fmt.Printf("reverted %04d %s\n", m.Version, m.Name)
+		}
+		return err
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+// readPassword asks for a password twice on the terminal, or reads one line
+// from stdin if it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(again) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
@@ -0,0 +1,607 @@
+//go:build server
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// cliHost returns the host named by s, its id, its name or one of its
+// tokens.
+func cliHost(ctx context.Context, db *sqlx.DB, s string) (*Host, error) {
+	var hosts []Host
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		err = db.SelectContext(ctx, &hosts, "SELECT * FROM hosts WHERE id = ?", id)
+	} else {
+		err = db.SelectContext(ctx, &hosts, "SELECT * FROM hosts WHERE name = ?", s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch len(hosts) {
+	case 0:
+		host, _, err := hostByToken(ctx, db, s)
+		if errors.Is(err, errNoHost) {
+			return nil, fmt.Errorf("no host %s", s)
+		}
+		return host, err
+	case 1:
+		return &hosts[0], nil
+	}
+	return nil, fmt.Errorf("%d hosts are named %s, use the id", len(hosts), s)
+}
+
+// parseFlags parses the flags of a subcommand and checks the number of
+// remaining arguments.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	fs.SetOutput(os.Stderr)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		fs.Usage()
+		return errors.New("wrong number of arguments")
+	}
+	return nil
+}
+
+func hostCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fs := flag.NewFlagSet("host "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "add":
+		token := fs.String("token", "", "token of the host, a new random token if empty")
+		zone := fs.String("zone", "", "DNS zone of the domain")
+		checkin := fs.String("checkin", "", "expected check-in interval, e.g. 1h")
+		ip4 := fs.String("ip4", "", "current IPv4 address")
+		ip6 := fs.String("ip6", "", "current IPv6 address")
+		auto := fs.Bool("auto", false, "use the source address of requests not reporting one")
+		policy := fs.String("addr-policy", policyReject, "reject, ignore or accept addresses in private and other special ranges")
+		allow := fs.String("allow", "", "comma separated CIDR prefixes updates are accepted from, any if empty")
+		requireSource := fs.Bool("require-source", false, "only accept updates reporting the source address of the request")
+		cert := fs.String("cert", "", "SHA-256 fingerprint of the client certificate updates must present")
+		err = parseFlags(fs, args[1:], 2, 2)
+		if err != nil {
+			return err
+		}
+		host := Host{Name: fs.Arg(0), Domain: fs.Arg(1), Zone: *zone, AutoAddr: *auto}
+		host.Ip4addr, host.Ip6addr, err = hostAddrs(*ip4, *ip6)
+		if err != nil {
+			return err
+		}
+		host.AddrPolicy, err = checkAddrPolicy(*policy)
+		if err != nil {
+			return err
+		}
+		err = setGuards(&host, *allow, *requireSource, *cert)
+		if err != nil {
+			return err
+		}
+		host.CheckinInterval, err = parseCheckinInterval(*checkin)
+		if err != nil {
+			return err
+		}
+		tok, err := insertHost(ctx, fh.DB, &host, *token)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "created host %d %s, the token is only shown once:\n", host.Id, host.Name)
+		fmt.Println(tok)
+		return nil
+	case "list":
+		err = parseFlags(fs, args[1:], 0, 0)
+		if err != nil {
+			return err
+		}
+		statuses, err := hostStatuses(ctx, fh.DB)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tDOMAIN\tIPV4\tIPV6\tLAST SEEN")
+		for _, s := range statuses {
+			lastSeen := "never"
+			if s.Seen.LastSeen != nil {
+				lastSeen = s.Seen.LastSeen.Local().Format(time.DateTime)
+			}
+			if s.Overdue() {
+				lastSeen += " (overdue)"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", s.Id, s.Name, s.Domain, deref(s.Ip4addr), deref(s.Ip6addr), lastSeen)
+		}
+		return tw.Flush()
+	case "show":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "Id:\t%d\nName:\t%s\nDomain:\t%s\nZone:\t%s\nIPv4:\t%s\nIPv6:\t%s\nLAN prefix:\t%s\nCheck-in:\t%s\nAuto address:\t%t\nAddress policy:\t%s\nCreated:\t%s\nModified:\t%s\n",
+			host.Id, host.Name, host.Domain, host.Zone, deref(host.Ip4addr), deref(host.Ip6addr), deref(host.Ip6LanPrefix), host.CheckinDuration(), host.AutoAddr, host.AddrPolicy,
+			host.Created.Local().Format(time.DateTime), host.Modified.Local().Format(time.DateTime))
+		if host.AllowedSources != "" {
+			fmt.Fprintf(tw, "Allowed sources:\t%s\n", host.AllowedSources)
+		}
+		if host.RequireSource {
+			fmt.Fprintf(tw, "Require source:\t%t\n", host.RequireSource)
+		}
+		if host.CertFingerprint != nil {
+			fmt.Fprintf(tw, "Client certificate:\t%s\n", *host.CertFingerprint)
+		}
+		tokens, err := hostTokens(ctx, fh.DB, host.Id)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if t.Expires != nil {
+				fmt.Fprintf(tw, "Token:\tprevious, valid until %s\n", t.Expires.Local().Format(time.DateTime))
+			} else {
+				fmt.Fprintf(tw, "Token:\tcreated %s\n", t.Created.Local().Format(time.DateTime))
+			}
+		}
+		var seen HostSeen
+		err = fh.DB.GetContext(ctx, &seen, "SELECT * FROM host_seen WHERE host_id = ?", host.Id)
+		if err == nil && seen.LastSeen != nil {
+			fmt.Fprintf(tw, "Last seen:\t%s from %s\n", seen.LastSeen.Local().Format(time.DateTime), seen.RemoteAddr)
+		}
+		if err == nil && seen.AddrWarning != nil {
+			fmt.Fprintf(tw, "Warning:\t%s\n", *seen.AddrWarning)
+		}
+		drift, err := hostDrift(ctx, fh.DB, host.Id)
+		if err == nil && drift != nil {
+			state := "in sync"
+			switch {
+			case drift.Drift:
+				state = "DRIFT"
+			case drift.Unknown():
+				state = "unknown"
+			case drift.Error != nil:
+				state = "check failed: " + *drift.Error
+			}
+			fmt.Fprintf(tw, "DNS:\t%s, %s (%s, checked %s)\n", state, drift.Published, drift.Source, drift.Checked.Local().Format(time.DateTime))
+		}
+		err = tw.Flush()
+		if err != nil {
+			return err
+		}
+		recs, err := hostRecords(ctx, fh.DB, host.Id)
+		if err != nil {
+			return err
+		}
+		if len(recs) > 0 {
+			fmt.Println()
+			err = printRecords(recs)
+			if err != nil {
+				return err
+			}
+		}
+		devs, err := lanDevices(ctx, fh.DB, host.Id)
+		if err != nil {
+			return err
+		}
+		if len(devs) > 0 {
+			fmt.Println()
+			err = printDevices(devs)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println()
+		return printUpdates(ctx, fh.DB, host)
+	case "rm":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		_, err = deleteHost(ctx, fh.DB, host.Id)
+		return err
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown host command %q", args[0])
+}
+
+func printUpdates(ctx context.Context, db *sqlx.DB, host *Host) error {
+	var updates []Update
+	err := db.SelectContext(ctx, &updates, "SELECT * FROM updates WHERE host_id = ? ORDER BY position, id", host.Id)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tRECORD\tMETHOD\tARGS\tAPI KEY\tCONFIG\tENABLED")
+	for _, u := range updates {
+		record := "host"
+		if u.RecordId != nil {
+			record = strconv.FormatInt(*u.RecordId, 10)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%t\n", u.Id, record, u.Cmd, u.Args, deref(u.ApiKey), deref(u.Config), u.Enabled)
+	}
+	return tw.Flush()
+}
+
+func printRecords(recs []HostRecord) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECORD\tDOMAIN\tZONE\tINHERIT")
+	for _, rec := range recs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", rec.Id, rec.Domain, rec.Zone, rec.Inherit)
+	}
+	return tw.Flush()
+}
+
+func recordCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fs := flag.NewFlagSet("record "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "add":
+		zone := fs.String("zone", "", "DNS zone of the domain, that of the host if empty")
+		noInherit := fs.Bool("no-inherit", false, "do not run the update methods of the host for the record")
+		err = parseFlags(fs, args[1:], 2, 2)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		rec := HostRecord{HostId: host.Id, Domain: fs.Arg(1), Zone: *zone, Inherit: !*noInherit}
+		err = insertRecord(ctx, fh.DB, &rec)
+		if err != nil {
+			return err
+		}
+		fmt.Println(rec.Id)
+		return nil
+	case "list":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		recs, err := hostRecords(ctx, fh.DB, host.Id)
+		if err != nil {
+			return err
+		}
+		return printRecords(recs)
+	case "rm":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid record id %q", fs.Arg(0))
+		}
+		_, err = hostRecord(ctx, fh.DB, id)
+		if err != nil {
+			return fmt.Errorf("no record %d", id)
+		}
+		return deleteRecord(ctx, fh.DB, id)
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown record command %q", args[0])
+}
+
+func printDevices(devs []LanDevice) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tDOMAIN\tZONE\tMAC\tIFACE ID\tIPV6")
+	for _, dev := range devs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", dev.Id, dev.Domain, dev.Zone, deref(dev.Ether), deref(dev.IfaceId), deref(dev.Ip6addr))
+	}
+	return tw.Flush()
+}
+
+func deviceCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fs := flag.NewFlagSet("device "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "add":
+		zone := fs.String("zone", "", "DNS zone of the domain, that of the host if empty")
+		ether := fs.String("ether", "", "MAC address the interface identifier is derived from")
+		ifaceID := fs.String("iface-id", "", "static interface identifier, e.g. ::1:2:3:4")
+		err = parseFlags(fs, args[1:], 2, 2)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		dev := LanDevice{Domain: fs.Arg(1), Zone: *zone, Ether: optional(*ether), IfaceId: optional(*ifaceID)}
+		err = insertLanDevice(ctx, fh.DB, fh.Queue, host, &dev)
+		if err != nil {
+			return err
+		}
+		fmt.Println(dev.Id)
+		return nil
+	case "list":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		devs, err := lanDevices(ctx, fh.DB, host.Id)
+		if err != nil {
+			return err
+		}
+		return printDevices(devs)
+	case "rm":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid device id %q", fs.Arg(0))
+		}
+		_, err = lanDevice(ctx, fh.DB, id)
+		if err != nil {
+			return fmt.Errorf("no device %d", id)
+		}
+		return deleteLanDevice(ctx, fh.DB, id)
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown device command %q", args[0])
+}
+
+func updateCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fs := flag.NewFlagSet("update "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "add":
+		apiKey := fs.String("api-key", "", "environment variable holding the secret")
+		config := fs.String("config", "", "JSON config of the update method")
+		disabled := fs.Bool("disabled", false, "add the update method disabled")
+		record := fs.Int64("record", 0, "id of the record the update method is for, the host if 0")
+		err = parseFlags(fs, args[1:], 2, 3)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		u := Update{
+			HostId:  host.Id,
+			Cmd:     fs.Arg(1),
+			Args:    fs.Arg(2),
+			ApiKey:  optional(*apiKey),
+			Config:  optional(*config),
+			Enabled: !*disabled,
+		}
+		if *record != 0 {
+			u.RecordId = record
+		}
+		err = validateUpdate(&u)
+		if err != nil {
+			return err
+		}
+		if checkRecord(ctx, fh.DB, &u) != nil {
+			return fmt.Errorf("no record %d of host %s", *record, host.Name)
+		}
+		err = insertUpdate(ctx, fh.DB, &u)
+		if err != nil {
+			return err
+		}
+		fmt.Println(u.Id)
+		return nil
+	case "list":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		return printUpdates(ctx, fh.DB, host)
+	case "rm":
+		err = parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid update method id %q", fs.Arg(0))
+		}
+		found, err := deleteUpdate(ctx, fh.DB, id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no update method %d", id)
+		}
+		return nil
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return fmt.Errorf("unknown update command %q", args[0])
+}
+
+func tokenCommand(ctx context.Context, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "gen":
+		fmt.Println(newToken())
+		return nil
+	case len(args) >= 2 && args[0] == "rotate":
+		fs := flag.NewFlagSet("token rotate", flag.ContinueOnError)
+		grace := fs.Duration("grace", tokenGracePeriod(), "how long the current token keeps working")
+		err := parseFlags(fs, args[1:], 1, 1)
+		if err != nil {
+			return err
+		}
+		fh, err := NewFritzHandler()
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		token, err := rotateHostToken(ctx, fh.DB, host.Id, *grace)
+		if err != nil {
+			return err
+		}
+		if *grace > 0 {
+			fmt.Fprintf(os.Stderr, "the previous token of %s keeps working until %s\n", host.Name, time.Now().Add(*grace).Format(time.DateTime))
+		}
+		fmt.Println(token)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return errors.New("invalid command")
+}
+
+func dbCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return errors.New("invalid command")
+	}
+	switch args[0] {
+	case "init":
+		if len(args) != 1 {
+			break
+		}
+		fh, err := NewFritzHandler()
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		applied, err := appliedMigrations(ctx, fh.DB)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("database is at schema version %d\n", schemaVersion(applied))
+		return nil
+	case "migrate":
+		if len(args) == 1 {
+			return migrateCommand(ctx, []string{"up"})
+		}
+		return migrateCommand(ctx, args[1:])
+	case "backup":
+		if len(args) != 2 {
+			break
+		}
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		// VACUUM INTO writes a consistent copy while the server keeps
+		// running, it refuses to overwrite an existing file.
+		_, err = db.ExecContext(ctx, "VACUUM INTO ?", args[1])
+		return err
+	}
+	fmt.Fprint(os.Stderr, cliUsage)
+	return errors.New("invalid command")
+}
+
+// runUpdatesCommand runs the update methods of a host right away, like
+// "Run now" in the admin interface, or renders them like "Test".
+func runUpdatesCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("run-updates", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only show what the update methods would do")
+	err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	host, err := cliHost(ctx, fh.DB, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var updates []Update
+	err = fh.DB.SelectContext(ctx, &updates, "SELECT * FROM updates WHERE host_id = ? AND enabled ORDER BY position, id", host.Id)
+	if err != nil {
+		return err
+	}
+	failed, runs := 0, 0
+	for _, u := range updates {
+		targets, err := updateTargets(ctx, fh.DB, host, &u)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			old := *target
+			run, err := applyUpdate(ctx, fh.DB, target, &u, &old, hostForm(target), *dryRun)
+			runs++
+			result := "OK"
+			if err != nil {
+				result = "FAILED: " + err.Error()
+				failed++
+			}
+			fmt.Printf("#%d %s %s: %s\n", u.Id, u.Cmd, target.Domain, result)
+			if run != nil {
+				if run.Args != "" {
+					fmt.Printf("  args: %s\n", run.Args)
+				}
+				if run.Output != "" {
+					fmt.Printf("  output: %s\n", strings.TrimSpace(run.Output))
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d runs failed", failed, runs)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+//go:build server
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// setTestDSN points the commands at a new database in a temporary
+// directory and returns its path.
+func setTestDSN(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fritzdyn.sqlite3")
+	t.Setenv("SQL_DRIVER", "sqlite")
+	t.Setenv("SQL_DSN", path)
+	return path
+}
+
+// runTestCLI runs the command line args and returns what it printed to
+// stdout.
+func runTestCLI(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	err = cliCommand(context.Background(), args)
+	os.Stdout = stdout
+	if _, serr := out.Seek(0, io.SeekStart); serr != nil {
+		t.Fatal(serr)
+	}
+	buf, rerr := io.ReadAll(out)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(buf), err
+}
+
+func TestCLIHosts(t *testing.T) {
+	ctx := context.Background()
+	setTestDSN(t)
+	out, err := runTestCLI(t, "host", "add", "-zone", "example.org", "-ip4", "192.0.2.1", "-checkin", "1h", "home", "home.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimSpace(out)
+	if len(token) < minTokenLength {
+		t.Fatalf("got token %q", token)
+	}
+	if _, err := runTestCLI(t, "host", "add", "-token", "short", "office", "office.example.org"); !errors.Is(err, errTokenTooShort) {
+		t.Errorf("got %v for a short token, want errTokenTooShort", err)
+	}
+	if _, err := runTestCLI(t, "host", "add", "-ip4", "192.0.2", "office", "office.example.org"); err == nil {
+		t.Error("invalid address accepted")
+	}
+	if _, err := runTestCLI(t, "host", "add", "office"); err == nil {
+		t.Error("host without domain accepted")
+	}
+	out, err = runTestCLI(t, "host", "list")
+	if err != nil || !strings.Contains(out, "home.example.org") || !strings.Contains(out, "192.0.2.1") || strings.Contains(out, "office") {
+		t.Errorf("got list %q, %v, want only home", out, err)
+	}
+	// The host can be named by its token.
+	out, err = runTestCLI(t, "host", "show", token)
+	if err != nil || !strings.Contains(out, "home.example.org") {
+		t.Errorf("got %q, %v showing the host by token", out, err)
+	}
+	fh, err := NewFritzHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	host, _, err := hostByToken(ctx, fh.DB, token)
+	if err != nil || host.Name != "home" || host.Zone != "example.org" || host.CheckinDuration() != "1h0m0s" {
+		t.Fatalf("got %+v, %v for the token", host, err)
+	}
+	if _, err := runTestCLI(t, "host", "rm", "home"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := hostByToken(ctx, fh.DB, token); !errors.Is(err, errNoHost) {
+		t.Errorf("got %v for the token of the removed host, want errNoHost", err)
+	}
+	if _, err := runTestCLI(t, "host", "rm", "home"); err == nil || err.Error() != "no host home" {
+		t.Errorf("got %v removing the host again, want no host home", err)
+	}
+}
+
+func TestCLIRunUpdates(t *testing.T) {
+	ctx := context.Background()
+	setTestDSN(t)
+	for _, args := range [][]string{
+		{"host", "add", "-zone", "example.org", "-ip4", "192.0.2.1", "home", "home.example.org"},
+		{"record", "add", "home", "www.example.org"},
+		{"update", "add", "-config", `{"argv": ["echo", "{{.Host.Domain}}", "{{.Host.Ip4addr}}"]}`, "home", "exec"},
+		{"host", "add", "broken", "broken.example.org"},
+		{"update", "add", "-config", `{"argv": ["false"]}`, "broken", "exec"},
+	} {
+		if _, err := runTestCLI(t, args...); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+	runs := func() int {
+		db, err := openDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var n int
+		db.GetContext(ctx, &n, "SELECT COUNT(*) FROM update_runs")
+		return n
+	}
+	out, err := runTestCLI(t, "run-updates", "-dry-run", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#1 exec home.example.org: OK\n  args: echo home.example.org 192.0.2.1\n" +
+		"#1 exec www.example.org: OK\n  args: echo www.example.org 192.0.2.1\n"
+	if out != want || runs() != 0 {
+		t.Errorf("dry run: got %q and %d runs, want %q and none recorded", out, runs(), want)
+	}
+	out, err = runTestCLI(t, "run-updates", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "#1 exec home.example.org: OK\n  args: echo home.example.org 192.0.2.1\n  output: home.example.org 192.0.2.1\n" +
+		"#1 exec www.example.org: OK\n  args: echo www.example.org 192.0.2.1\n  output: www.example.org 192.0.2.1\n"
+	if out != want || runs() != 2 {
+		t.Errorf("run: got %q and %d runs, want %q and 2 recorded", out, runs(), want)
+	}
+	out, err = runTestCLI(t, "run-updates", "broken")
+	if err == nil || err.Error() != "1 of 1 runs failed" || !strings.HasPrefix(out, "#2 exec broken.example.org: FAILED: exit status 1") {
+		t.Errorf("got %q, %v for the failing update method", out, err)
+	}
+	if _, err := runTestCLI(t, "run-updates", "nobody"); err == nil {
+		t.Error("unknown host accepted")
+	}
+}
+
+func TestCLIBackup(t *testing.T) {
+	ctx := context.Background()
+	setTestDSN(t)
+	if _, err := runTestCLI(t, "host", "add", "home", "home.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup.sqlite3")
+	if _, err := runTestCLI(t, "db", "backup", backup); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlx.Connect("sqlite", backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var names []string
+	if err := db.SelectContext(ctx, &names, "SELECT name FROM hosts"); err != nil || len(names) != 1 || names[0] != "home" {
+		t.Errorf("got hosts %q, %v in the backup, want home", names, err)
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil || len(applied) == 0 {
+		t.Errorf("got %d migrations, %v in the backup", len(applied), err)
+	}
+	if _, err := runTestCLI(t, "db", "backup", backup); err == nil {
+		t.Error("existing backup overwritten")
+	}
+	if _, err := runTestCLI(t, "db", "backup"); err == nil {
+		t.Error("backup without file accepted")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// addrAuto is reported as ipaddr or ip6addr to ask for the source address
+// of the request.
+const addrAuto = "auto"
+
+// proxySet is the set of reverse proxies whose forwarding headers are
+// believed.
+type proxySet struct {
+	prefixes []netip.Prefix
+	// unix trusts peers without an IP address, i.e. connected through the
+	// unix socket the server listens on.
+	unix bool
+}
+
+// trustedProxies returns the proxies from TRUSTED_PROXIES.
+var trustedProxies = sync.OnceValue(func() proxySet {
+	return parseProxies(os.Getenv("TRUSTED_PROXIES"))
+})
+
+// parseProxies parses a comma separated list of addresses, CIDR prefixes
+// and "unix". Invalid entries are logged and skipped.
+func parseProxies(list string) proxySet {
+	var set proxySet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case s == "unix":
+			set.unix = true
+		case strings.Contains(s, "/"):
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				slog.Error("TRUSTED_PROXIES", "entry", s, "err", err)
+				continue
+			}
+			set.prefixes = append(set.prefixes, prefix.Masked())
+		default:
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				slog.Error("TRUSTED_PROXIES", "entry", s, "err", err)
+				continue
+			}
+			set.prefixes = append(set.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	return set
+}
+
+func (set proxySet) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range set.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client of r. If the peer is a
+// trusted proxy the forwarding headers are followed from the nearest hop
+// until an address not belonging to a trusted proxy, a Forwarded header
+// taking precedence over X-Forwarded-For. It reports false if there is no
+// usable address, e.g. because a proxy hid it.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	proxies := trustedProxies()
+	peer, err := netip.ParseAddr(splitHost(r.RemoteAddr))
+	if err == nil {
+		peer = peer.Unmap()
+		if !proxies.trusts(peer) {
+			return peer, true
+		}
+	} else if !proxies.unix {
+		return netip.Addr{}, false
+	}
+	hops := forwardedFor(r.Header)
+	if hops == nil {
+		return peer, peer.IsValid()
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Obfuscated or garbage, nothing beyond can be trusted.
+			return netip.Addr{}, false
+		}
+		addr = addr.Unmap()
+		if i == 0 || !proxies.trusts(addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// fromTrustedProxy reports whether the peer of r is a trusted proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	proxies := trustedProxies()
+	peer, err := netip.ParseAddr(splitHost(r.RemoteAddr))
+	if err != nil {
+		return proxies.unix
+	}
+	return proxies.trusts(peer)
+}
+
+// forwardedFor returns the client addresses in the Forwarded or, if there
+// is none, the X-Forwarded-For headers of h, the nearest hop last.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				node := ""
+				for _, pair := range strings.Split(elem, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if strings.EqualFold(key, "for") {
+						node = strings.Trim(value, `"`)
+					}
+				}
+				hops = append(hops, splitHost(node))
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(s))
+		}
+	}
+	return hops
+}
+
+// splitHost strips the port and the brackets of an IPv6 address from
+// hostport, if any.
+func splitHost(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+}
+
+// resolveAuto returns the addresses to store for a request reporting
+// ipaddr and ip6addr. "auto" stands for no address, unless useSource is
+// set: then the address of the client of r is used for its family if no
+// address of that family was reported.
+func resolveAuto(r *http.Request, useSource bool, ipaddr, ip6addr string) (string, string) {
+	if ipaddr == addrAuto {
+		ipaddr = ""
+	}
+	if ip6addr == addrAuto {
+		ip6addr = ""
+	}
+	if !useSource {
+		return ipaddr, ip6addr
+	}
+	addr, ok := clientAddr(r)
+	switch {
+	case !ok:
+		slog.WarnContext(r.Context(), "no source address", "remote", r.RemoteAddr)
+	case addr.Is4() && ipaddr == "":
+		ipaddr = addr.String()
+	case addr.Is6() && ip6addr == "":
+		ip6addr = addr.WithZone("").String()
+	}
+	return ipaddr, ip6addr
+}
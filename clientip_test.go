@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// setTrustedProxies trusts the proxies in list for the rest of the test.
+func setTrustedProxies(t *testing.T, list string) {
+	t.Helper()
+	saved := trustedProxies
+	set := parseProxies(list)
+	trustedProxies = func() proxySet { return set }
+	t.Cleanup(func() { trustedProxies = saved })
+}
+
+func TestClientAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		proxies string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", remote: "8.8.8.8:1234", want: "8.8.8.8"},
+		{name: "direct IPv6", remote: "[2001:4860::1]:1234", want: "2001:4860::1"},
+		{name: "mapped IPv4", remote: "[::ffff:8.8.8.8]:1234", want: "8.8.8.8"},
+		{name: "untrusted proxy ignored", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, want: "10.0.0.1"},
+		{name: "trusted proxy", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, want: "8.8.8.8"},
+		{name: "trusted proxy address", proxies: "10.0.0.1", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, want: "8.8.8.8"},
+		{name: "nearest untrusted hop", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 8.8.8.8, 10.0.0.2"}, want: "8.8.8.8"},
+		{name: "all hops trusted", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "trusted proxy without header", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "forwarded before x-forwarded-for", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": `for="[2001:4860::1]:4711";proto=https`, "X-Forwarded-For": "8.8.8.8"},
+			want:    "2001:4860::1"},
+		{name: "obfuscated hop", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "for=_hidden"}, want: ""},
+		{name: "garbage hop", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8, garbage"}, want: ""},
+		{name: "unix socket untrusted", remote: "@", headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, want: ""},
+		{name: "unix socket trusted", proxies: "unix", remote: "@",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, want: "8.8.8.8"},
+		{name: "invalid proxy entries skipped", proxies: "bogus, 10.0.0.0/33, 10.0.0.1", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, want: "8.8.8.8"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setTrustedProxies(t, tc.proxies)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			addr, ok := clientAddr(r)
+			got := ""
+			if ok {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveAuto(t *testing.T) {
+	setTrustedProxies(t, "")
+	for _, tc := range []struct {
+		remote          string
+		useSource       bool
+		ipaddr, ip6addr string
+		wantIP, wantIP6 string
+	}{
+		{"8.8.8.8:1", false, "auto", "auto", "", ""},
+		{"8.8.8.8:1", true, "auto", "auto", "8.8.8.8", ""},
+		{"8.8.8.8:1", true, "8.8.4.4", "", "8.8.4.4", ""},
+		{"[2001:4860::1]:1", true, "8.8.4.4", "auto", "8.8.4.4", "2001:4860::1"},
+		{"[2001:4860::1]:1", true, "", "2001:4860::2", "", "2001:4860::2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		ip, ip6 := resolveAuto(r, tc.useSource, tc.ipaddr, tc.ip6addr)
+		if ip != tc.wantIP || ip6 != tc.wantIP6 {
+			t.Errorf("%s %v %q %q: got %q %q, want %q %q", tc.remote, tc.useSource, tc.ipaddr, tc.ip6addr,
+				ip, ip6, tc.wantIP, tc.wantIP6)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// csrfCookie holds a random value per browser. Forms send a token derived
+// from it in the csrf_token field, htmx requests in the X-CSRF-Token
+// header. Another site can neither read the cookie nor the token, so it
+// cannot forge a request that carries both.
+const csrfCookie = "fritzdyn_csrf"
+
+func csrfTokenFor(secret string) string {
+	sum := sha256.Sum256([]byte("fritzdyn csrf\x00" + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// csrfToken returns the token for the browser making the request. A new
+// cookie is set if it does not have one yet, so it must be called before
+// the response is written.
+func (h *AdminHandler) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return csrfTokenFor(cookie.Value)
+	}
+	secret := rand.Text()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    secret,
+		Path:     "/admin/",
+		Secure:   !h.InsecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Make the cookie visible to later calls for the same request.
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: secret})
+	return csrfTokenFor(secret)
+}
+
+// checkCSRF reports whether a request that changes state carries the token
+// matching its cookie. Safe methods always pass.
+func checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.PostFormValue("csrf_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(csrfTokenFor(cookie.Value))) == 1
+}
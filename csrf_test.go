@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	const secret = "browser-secret"
+	token := csrfTokenFor(secret)
+	for _, tc := range []struct {
+		name   string
+		method string
+		cookie string
+		header string
+		form   string
+		want   bool
+	}{
+		{name: "GET", method: http.MethodGet, want: true},
+		{name: "HEAD", method: http.MethodHead, want: true},
+		{name: "POST form token", method: http.MethodPost, cookie: secret, form: token, want: true},
+		{name: "DELETE header token", method: http.MethodDelete, cookie: secret, header: token, want: true},
+		{name: "header before form", method: http.MethodPost, cookie: secret, header: "wrong", form: token},
+		{name: "no cookie", method: http.MethodPost, form: token},
+		{name: "no token", method: http.MethodPost, cookie: secret},
+		{name: "token of another cookie", method: http.MethodPost, cookie: "other", form: token},
+		{name: "cookie value as token", method: http.MethodPost, cookie: secret, form: secret},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{}
+			if tc.form != "" {
+				form.Set("csrf_token", tc.form)
+			}
+			r := httptest.NewRequest(tc.method, "/admin/host/1", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tc.cookie})
+			}
+			if tc.header != "" {
+				r.Header.Set("X-CSRF-Token", tc.header)
+			}
+			if got := checkCSRF(r); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	h := &AdminHandler{}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	token := h.csrfToken(w, r)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || !cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Fatalf("got cookies %v, want one secure %s cookie", cookies, csrfCookie)
+	}
+	if token != csrfTokenFor(cookies[0].Value) {
+		t.Error("token does not match the cookie")
+	}
+	// Later calls for the same request and the next requests reuse the cookie.
+	if again := h.csrfToken(w, r); again != token {
+		t.Errorf("got token %q for the same request, want %q", again, token)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	r.AddCookie(cookies[0])
+	if next := h.csrfToken(w, r); next != token || len(w.Result().Cookies()) != 0 {
+		t.Errorf("got token %q and cookies %v for the next request, want %q and none", next, w.Result().Cookies(), token)
+	}
+}
+
+func TestAdminRejectsForgedRequests(t *testing.T) {
+	setTrustedProxies(t, "192.0.2.1")
+	h := NewAdminHandler(newTestDB(t), nil, NewLimiter())
+	h.AuthHeader = "X-User"
+	for _, tc := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{name: "GET", method: http.MethodGet, want: http.StatusOK},
+		{name: "POST without token", method: http.MethodPost, want: http.StatusForbidden},
+		{name: "cross-origin POST", method: http.MethodPost, headers: map[string]string{
+			"Sec-Fetch-Site": "cross-site", "X-CSRF-Token": csrfTokenFor("s")}, want: http.StatusForbidden},
+		{name: "PUT not routed", method: http.MethodPut, headers: map[string]string{"X-CSRF-Token": csrfTokenFor("s")},
+			want: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/admin/", nil)
+			r.Header.Set("X-User", "admin")
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "s"})
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
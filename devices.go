@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errDeviceExists = errors.New("domain is already a LAN device of the host")
+	errDeviceIID    = errors.New("either a MAC address or an interface identifier is required, not both")
+)
+
+// LanDevice is a device in the LAN of a host, e.g. a NAS, with a stable
+// interface identifier. Its IPv6 address is derived from the prefix the
+// FRITZ!Box reports as ip6lanprefix and published under its own domain by
+// the update methods of the host.
+type LanDevice struct {
+	Id     int64
+	HostId int64 `db:"host_id"`
+	Domain string
+	Zone   string
+	// Ether is the MAC address the interface identifier is derived from
+	// as EUI-64, IfaceId a static interface identifier like ::1:2:3:4.
+	// Exactly one of them is set.
+	Ether   *string
+	IfaceId *string `db:"iface_id"`
+	// Ip6addr is the address for the current prefix, nil while there is
+	// none.
+	Ip6addr  *string
+	Modified time.Time
+	Created  time.Time
+}
+
+// Host returns host as the update methods see it for the device: with the
+// domain, zone and address of the device and without an IPv4 address. An
+// empty zone is taken from the host.
+func (dev *LanDevice) Host(host *Host) *Host {
+	h := *host
+	h.Domain = dev.Domain
+	if dev.Zone != "" {
+		h.Zone = dev.Zone
+	}
+	h.Ip4addr = nil
+	h.Ip6addr = dev.Ip6addr
+	return &h
+}
+
+// interfaceID returns the interface identifier of the device. Malformed
+// identifiers are reported as errBadAddr.
+func (dev *LanDevice) interfaceID() ([8]byte, error) {
+	var iid [8]byte
+	var err error
+	switch {
+	case dev.Ether != nil && dev.IfaceId == nil:
+		var mac net.HardwareAddr
+		mac, err = net.ParseMAC(*dev.Ether)
+		if err == nil {
+			iid, err = eui64(mac)
+		}
+	case dev.IfaceId != nil && dev.Ether == nil:
+		iid, err = parseIfaceID(*dev.IfaceId)
+	default:
+		return iid, errDeviceIID
+	}
+	if err != nil {
+		return iid, fmt.Errorf("%w: %w", errBadAddr, err)
+	}
+	return iid, nil
+}
+
+// eui64 returns the modified EUI-64 interface identifier of mac, which
+// must be in EUI-48 or EUI-64 form.
+func eui64(mac net.HardwareAddr) ([8]byte, error) {
+	var iid [8]byte
+	switch len(mac) {
+	case 8:
+		// If MAC is in EUI-64 form, directly copy it.
+		copy(iid[:], mac)
+	case 6:
+		// If MAC is in EUI-48 form, split first three bytes and last
+		// three bytes, and inject 0xff and 0xfe between them.
+		copy(iid[0:3], mac[0:3])
+		iid[3] = 0xff
+		iid[4] = 0xfe
+		copy(iid[5:8], mac[3:6])
+	default:
+		return iid, fmt.Errorf("%s is not EUI-48 or EUI-64", mac)
+	}
+	// Flip 7th bit from left on the first byte of the MAC address, the
+	// "universal/local (U/L)" bit.  See RFC 4291, Section 2.5.1 for more
+	// information.
+	iid[0] ^= 0x02
+	return iid, nil
+}
+
+// parseIfaceID parses a static interface identifier written as an IPv6
+// address with the upper 64 bits zero, e.g. ::1:2:3:4.
+func parseIfaceID(s string) ([8]byte, error) {
+	var iid [8]byte
+	addr, err := netip.ParseAddr(s)
+	if err != nil || !addr.Is6() || addr.Is4In6() || addr.Zone() != "" {
+		return iid, fmt.Errorf("interface identifier %q is not written like ::1:2:3:4", s)
+	}
+	b := addr.As16()
+	if [8]byte(b[0:8]) != [8]byte{} {
+		return iid, fmt.Errorf("interface identifier %s is longer than 64 bits", s)
+	}
+	if [8]byte(b[8:16]) == iid {
+		return iid, fmt.Errorf("interface identifier %s is zero", s)
+	}
+	return [8]byte(b[8:16]), nil
+}
+
+// parseLanPrefix parses the ip6lanprefix reported by a FRITZ!Box. It must
+// be an IPv6 prefix of at most 64 bits, host bits are cleared.
+func parseLanPrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: ip6lanprefix %q does not parse", errBadAddr, s)
+	}
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() == 0 || prefix.Bits() > 64 ||
+		prefix.Addr().IsUnspecified() || prefix.Addr().IsMulticast() {
+		return netip.Prefix{}, fmt.Errorf("%w: ip6lanprefix %s is not an IPv6 prefix of up to 64 bits", errBadAddr, prefix)
+	}
+	return prefix, nil
+}
+
+// checkLanPrefix parses s like parseLanPrefix and applies the address
+// policy of a host to it like checkAddrs. A prefix dropped by the ignore
+// policy is returned as the zero prefix and described in warning.
+func checkLanPrefix(policy, s string) (netip.Prefix, string, error) {
+	prefix, err := parseLanPrefix(s)
+	if err != nil {
+		return netip.Prefix{}, "", err
+	}
+	class := addrRange(prefix.Addr())
+	if class == "" || policy == policyAccept {
+		return prefix, "", nil
+	}
+	msg := fmt.Sprintf("ip6lanprefix %s is in a %s range", prefix, class)
+	if policy != policyIgnore {
+		return netip.Prefix{}, "", fmt.Errorf("%w: %s", errBadAddr, msg)
+	}
+	return netip.Prefix{}, "ignored " + msg, nil
+}
+
+// lanAddr returns the address with the upper 64 bits of prefix and the
+// interface identifier iid.
+func lanAddr(prefix netip.Prefix, iid [8]byte) netip.Addr {
+	b := prefix.Addr().As16()
+	copy(b[8:16], iid[:])
+	return netip.AddrFrom16(b)
+}
+
+// deviceAddr returns the address of dev in the LAN of host, nil if the
+// host has not reported a prefix yet.
+func deviceAddr(host *Host, dev *LanDevice) (*string, error) {
+	if host.Ip6LanPrefix == nil {
+		return nil, nil
+	}
+	prefix, err := parseLanPrefix(*host.Ip6LanPrefix)
+	if err != nil {
+		return nil, err
+	}
+	iid, err := dev.interfaceID()
+	if err != nil {
+		return nil, err
+	}
+	addr := lanAddr(prefix, iid).String()
+	return &addr, nil
+}
+
+// lanDevices returns the LAN devices of the host with id, sorted by
+// domain.
+func lanDevices(ctx context.Context, q sqlx.QueryerContext, id int64) ([]LanDevice, error) {
+	var devs []LanDevice
+	err := sqlx.SelectContext(ctx, q, &devs, "SELECT * FROM lan_devices WHERE host_id = ? ORDER BY domain", id)
+	return devs, err
+}
+
+// lanDevice returns the LAN device with id. It returns sql.ErrNoRows if
+// there is no such device.
+func lanDevice(ctx context.Context, q sqlx.QueryerContext, id int64) (*LanDevice, error) {
+	var dev LanDevice
+	err := sqlx.GetContext(ctx, q, &dev, "SELECT * FROM lan_devices WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// insertLanDevice adds dev to host and fills in the columns set by the
+// database. If the host has reported a prefix, the address of the device
+// is computed and queued for the update methods of the host.
+func insertLanDevice(ctx context.Context, db *sqlx.DB, queue *Queue, host *Host, dev *LanDevice) error {
+	dev.HostId = host.Id
+	dev.Domain = strings.TrimSpace(dev.Domain)
+	dev.Zone = strings.TrimSpace(dev.Zone)
+	if dev.Domain == "" {
+		return errNoDomain
+	}
+	iid, err := dev.interfaceID()
+	if err != nil {
+		return err
+	}
+	// Store the identifiers in canonical form.
+	if dev.Ether != nil {
+		mac, _ := net.ParseMAC(*dev.Ether)
+		s := mac.String()
+		dev.Ether = &s
+	} else {
+		s := lanAddr(netip.MustParsePrefix("::/64"), iid).String()
+		dev.IfaceId = &s
+	}
+	dev.Ip6addr, err = deviceAddr(host, dev)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var taken bool
+	err = tx.GetContext(ctx, &taken, "SELECT EXISTS (SELECT 1 FROM lan_devices WHERE host_id = ? AND domain = ?)", host.Id, dev.Domain)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errDeviceExists
+	}
+	err = tx.GetContext(ctx, dev, `INSERT INTO lan_devices (host_id, domain, zone, ether, iface_id, ip6addr)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING *`, dev.HostId, dev.Domain, dev.Zone, dev.Ether, dev.IfaceId, dev.Ip6addr)
+	if err != nil {
+		return err
+	}
+	if dev.Ip6addr != nil {
+		err = queue.EnqueueDevice(ctx, tx, host, dev, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	queue.Notify()
+	return nil
+}
+
+// deleteLanDevice removes the LAN device with id together with its
+// pending jobs. Its published record is left alone.
+func deleteLanDevice(ctx context.Context, db *sqlx.DB, id int64) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM jobs WHERE device_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM lan_devices WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateLanPrefix stores prefix as the LAN prefix of host inside tx,
+// recomputes the addresses of its devices and queues the update methods
+// of the host for every device whose address changed. It reports whether
+// anything changed.
+func updateLanPrefix(ctx context.Context, tx *sqlx.Tx, queue *Queue, host *Host, prefix netip.Prefix) (bool, error) {
+	s := prefix.String()
+	changed := host.Ip6LanPrefix == nil || *host.Ip6LanPrefix != s
+	if changed {
+		host.Ip6LanPrefix = &s
+		_, err := tx.ExecContext(ctx, "UPDATE hosts SET ip6lanprefix = ? WHERE id = ?", s, host.Id)
+		if err != nil {
+			return false, err
+		}
+	}
+	devs, err := lanDevices(ctx, tx, host.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, dev := range devs {
+		addr, err := deviceAddr(host, &dev)
+		if err != nil {
+			return false, err
+		}
+		if equalAddr(addr, dev.Ip6addr) {
+			continue
+		}
+		old := dev.Ip6addr
+		dev.Ip6addr = addr
+		_, err = tx.ExecContext(ctx, "UPDATE lan_devices SET ip6addr = ? WHERE id = ?", dev.Ip6addr, dev.Id)
+		if err != nil {
+			return false, err
+		}
+		err = queue.EnqueueDevice(ctx, tx, host, &dev, old)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestEUI64(t *testing.T) {
+	for _, tc := range []struct {
+		mac  string
+		want string
+	}{
+		{"00:1a:2b:3c:4d:5e", "::21a:2bff:fe3c:4d5e"},
+		{"02:00:5e:10:00:01", "::5eff:fe10:1"},
+		{"3c:a6:2f:00:00:ff", "::3ea6:2fff:fe00:ff"},
+		{"00:11:22:33:44:55:66:77", "::211:2233:4455:6677"},
+		{"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01", ""},
+	} {
+		mac, err := net.ParseMAC(tc.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iid, err := eui64(mac)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %x, want an error", tc.mac, iid)
+			}
+			continue
+		}
+		if got := lanAddr(netip.MustParsePrefix("::/64"), iid).String(); err != nil || got != tc.want {
+			t.Errorf("%s: got %s, %v, want %s", tc.mac, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseIfaceID(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want [8]byte
+		ok   bool
+	}{
+		{"::1:2:3:4", [8]byte{0, 1, 0, 2, 0, 3, 0, 4}, true},
+		{"::1", [8]byte{7: 1}, true},
+		{"::ffff:ffff:ffff:ffff", [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true},
+		{"::", [8]byte{}, false},
+		{"2001:db8::1", [8]byte{}, false},
+		{"::1:0:0:0:0", [8]byte{}, false},
+		{"::ffff:192.0.2.1", [8]byte{}, false},
+		{"192.0.2.1", [8]byte{}, false},
+		{"::1%eth0", [8]byte{}, false},
+		{"00:1a:2b:3c:4d:5e", [8]byte{}, false},
+	} {
+		got, err := parseIfaceID(tc.s)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: got %x, %v, want %x, ok %v", tc.s, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLanAddr(t *testing.T) {
+	iid := [8]byte{0x02, 0x1a, 0x2b, 0xff, 0xfe, 0x3c, 0x4d, 0x5e}
+	for _, tc := range []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8:1:2::/64", "2001:db8:1:2:21a:2bff:fe3c:4d5e"},
+		{"2001:db8:1:200::/56", "2001:db8:1:200:21a:2bff:fe3c:4d5e"},
+		{"2001:db8::/48", "2001:db8::21a:2bff:fe3c:4d5e"},
+	} {
+		prefix, err := parseLanPrefix(tc.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lanAddr(prefix, iid).String(); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateLanPrefix(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	q := NewQueue(db)
+	host := newTestHost(t, db, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	_, err := db.ExecContext(ctx, "INSERT INTO updates (host_id, cmd, args) VALUES (?, 'GET', 'https://example.org/')", host.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs := []*LanDevice{
+		{Domain: "nas.example.org", Ether: optional("00:1a:2b:3c:4d:5e")},
+		{Domain: "printer.example.org", IfaceId: optional("::1:2:3:4")},
+	}
+	for _, dev := range devs {
+		if err := insertLanDevice(ctx, db, q, host, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type job struct {
+		DeviceId   int64   `db:"device_id"`
+		OldIp6addr *string `db:"old_ip6addr"`
+		Ip6addr    *string
+	}
+	// update sets the prefix and returns the pending jobs with the new
+	// address of their device.
+	update := func(prefix string) (bool, []job) {
+		t.Helper()
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		changed, err := updateLanPrefix(ctx, tx, q, host, netip.MustParsePrefix(prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		var jobs []job
+		err = db.SelectContext(ctx, &jobs, `SELECT j.device_id, j.old_ip6addr, d.ip6addr FROM jobs j
+			JOIN lan_devices d ON d.id = j.device_id WHERE j.state = ? ORDER BY j.device_id`, jobPending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changed, jobs
+	}
+	check := func(name string, jobs []job, want ...[2]string) {
+		t.Helper()
+		if len(jobs) != len(want) {
+			t.Fatalf("%s: got %d jobs, want %d", name, len(jobs), len(want))
+		}
+		for i, j := range jobs {
+			if j.DeviceId != devs[i].Id || deref(j.OldIp6addr) != want[i][0] || deref(j.Ip6addr) != want[i][1] {
+				t.Errorf("%s: got job for device %d from %q to %q, want device %d from %q to %q", name,
+					j.DeviceId, deref(j.OldIp6addr), deref(j.Ip6addr), devs[i].Id, want[i][0], want[i][1])
+			}
+		}
+	}
+	changed, jobs := update("2001:db8:1:2::/64")
+	if !changed {
+		t.Error("first prefix not reported as a change")
+	}
+	check("first prefix", jobs,
+		[2]string{"", "2001:db8:1:2:21a:2bff:fe3c:4d5e"},
+		[2]string{"", "2001:db8:1:2:1:2:3:4"})
+	// The jobs are still waiting, the replacements keep the old address.
+	_, jobs = update("2001:db8:1:3::/64")
+	check("second prefix", jobs,
+		[2]string{"", "2001:db8:1:3:21a:2bff:fe3c:4d5e"},
+		[2]string{"", "2001:db8:1:3:1:2:3:4"})
+	if _, err := db.ExecContext(ctx, "DELETE FROM jobs"); err != nil {
+		t.Fatal(err)
+	}
+	changed, jobs = update("2001:db8:1:3::/64")
+	if changed || len(jobs) != 0 {
+		t.Errorf("same prefix: got changed %v and %d jobs, want no change", changed, len(jobs))
+	}
+	_, jobs = update("2001:db8:1:4::/64")
+	check("third prefix", jobs,
+		[2]string{"2001:db8:1:3:21a:2bff:fe3c:4d5e", "2001:db8:1:4:21a:2bff:fe3c:4d5e"},
+		[2]string{"2001:db8:1:3:1:2:3:4", "2001:db8:1:4:1:2:3:4"})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// serveDynDNS2 implements the dyndns2 protocol spoken by ddclient, inadyn,
+// OpenWrt and most other routers:
+//
+//	/nic/update?hostname=vpn.example.com&myip=192.0.2.1
+//
+// The host token is passed as the HTTP Basic auth password, the user name
+// is ignored. Without myip the source address of the request is used. The
+// answer is one of the usual dyndns2 return codes, one line per requested
+// hostname.
+func (fh *FritzHandler) serveDynDNS2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	err := r.ParseForm()
+	if err != nil {
+		slog.ErrorContext(ctx, "ParseForm", "err", err)
+		fmt.Fprintf(w, "911\n")
+		return
+	}
+	slog.DebugContext(ctx, "dyndns2 req", "url", redactURL(r.URL), "form", jobForm(r.Form))
+	_, token, ok := r.BasicAuth()
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fritzdyn"`)
+		http.Error(w, "badauth", http.StatusUnauthorized)
+		return
+	}
+	if wait := fh.limit(r, token); wait > 0 {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		fmt.Fprintf(w, "abuse\n")
+		return
+	}
+	var hostnames []string
+	for _, h := range strings.Split(r.FormValue("hostname"), ",") {
+		h = strings.TrimSuffix(strings.TrimSpace(h), ".")
+		if h != "" {
+			hostnames = append(hostnames, h)
+		}
+	}
+	if len(hostnames) == 0 {
+		fmt.Fprintf(w, "notfqdn\n")
+		return
+	}
+	var ipaddr, ip6addr string
+	for _, s := range strings.Split(r.FormValue("myip")+","+r.FormValue("myipv6"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" || s == addrAuto {
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			slog.ErrorContext(ctx, "ParseAddr", "myip", s, "err", err)
+			fmt.Fprintf(w, "911\n")
+			return
+		}
+		if addr.Unmap().Is4() {
+			ipaddr = addr.Unmap().String()
+		} else {
+			ip6addr = addr.String()
+		}
+	}
+	if ipaddr == "" && ip6addr == "" {
+		source, ok := clientAddr(r)
+		switch {
+		case !ok:
+			slog.WarnContext(ctx, "no source address", "remote", r.RemoteAddr)
+		case source.Is4():
+			ipaddr = source.String()
+		default:
+			ip6addr = source.WithZone("").String()
+		}
+	}
+	badToken, goodToken := false, false
+	for _, hostname := range hostnames {
+		if !strings.Contains(hostname, ".") {
+			fmt.Fprintf(w, "notfqdn\n")
+			continue
+		}
+		_, modified, err := fh.updateHost(ctx, r, sourceDynDNS2, token, hostname, ipaddr, ip6addr, "")
+		goodToken = goodToken || !errors.Is(err, errNoHost)
+		switch {
+		case errors.Is(err, errNoHost):
+			badToken = true
+			fmt.Fprintf(w, "badauth\n")
+		case errors.Is(err, errForbidden):
+			fmt.Fprintf(w, "badauth\n")
+		case errors.Is(err, errDomainMismatch):
+			fmt.Fprintf(w, "nohost\n")
+		case err != nil:
+			// Also for invalid or refused addresses.
+			fmt.Fprintf(w, "911\n")
+		case modified:
+			fmt.Fprintf(w, "good %s\n", dynDNS2Addrs(ipaddr, ip6addr))
+		default:
+			fmt.Fprintf(w, "nochg %s\n", dynDNS2Addrs(ipaddr, ip6addr))
+		}
+	}
+	if badToken {
+		fh.fail(r)
+	}
+	if goodToken {
+		fh.succeed(r)
+	}
+}
+
+// dynDNS2Addrs formats the addresses reported by a request for a good or
+// nochg answer. Addresses stored for the host but not reported are left
+// out.
+func dynDNS2Addrs(ipaddr, ip6addr string) string {
+	var addrs []string
+	for _, addr := range []string{ipaddr, ip6addr} {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDynDNS2(t *testing.T) {
+	fh := newTestHandler(t)
+	newTestHost(t, fh.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	for _, tc := range []struct {
+		name     string
+		query    string
+		token    string
+		remote   string
+		want     string
+		wantCode int
+	}{
+		{name: "good", query: "hostname=home.example.org&myip=8.8.8.8", want: "good 8.8.8.8\n"},
+		{name: "nochg", query: "hostname=home.example.org&myip=8.8.8.8", want: "nochg 8.8.8.8\n"},
+		{name: "source address without myip", query: "hostname=home.example.org", want: "good 8.8.4.4\n"},
+		{name: "source address with auto", query: "hostname=home.example.org&myip=auto", want: "nochg 8.8.4.4\n"},
+		{name: "IPv6 source address", query: "hostname=home.example.org", remote: "[2001:4860::1]:1234",
+			want: "good 2001:4860::1\n"},
+		{name: "both families", query: "hostname=home.example.org&myip=8.8.8.8&myipv6=2001:4860::2", want: "good 8.8.8.8,2001:4860::2\n"},
+		{name: "only the reported address", query: "hostname=home.example.org&myip=8.8.8.8", want: "nochg 8.8.8.8\n"},
+		{name: "invalid myip", query: "hostname=home.example.org&myip=8.8.8", want: "911\n"},
+		{name: "private myip", query: "hostname=home.example.org&myip=192.168.1.1", want: "911\n"},
+		{name: "bad token", query: "hostname=home.example.org&myip=8.8.8.8", token: "wrong", want: "badauth\n"},
+		{name: "wrong hostname", query: "hostname=other.example.org&myip=8.8.8.8", want: "nohost\n"},
+		{name: "no hostname", query: "myip=8.8.8.8", want: "notfqdn\n"},
+		{name: "hostname without domain", query: "hostname=home&myip=8.8.8.8", want: "notfqdn\n"},
+		{name: "no auth", query: "hostname=home.example.org", token: "-", want: "badauth\n", wantCode: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/nic/update?"+tc.query, nil)
+			r.RemoteAddr = "8.8.4.4:1234"
+			if tc.remote != "" {
+				r.RemoteAddr = tc.remote
+			}
+			switch tc.token {
+			case "":
+				r.SetBasicAuth("fritzdyn", testToken)
+			case "-":
+			default:
+				r.SetBasicAuth("fritzdyn", tc.token)
+			}
+			w := httptest.NewRecorder()
+			fh.ServeHTTP(w, r)
+			wantCode := tc.wantCode
+			if wantCode == 0 {
+				wantCode = http.StatusOK
+			}
+			if w.Code != wantCode {
+				t.Errorf("got status %d, want %d", w.Code, wantCode)
+			}
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
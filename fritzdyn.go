@@ -1,58 +1,100 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"html/template"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-	"github.com/libdns/cloudflare"
-	"github.com/libdns/libdns"
 	"github.com/XSAM/otelsql"
+	"github.com/jmoiron/sqlx"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	_ "modernc.org/sqlite"
 )
 
 type Host struct {
-	Token    string
-	Name     string
-	Domain   string
-	Zone     string
-	Ip4addr  *string
-	Ip6addr  *string
-	Modified time.Time
-	Created  time.Time
+	Id      int64
+	Name    string
+	Domain  string
+	Zone    string
+	Ip4addr *string
+	Ip6addr *string
+	// CheckinInterval is the number of seconds after which a host that
+	// did not report in is considered stale, nil if it is not monitored.
+	CheckinInterval *int64 `db:"checkin_interval"`
+	// AutoAddr uses the source address of a request for the address
+	// family it came in with, if the host does not report one.
+	AutoAddr bool `db:"auto_addr"`
+	// AddrPolicy is what happens to a reported address in a private,
+	// CGNAT, link-local, ULA, documentation or loopback range: reject,
+	// ignore or accept.
+	AddrPolicy string `db:"addr_policy"`
+	// Ip6LanPrefix is the IPv6 prefix of the LAN of the host the
+	// addresses of its LAN devices are derived from.
+	Ip6LanPrefix *string `db:"ip6lanprefix"`
+	// AllowedSources is a comma separated list of the CIDR prefixes
+	// updates are accepted from, any if empty.
+	AllowedSources string `db:"allowed_sources"`
+	// RequireSource only accepts updates reporting the source address of
+	// the request for its address family.
+	RequireSource bool `db:"require_source"`
+	// CertFingerprint is the hex SHA-256 fingerprint of the client
+	// certificate updates must present, nil if none is required.
+	CertFingerprint *string `db:"cert_fingerprint"`
+	Modified        time.Time
+	Created         time.Time
 }
 
 type Update struct {
 	Id       int64
 	ApiKey   *string `db:"api_key"`
-	Token    string
+	HostId   int64   `db:"host_id"`
+	RecordId *int64  `db:"record_id"`
 	Cmd      string
 	Args     string
+	Config   *string
+	Position int64
+	Enabled  bool
 	Modified time.Time
 	Created  time.Time
 }
 
+var (
+	errNoHost         = errors.New("no such host")
+	errDomainMismatch = errors.New("configured domain does not match")
+)
+
 type FritzHandler struct {
-	DB *sqlx.DB
+	DB      *sqlx.DB
+	Queue   *Queue
+	Limiter *Limiter
 }
 
 func NewFritzHandler() (fh *FritzHandler, err error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	err = checkSchema(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &FritzHandler{DB: db, Queue: NewQueue(db), Limiter: NewLimiter()}, nil
+}
+
+// openDB connects to the database configured in SQL_DRIVER and SQL_DSN.
+func openDB() (*sqlx.DB, error) {
 	driverName := os.Getenv("SQL_DRIVER")
 	dsn := os.Getenv("SQL_DSN")
-	slog.Debug("NewFritzHandler", "driver", driverName, "dsn", dsn)
-	var db *sqlx.DB
+	slog.Debug("openDB", "driver", driverName, "dsn", dsn)
 	if os.Getenv("ENABLE_OTEL") == "true" {
 		db_instrumented, err := otelsql.Open(driverName, dsn, otelsql.WithAttributes(
 			semconv.DBSystemSqlite,
@@ -60,14 +102,9 @@ func NewFritzHandler() (fh *FritzHandler, err error) {
 		if err != nil {
 			return nil, err
 		}
-		db = sqlx.NewDb(db_instrumented, driverName)
-	} else {
-		db, err = sqlx.Connect(driverName, dsn)
-		if err != nil {
-			return nil, err
-		}
+		return sqlx.NewDb(db_instrumented, driverName), nil
 	}
-	return &FritzHandler{DB: db}, nil
+	return sqlx.Connect(driverName, dsn)
 }
 
 func (fh *FritzHandler) Close() error {
@@ -75,6 +112,14 @@ func (fh *FritzHandler) Close() error {
 }
 
 func (fh *FritzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/nic/update") {
+		fh.serveDynDNS2(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/health/hosts") {
+		fh.serveHostHealth(w, r)
+		return
+	}
 	ctx := r.Context()
 	err := r.ParseForm()
 	if err != nil {
@@ -82,22 +127,23 @@ func (fh *FritzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	slog.DebugContext(ctx, "req", "url", r.URL, "header", r.Header, "form", r.Form)
+	slog.DebugContext(ctx, "req", "url", redactURL(r.URL), "header", r.Header)
 	token := r.FormValue("token")
+	if wait := fh.limit(r, token); wait > 0 {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
 	ipaddr := r.FormValue("ipaddr")
 	ip6addr := r.FormValue("ip6addr")
 	ip6lanprefix := r.FormValue("ip6lanprefix")
 	ether := r.FormValue("ether")
 	domain := r.FormValue("domain")
 	if len(ip6addr) == 0 && len(ip6lanprefix) > 0 && len(ether) > 0 {
-		prefix, err := netip.ParsePrefix(ip6lanprefix)
+		// make ip6addr the EUI ipv6 from prefix and ether
+		prefix, err := parseLanPrefix(ip6lanprefix)
 		if err != nil {
-			slog.ErrorContext(ctx, "ParsePrefix", "ip6lanprefix", ip6lanprefix, "err", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
-		}
-		if !prefix.Addr().Is6() {
-			slog.ErrorContext(ctx, "is not ip6", "prefix", prefix.String())
+			slog.ErrorContext(ctx, "parseLanPrefix", "err", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
@@ -107,207 +153,205 @@ func (fh *FritzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		// make ip6addr the EUI ipv6 from prefix and ether
-		if prefix.Bits() == -1 || prefix.Bits() > 64 {
-			slog.ErrorContext(ctx, "bad prefix", "prefix", prefix.String())
+		iid, err := eui64(mac)
+		if err != nil {
+			slog.ErrorContext(ctx, "eui64", "err", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		// MAC must be in EUI-48 or EUI64 form.
-		if len(mac) != 6 && len(mac) != 8 {
-			slog.ErrorContext(ctx, "is not EUI-48 or EUI64", "mac", mac.String())
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+		ip6addr = lanAddr(prefix, iid).String()
+	}
+	_, modified, err := fh.updateHost(ctx, r, sourceFritzBox, token, domain, ipaddr, ip6addr, ip6lanprefix)
+	if !errors.Is(err, errNoHost) {
+		fh.succeed(r)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errNoHost):
+			fh.fail(r)
+			http.NotFound(w, r)
+		case errors.Is(err, errDomainMismatch):
+			http.Error(w, "Configured domain does not match", http.StatusForbidden)
+		case errors.Is(err, errForbidden):
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		case errors.Is(err, errBadAddr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-		pbytes := prefix.Addr().As16()
-		var ip [16]byte
-		copy(ip[0:8], pbytes[0:8])
+		return
+	}
+	if modified {
+		fmt.Fprintf(w, "OK modified\n")
+	} else {
+		fmt.Fprintf(w, "OK\n")
+	}
+}
 
-		// Flip 7th bit from left on the first byte of the MAC address, the
-		// "universal/local (U/L)" bit.  See RFC 4291, Section 2.5.1 for more
-		// information.
+// limit counts an update request with token and returns how long the
+// client has to wait if it is over a limit or locked out. A failing
+// limiter lets the request through.
+func (fh *FritzHandler) limit(r *http.Request, token string) time.Duration {
+	wait, err := fh.Limiter.Allow(r.Context(), remoteHost(r), token)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Limiter.Allow", "err", err)
+		return 0
+	}
+	return wait
+}
 
-		// If MAC is in EUI-64 form, directly copy it into output IP address.
-		if len(mac) == 8 {
-			copy(ip[8:16], mac)
-			ip[8] ^= 0x02
-		} else {
-			// If MAC is in EUI-48 form, split first three bytes and last three bytes,
-			// and inject 0xff and 0xfe between them.
-			copy(ip[8:11], mac[0:3])
-			ip[8] ^= 0x02
-			ip[11] = 0xff
-			ip[12] = 0xfe
-			copy(ip[13:16], mac[3:6])
-		}
-		ip6addr = netip.AddrFrom16(ip).String()
+// fail counts a bad token towards a lockout of the source of r.
+func (fh *FritzHandler) fail(r *http.Request) {
+	err := fh.Limiter.Fail(r.Context(), remoteHost(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Limiter.Fail", "err", err)
 	}
-	var host Host
+}
+
+// succeed forgets the bad tokens counted for the source of r, after it
+// sent a valid one.
+func (fh *FritzHandler) succeed(r *http.Request) {
+	err := fh.Limiter.Succeed(r.Context(), remoteHost(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Limiter.Succeed", "err", err)
+	}
+}
+
+// retryAfter formats wait for the Retry-After header, in whole seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
+
+// updateHost stores the addresses reported for the host identified by token
+// and runs the update methods of the host if any of them changed. Empty
+// addresses are left untouched. A LAN prefix, if reported, is stored and
+// the addresses of the LAN devices of the host are derived from it. Every
+// request with a valid token that passes the guards of the host is
+// recorded as a heartbeat, even for a domain the host does not serve,
+// changes are added to the address history with source.
+func (fh *FritzHandler) updateHost(ctx context.Context, r *http.Request, source, token, domain, ipaddr, ip6addr, lanPrefix string) (*Host, bool, error) {
 	tx, err := fh.DB.BeginTxx(ctx, nil)
 	if err != nil {
 		slog.ErrorContext(ctx, "BeginTxx", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, false, err
 	}
 	defer tx.Rollback()
-	err = tx.GetContext(ctx, &host, "select * FROM hosts WHERE token = ?", token)
+	h, ht, err := hostByToken(ctx, tx, token)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			http.NotFound(w, r)
-			return
+		if !errors.Is(err, errNoHost) {
+			slog.ErrorContext(ctx, "hostByToken", "err", err)
 		}
-		slog.ErrorContext(ctx, "GetContext", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, false, err
+	}
+	host := *h
+	err = recordSeen(ctx, tx, r, host.Id)
+	if err != nil {
+		slog.ErrorContext(ctx, "recordSeen", "err", err)
+		return &host, false, err
+	}
+	// reject keeps the heartbeat of a request that is refused.
+	reject := func(reason error) (*Host, bool, error) {
+		err := tx.Commit()
+		if err != nil {
+			slog.ErrorContext(ctx, "Commit", "err", err)
+			return &host, false, err
+		}
+		return &host, false, reason
+	}
+	if ht.Expires != nil {
+		slog.WarnContext(ctx, "host uses a rotated token", "host", host.Name, "expires", ht.Expires)
 	}
 	slog.DebugContext(ctx, "Updating", "host", host)
-	if domain != host.Domain {
+	served, err := servesDomain(ctx, tx, &host, domain)
+	if err != nil {
+		slog.ErrorContext(ctx, "servesDomain", "err", err)
+		return &host, false, err
+	}
+	if !served {
 		slog.ErrorContext(ctx, "domain does not match", "domain_request", domain, "domain_update", host.Domain)
-		http.Error(w, "Configured domain does not match", http.StatusForbidden)
-		return
+		return reject(errDomainMismatch)
+	}
+	ipaddr, ip6addr = resolveAuto(r, host.AutoAddr, ipaddr, ip6addr)
+	err = checkGuards(r, &host, ipaddr, ip6addr)
+	if err != nil {
+		// Possibly a stolen token, not a heartbeat.
+		return &host, false, err
+	}
+	ipaddr, ip6addr, warning, addrErr := checkAddrs(host.AddrPolicy, ipaddr, ip6addr)
+	var prefix netip.Prefix
+	if addrErr == nil && lanPrefix != "" {
+		var prefixWarning string
+		prefix, prefixWarning, addrErr = checkLanPrefix(host.AddrPolicy, lanPrefix)
+		if warning != "" && prefixWarning != "" {
+			warning += ", "
+		}
+		warning += prefixWarning
+	}
+	if addrErr != nil {
+		warning = addrErr.Error()
+	}
+	err = recordAddrWarning(ctx, tx, host.Id, warning)
+	if err != nil {
+		slog.ErrorContext(ctx, "recordAddrWarning", "err", err)
+		return &host, false, err
+	}
+	if addrErr != nil {
+		slog.WarnContext(ctx, "address rejected", "host", host.Name, "err", addrErr)
+		// Keep the heartbeat and the warning.
+		return reject(addrErr)
+	}
+	if warning != "" {
+		slog.WarnContext(ctx, "address ignored", "host", host.Name, "warning", warning)
 	}
 
+	old := host
 	modified := false
 	if ipaddr != "" && (host.Ip4addr == nil || ipaddr != *host.Ip4addr) {
 		modified = true
 		host.Ip4addr = &ipaddr
-		_, err = tx.ExecContext(ctx, "UPDATE hosts SET ip4addr = ? WHERE token = ?", host.Ip4addr, host.Token)
+		_, err = tx.ExecContext(ctx, "UPDATE hosts SET ip4addr = ? WHERE id = ?", host.Ip4addr, host.Id)
 	}
 	if err != nil {
 		slog.ErrorContext(ctx, "ExecContext", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return &host, false, err
 	}
 	if ip6addr != "" && (host.Ip6addr == nil || ip6addr != *host.Ip6addr) {
 		modified = true
 		host.Ip6addr = &ip6addr
-		_, err = tx.ExecContext(ctx, "UPDATE hosts SET ip6addr = ? WHERE token = ?", host.Ip6addr, host.Token)
+		_, err = tx.ExecContext(ctx, "UPDATE hosts SET ip6addr = ? WHERE id = ?", host.Ip6addr, host.Id)
 	}
 	if err != nil {
 		slog.ErrorContext(ctx, "ExecContext", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return &host, false, err
+	}
+	devicesChanged := false
+	if prefix.IsValid() {
+		devicesChanged, err = updateLanPrefix(ctx, tx, fh.Queue, &host, prefix)
+		if err != nil {
+			slog.ErrorContext(ctx, "updateLanPrefix", "err", err)
+			return &host, false, err
+		}
 	}
 	slog.DebugContext(ctx, "Updating", "host", host, "modified", modified)
 	if modified {
-		var data = make(map[string]any)
-		data["Req"] = r
-		data["Host"] = &host
-		var updates []Update
-		err = tx.SelectContext(ctx, &updates, "SELECT * FROM updates WHERE token = ?", host.Token)
+		err = recordIPChange(ctx, tx, &old, &host, source, remoteHost(r))
 		if err != nil {
-			slog.ErrorContext(ctx, "SelectContext", "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		for _, u := range updates {
-			data["Upd"] = &u
-			//slog.Debug("update", "data", data)
-			argTempl, err := template.New("args").Parse(u.Args)
-			if err != nil {
-				slog.ErrorContext(ctx, "template.New", "err", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			var argStr strings.Builder
-			err = argTempl.Execute(&argStr, data)
-			if err != nil {
-				slog.ErrorContext(ctx, "Execute", "err", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			switch u.Cmd {
-			case "GET":
-				req, err := http.NewRequestWithContext(ctx, "GET", argStr.String(), nil)
-				if err != nil {
-					slog.ErrorContext(ctx, "NewRequestWithContext", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				client := http.Client{}
-				res, err := client.Do(req)
-				if err != nil {
-					slog.ErrorContext(ctx, "Do", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				defer res.Body.Close()
-				if res.StatusCode/100 != 2 {
-					slog.ErrorContext(ctx, "Get", "status", res.Status, "code", res.StatusCode)
-					http.Error(w, res.Status, http.StatusInternalServerError)
-					return
-				}
-				buf, err := io.ReadAll(res.Body)
-				if err != nil {
-					slog.ErrorContext(ctx, "ReadAll", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				slog.InfoContext(ctx, "Get", "url", argStr.String(), "resp", string(buf))
-			case "cloudflare":
-				if u.ApiKey == nil {
-					slog.ErrorContext(ctx, "api_key not set")
-					continue
-				}
-				apiKey := os.Getenv(*u.ApiKey)
-				if len(apiKey) == 0 {
-					slog.ErrorContext(ctx, "api_key ENV variable not set")
-					continue
-				}
-				clfupdate := &cloudflare.Provider{APIToken: apiKey}
-				sub := libdns.RelativeName(host.Domain, host.Zone)
-				recs := []libdns.Record{
-					libdns.Address{
-						Name: sub,
-						IP:   netip.MustParseAddr(*host.Ip4addr),
-					},
-				}
-				if host.Ip6addr != nil {
-					recs = append(recs, libdns.Address{
-						Name: sub,
-						IP:   netip.MustParseAddr(*host.Ip6addr),
-					})
-				}
-				slog.DebugContext(ctx, "cloudflare SetRecords", "recs", recs)
-				newRecs, err := clfupdate.SetRecords(ctx, host.Zone, recs)
-				if err != nil {
-					slog.ErrorContext(ctx, "cloudflare SetRecords", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				slog.InfoContext(ctx, "SetRecords", "zone", argStr.String(), "newRecs", newRecs)
-			default:
-				cmdTempl, err := template.New("cmd").Parse(u.Cmd)
-				if err != nil {
-					slog.ErrorContext(ctx, "template.New", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				var cmdStr strings.Builder
-				err = cmdTempl.Execute(&cmdStr, data)
-				if err != nil {
-					slog.ErrorContext(ctx, "Execute", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				cmd := exec.Command("sh", "-c", cmdStr.String()+" \""+argStr.String()+"\"")
-				stdoutStderr, err := cmd.CombinedOutput()
-				if err != nil {
-					slog.ErrorContext(ctx, "cmd", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				slog.DebugContext(ctx, "exec", "cmd", cmdStr.String(), "args", argStr.String(), "outerr", string(stdoutStderr))
-			}
+			slog.ErrorContext(ctx, "recordIPChange", "err", err)
+			return &host, false, err
 		}
-		err = tx.Commit()
+		err = fh.Queue.Enqueue(ctx, tx, &old, r.Form)
 		if err != nil {
-			slog.ErrorContext(ctx, "Commit", "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			slog.ErrorContext(ctx, "Enqueue", "err", err)
+			return &host, false, err
 		}
-		fmt.Fprintf(w, "OK modified\n")
-	} else {
-		fmt.Fprintf(w, "OK\n")
 	}
+	err = tx.Commit()
+	if err != nil {
+		slog.ErrorContext(ctx, "Commit", "err", err)
+		return &host, false, err
+	}
+	if modified || devicesChanged {
+		fh.Queue.Notify()
+	}
+	return &host, modified, nil
 }
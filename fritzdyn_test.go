@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// testToken is the token of the hosts created by tests.
+const testToken = "test-token-0123456789"
+
+// openTestDB returns an empty sqlite database in a temporary directory.
+func openTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Connect("sqlite", filepath.Join(t.TempDir(), "fritzdyn.sqlite3")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestDB returns a migrated sqlite database in a temporary directory.
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db := openTestDB(t)
+	err := checkSchema(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestHandler returns a handler on a new test database without rate
+// limits.
+func newTestHandler(t *testing.T) *FritzHandler {
+	t.Helper()
+	db := newTestDB(t)
+	fh := &FritzHandler{DB: db, Queue: NewQueue(db), Limiter: NewLimiter()}
+	fh.Limiter.SourceLimit = 0
+	fh.Limiter.TokenLimit = 0
+	fh.Limiter.LockoutFailures = 0
+	return fh
+}
+
+// newTestHost creates a host with token and returns it.
+func newTestHost(t *testing.T, db *sqlx.DB, host Host, token string) *Host {
+	t.Helper()
+	if host.AddrPolicy == "" {
+		host.AddrPolicy = policyReject
+	}
+	_, err := insertHost(context.Background(), db, &host, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &host
+}
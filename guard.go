@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// errForbidden is returned for an update request with a valid token that
+// does not pass the guards of its host.
+var errForbidden = errors.New("request not allowed for the host")
+
+// Reasons a guard rejects a request, used for the logs and the metric.
+const (
+	guardSource     = "source"
+	guardMismatch   = "source_mismatch"
+	guardClientCert = "client_cert"
+)
+
+// setGuards checks the guard settings as entered and sets them on host.
+func setGuards(host *Host, sources string, requireSource bool, fingerprint string) error {
+	var err error
+	host.AllowedSources, err = parseAllowedSources(sources)
+	if err != nil {
+		return err
+	}
+	host.CertFingerprint, err = parseFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+	host.RequireSource = requireSource
+	return nil
+}
+
+// parseAllowedSources parses a list of CIDR prefixes or addresses
+// separated by commas or white space and returns it in canonical form.
+func parseAllowedSources(s string) (string, error) {
+	var list []string
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		prefix, err := parseSource(entry)
+		if err != nil {
+			return "", err
+		}
+		list = append(list, prefix.String())
+	}
+	return strings.Join(list, ","), nil
+}
+
+// parseSource parses a CIDR prefix, or an address standing for itself.
+func parseSource(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("allowed source %q is not a CIDR prefix", s)
+		}
+		if prefix.Addr().Is4In6() {
+			return netip.Prefix{}, fmt.Errorf("allowed source %s: use the IPv4 prefix", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("allowed source %q is not an address", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseFingerprint parses the hex SHA-256 fingerprint of a certificate,
+// bytes may be separated by colons. It returns nil for an empty string.
+func parseFingerprint(s string) (*string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("certificate fingerprint %q is not a hex SHA-256 hash", s)
+	}
+	fp := hex.EncodeToString(b)
+	return &fp, nil
+}
+
+// clientCertFingerprint returns the SHA-256 fingerprint of the client
+// certificate of r. It is taken from the TLS connection if the server
+// terminates TLS itself, otherwise from the CLIENT_CERT_HEADER header set
+// by a trusted proxy, holding either the fingerprint or the certificate in
+// PEM form, possibly URL encoded. It reports false if there is none.
+func clientCertFingerprint(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		return hex.EncodeToString(sum[:]), true
+	}
+	name := os.Getenv("CLIENT_CERT_HEADER")
+	if name == "" || !fromTrustedProxy(r) {
+		return "", false
+	}
+	value := r.Header.Get(name)
+	if value == "" {
+		return "", false
+	}
+	if fp, err := parseFingerprint(value); err == nil {
+		return *fp, true
+	}
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		value = unescaped
+	}
+	block, _ := pem.Decode([]byte(value))
+	if block == nil || block.Type != "CERTIFICATE" {
+		slog.WarnContext(r.Context(), "client certificate header does not parse", "header", name)
+		return "", false
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// checkGuards makes sure r may update host: it must come from one of the
+// allowed sources of the host, report the source address of the request
+// if the host requires it and present the client certificate bound to the
+// host. ipaddr and ip6addr are the addresses reported. Rejections are
+// logged and counted, the error wraps errForbidden.
+func checkGuards(r *http.Request, host *Host, ipaddr, ip6addr string) error {
+	reason, msg := guardReject(r, host, ipaddr, ip6addr)
+	if reason == "" {
+		return nil
+	}
+	slog.WarnContext(r.Context(), "update rejected", "host", host.Name, "reason", reason, "detail", msg, "remote", remoteHost(r))
+	guardRejections.Add(r.Context(), 1, metric.WithAttributes(attribute.String("host", host.Name), attribute.String("reason", reason)))
+	return fmt.Errorf("%w: %s", errForbidden, msg)
+}
+
+// guardReject returns why r may not update host, empty if it may.
+func guardReject(r *http.Request, host *Host, ipaddr, ip6addr string) (string, string) {
+	if host.AllowedSources != "" || host.RequireSource {
+		source, ok := clientAddr(r)
+		if !ok {
+			return guardSource, "no source address"
+		}
+		if host.AllowedSources != "" && !allowedSource(host.AllowedSources, source) {
+			return guardSource, fmt.Sprintf("source %s is not allowed", source)
+		}
+		if host.RequireSource {
+			reported := ipaddr
+			if source.Is6() {
+				reported = ip6addr
+			}
+			addr, err := netip.ParseAddr(reported)
+			if err != nil || addr.Unmap() != source.WithZone("") {
+				return guardMismatch, fmt.Sprintf("reported address %q is not the source %s", reported, source)
+			}
+		}
+	}
+	if host.CertFingerprint != nil {
+		fp, ok := clientCertFingerprint(r)
+		if !ok {
+			return guardClientCert, "no client certificate"
+		}
+		if subtle.ConstantTimeCompare([]byte(fp), []byte(*host.CertFingerprint)) != 1 {
+			return guardClientCert, fmt.Sprintf("client certificate %s is not the one of the host", fp)
+		}
+	}
+	return "", ""
+}
+
+// allowedSource reports whether addr is in one of the prefixes of the
+// canonical list sources.
+func allowedSource(sources string, addr netip.Addr) bool {
+	for _, s := range strings.Split(sources, ",") {
+		prefix, err := netip.ParsePrefix(s)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowedSources(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"", "", ""},
+		{"192.0.2.1", "192.0.2.1/32", ""},
+		{"192.0.2.7/24, 2001:db8::1/48\n::ffff:198.51.100.1", "192.0.2.0/24,2001:db8::/48,198.51.100.1/32", ""},
+		{"192.0.2.0/33", "", "not a CIDR prefix"},
+		{"::ffff:192.0.2.0/120", "", "use the IPv4 prefix"},
+		{"fe80::1%eth0", "", "not an address"},
+		{"example.org", "", "not an address"},
+	} {
+		got, err := parseAllowedSources(tc.in)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%q: got error %v, want %q", tc.in, err, tc.wantErr)
+			}
+		} else if err != nil || got != tc.want {
+			t.Errorf("%q: got %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	fp := strings.Repeat("ab", sha256.Size)
+	for _, tc := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{fp, fp, true},
+		{strings.ToUpper(fp), fp, true},
+		{strings.TrimSuffix(strings.Repeat("AB:", sha256.Size), ":"), fp, true},
+		{fp[2:], "", false},
+		{"zz" + fp[2:], "", false},
+	} {
+		got, err := parseFingerprint(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: got error %v", tc.in, err)
+			continue
+		}
+		if s := deref(got); s != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.in, s, tc.want)
+		}
+	}
+}
+
+func TestCheckGuards(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.1")
+	t.Setenv("CLIENT_CERT_HEADER", "X-Client-Cert")
+	cert := []byte("test certificate")
+	sum := sha256.Sum256(cert)
+	fp := hex.EncodeToString(sum[:])
+	other := strings.Repeat("00", sha256.Size)
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	for _, tc := range []struct {
+		name    string
+		host    Host
+		remote  string
+		headers map[string]string
+		tlsCert bool
+		ip, ip6 string
+		wantErr bool
+	}{
+		{name: "no guards", remote: "8.8.8.8:1"},
+		{name: "allowed source", host: Host{AllowedSources: "8.8.8.0/24,2001:4860::/32"}, remote: "8.8.8.8:1"},
+		{name: "allowed IPv6 source", host: Host{AllowedSources: "8.8.8.0/24,2001:4860::/32"}, remote: "[2001:4860::1]:1"},
+		{name: "source not allowed", host: Host{AllowedSources: "8.8.8.0/24"}, remote: "8.8.4.4:1", wantErr: true},
+		{name: "allowed source behind proxy", host: Host{AllowedSources: "8.8.8.0/24"}, remote: "10.0.0.1:1",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}},
+		{name: "forwarded header of untrusted peer", host: Host{AllowedSources: "8.8.8.0/24"}, remote: "8.8.4.4:1",
+			headers: map[string]string{"X-Forwarded-For": "8.8.8.8"}, wantErr: true},
+		{name: "no source address", host: Host{AllowedSources: "8.8.8.0/24"}, remote: "10.0.0.1:1",
+			headers: map[string]string{"Forwarded": "for=unknown"}, wantErr: true},
+		{name: "source reported", host: Host{RequireSource: true}, remote: "8.8.8.8:1", ip: "8.8.8.8"},
+		{name: "IPv6 source reported", host: Host{RequireSource: true}, remote: "[2001:4860::1]:1", ip: "8.8.4.4", ip6: "2001:4860::1"},
+		{name: "source mismatch", host: Host{RequireSource: true}, remote: "8.8.8.8:1", ip: "8.8.4.4", wantErr: true},
+		{name: "source missing", host: Host{RequireSource: true}, remote: "[2001:4860::1]:1", ip: "8.8.8.8", wantErr: true},
+		{name: "TLS client certificate", host: Host{CertFingerprint: &fp}, remote: "8.8.8.8:1", tlsCert: true},
+		{name: "wrong TLS client certificate", host: Host{CertFingerprint: &other}, remote: "8.8.8.8:1", tlsCert: true, wantErr: true},
+		{name: "no client certificate", host: Host{CertFingerprint: &fp}, remote: "8.8.8.8:1", wantErr: true},
+		{name: "fingerprint header", host: Host{CertFingerprint: &fp}, remote: "10.0.0.1:1",
+			headers: map[string]string{"X-Client-Cert": strings.ToUpper(fp)}},
+		{name: "URL encoded PEM header", host: Host{CertFingerprint: &fp}, remote: "10.0.0.1:1",
+			headers: map[string]string{"X-Client-Cert": url.QueryEscape(certPEM)}},
+		{name: "garbage header", host: Host{CertFingerprint: &fp}, remote: "10.0.0.1:1",
+			headers: map[string]string{"X-Client-Cert": "garbage"}, wantErr: true},
+		{name: "header of untrusted peer", host: Host{CertFingerprint: &fp}, remote: "8.8.8.8:1",
+			headers: map[string]string{"X-Client-Cert": fp}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			if tc.tlsCert {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: cert}}}
+			}
+			tc.host.Name = "home"
+			err := checkGuards(r, &tc.host, tc.ip, tc.ip6)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, errForbidden) {
+				t.Errorf("got error %v, want errForbidden", err)
+			}
+		})
+	}
+}
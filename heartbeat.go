@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HostSeen records the last request of a host.
+type HostSeen struct {
+	HostId     int64      `db:"host_id"`
+	LastSeen   *time.Time `db:"last_seen"`
+	RemoteAddr string     `db:"remote_addr"`
+	UserAgent  string     `db:"user_agent"`
+	// StaleSince is set while the host is overdue and has been reported
+	// as such.
+	StaleSince *time.Time `db:"stale_since"`
+	// AddrWarning describes the addresses of the last request that were
+	// rejected or ignored by the address policy of the host.
+	AddrWarning *string `db:"addr_warning"`
+}
+
+// HostStatus is a host together with its last check-in.
+type HostStatus struct {
+	Host
+	Seen HostSeen
+}
+
+// Overdue reports whether the host missed its check-in interval. Hosts that
+// never reported in count from the time they were created.
+func (s HostStatus) Overdue() bool {
+	if s.CheckinInterval == nil {
+		return false
+	}
+	last := s.Created
+	if s.Seen.LastSeen != nil {
+		last = *s.Seen.LastSeen
+	}
+	return time.Since(last) > time.Duration(*s.CheckinInterval)*time.Second
+}
+
+// CheckinDuration returns the check-in interval of the host as a duration
+// string, or "" if the host is not monitored.
+func (h Host) CheckinDuration() string {
+	if h.CheckinInterval == nil {
+		return ""
+	}
+	return (time.Duration(*h.CheckinInterval) * time.Second).String()
+}
+
+// parseCheckinInterval parses a check-in interval as entered in the admin
+// interface, e.g. "30m". An empty string disables monitoring.
+func parseCheckinInterval(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, err
+	}
+	if d < time.Minute {
+		return nil, fmt.Errorf("check-in interval %s is shorter than a minute", d)
+	}
+	secs := int64(d / time.Second)
+	return &secs, nil
+}
+
+// recordSeen stores the time, remote address and User-Agent of r as the
+// last check-in of the host with id.
+func recordSeen(ctx context.Context, tx *sqlx.Tx, r *http.Request, id int64) error {
+	agent := r.UserAgent()
+	if len(agent) > 255 {
+		agent = agent[:255]
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO host_seen (host_id, last_seen, remote_addr, user_agent) VALUES (?, ?, ?, ?)
+		ON CONFLICT (host_id) DO UPDATE SET last_seen = excluded.last_seen,
+			remote_addr = excluded.remote_addr, user_agent = excluded.user_agent`,
+		id, time.Now().UTC(), remoteHost(r), agent)
+	return err
+}
+
+// recordAddrWarning stores the address warning of the last request of the
+// host with id, an empty warning clears it. recordSeen must have been
+// called for the request.
+func recordAddrWarning(ctx context.Context, tx *sqlx.Tx, id int64, warning string) error {
+	if len(warning) > 255 {
+		warning = warning[:255]
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE host_seen SET addr_warning = ? WHERE host_id = ?", optional(warning), id)
+	return err
+}
+
+// hostStatuses returns all hosts, newest first, with their last check-in.
+func hostStatuses(ctx context.Context, db *sqlx.DB) ([]HostStatus, error) {
+	var hosts []Host
+	err := db.SelectContext(ctx, &hosts, "SELECT * FROM hosts ORDER BY created DESC")
+	if err != nil {
+		return nil, err
+	}
+	var seen []HostSeen
+	err = db.SelectContext(ctx, &seen, "SELECT * FROM host_seen")
+	if err != nil {
+		return nil, err
+	}
+	seenByHost := make(map[int64]HostSeen)
+	for _, s := range seen {
+		seenByHost[s.HostId] = s
+	}
+	statuses := make([]HostStatus, len(hosts))
+	for i, host := range hosts {
+		statuses[i] = HostStatus{Host: host, Seen: seenByHost[host.Id]}
+	}
+	return statuses, nil
+}
+
+// checkStale notifies about hosts that became overdue and about stale
+// hosts that reported in again.
+func checkStale(ctx context.Context, db *sqlx.DB) error {
+	statuses, err := hostStatuses(ctx, db)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, s := range statuses {
+		overdue := s.Overdue()
+		event := Event{Host: s.Name, Domain: s.Domain, Time: now}
+		switch {
+		case overdue && s.Seen.StaleSince == nil:
+			_, err = db.ExecContext(ctx, `INSERT INTO host_seen (host_id, stale_since) VALUES (?, ?)
+				ON CONFLICT (host_id) DO UPDATE SET stale_since = excluded.stale_since`, s.Id, now)
+			event.Kind = "stale"
+			event.Message = fmt.Sprintf("%s has not checked in for more than %s", s.Name, s.CheckinDuration())
+			if s.Seen.LastSeen != nil {
+				event.Message += ", last seen " + s.Seen.LastSeen.Format(time.RFC3339) + " from " + s.Seen.RemoteAddr
+			}
+		case !overdue && s.Seen.StaleSince != nil:
+			_, err = db.ExecContext(ctx, "UPDATE host_seen SET stale_since = NULL WHERE host_id = ?", s.Id)
+			event.Kind = "recovered"
+			event.Message = fmt.Sprintf("%s is no longer overdue, stale since %s", s.Name, s.Seen.StaleSince.Format(time.RFC3339))
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		notify(ctx, event)
+	}
+	return nil
+}
+
+// runStaleChecks calls checkStale every STALE_CHECK_INTERVAL (default 1m)
+// until ctx is cancelled.
+func runStaleChecks(ctx context.Context, db *sqlx.DB) {
+	interval := time.Minute
+	if d, err := time.ParseDuration(os.Getenv("STALE_CHECK_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := checkStale(ctx, db)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "checkStale", "err", err)
+			}
+		}
+	}
+}
+
+// serveHostHealth answers with the check-in state of the monitored hosts as
+// JSON. The status is 503 if any of them is overdue, so that it can be used
+// by an uptime monitor. The hosts are only listed for requests with an
+// API key with the read scope, others just get the status.
+func (fh *FritzHandler) serveHostHealth(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key, err := requestAPIKey(r, fh.DB)
+	if err != nil {
+		slog.ErrorContext(ctx, "requestAPIKey", "err", err)
+	}
+	detailed := key != nil && key.HasScope(scopeRead)
+	statuses, err := hostStatuses(ctx, fh.DB)
+	if err != nil {
+		slog.ErrorContext(ctx, "hostStatuses", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	type hostHealth struct {
+		Name            string     `json:"name"`
+		Domain          string     `json:"domain"`
+		CheckinInterval string     `json:"checkin_interval"`
+		LastSeen        *time.Time `json:"last_seen"`
+		Overdue         bool       `json:"overdue"`
+		StaleSince      *time.Time `json:"stale_since,omitempty"`
+	}
+	result := struct {
+		Status string       `json:"status"`
+		Hosts  []hostHealth `json:"hosts,omitempty"`
+	}{Status: "up"}
+	for _, s := range statuses {
+		if s.CheckinInterval == nil {
+			continue
+		}
+		overdue := s.Overdue()
+		if overdue {
+			result.Status = "down"
+		}
+		if !detailed {
+			continue
+		}
+		result.Hosts = append(result.Hosts, hostHealth{
+			Name:            s.Name,
+			Domain:          s.Domain,
+			CheckinInterval: s.CheckinDuration(),
+			LastSeen:        s.Seen.LastSeen,
+			Overdue:         overdue,
+			StaleSince:      s.Seen.StaleSince,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "up" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHostHealth(t *testing.T) {
+	ctx := context.Background()
+	fh := newTestHandler(t)
+	hour := int64(3600)
+	office := newTestHost(t, fh.DB, Host{Name: "office", Domain: "office.example.org", Zone: "example.org", CheckinInterval: &hour}, "")
+	home := newTestHost(t, fh.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org", CheckinInterval: &hour}, "")
+	newTestHost(t, fh.DB, Host{Name: "lab", Domain: "lab.example.org", Zone: "example.org"}, "")
+	_, err := fh.DB.ExecContext(ctx, "INSERT INTO host_seen (host_id, last_seen, remote_addr) VALUES (?, ?, '192.0.2.1'), (?, ?, '192.0.2.2')",
+		office.Id, time.Now().UTC().Add(-2*time.Hour), home.Id, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, reader, err := createAPIKey(ctx, fh.DB, "monitor", scopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		auth      string
+		wantHosts []string
+	}{
+		{name: "no credentials"},
+		{name: "invalid key", auth: "Bearer fdk_invalid"},
+		{name: "host token", auth: "Bearer " + testToken},
+		{name: "read key", auth: "Bearer " + reader, wantHosts: []string{"home", "office"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/health/hosts", nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			fh.ServeHTTP(w, r)
+			var got struct {
+				Status string
+				Hosts  []struct {
+					Name    string
+					Overdue bool
+				}
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusServiceUnavailable || got.Status != "down" {
+				t.Errorf("got %d %q, want 503 down", w.Code, got.Status)
+			}
+			var names []string
+			for _, h := range got.Hosts {
+				names = append(names, h.Name)
+				if h.Overdue != (h.Name == "office") {
+					t.Errorf("%s: got overdue %v", h.Name, h.Overdue)
+				}
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tc.wantHosts) {
+				t.Errorf("got hosts %q, want %q", names, tc.wantHosts)
+			}
+		})
+	}
+}
+
+func TestHeartbeatOnDomainMismatch(t *testing.T) {
+	ctx := context.Background()
+	fh := newTestHandler(t)
+	host := newTestHost(t, fh.DB, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	r := httptest.NewRequest(http.MethodGet, "/?token="+testToken, nil)
+	r.Header.Set("User-Agent", "Fritz!Box")
+	_, _, err := fh.updateHost(ctx, r, "test", testToken, "other.example.org", "192.0.2.1", "", "")
+	if !errors.Is(err, errDomainMismatch) {
+		t.Fatalf("got %v, want errDomainMismatch", err)
+	}
+	var seen HostSeen
+	err = fh.DB.GetContext(ctx, &seen, "SELECT * FROM host_seen WHERE host_id = ?", host.Id)
+	if err != nil || seen.LastSeen == nil || seen.UserAgent != "Fritz!Box" {
+		t.Errorf("got heartbeat %+v, %v, want the request recorded", seen, err)
+	}
+	var ip4addr *string
+	fh.DB.GetContext(ctx, &ip4addr, "SELECT ip4addr FROM hosts WHERE id = ?", host.Id)
+	if ip4addr != nil {
+		t.Errorf("got address %s stored for the wrong domain", *ip4addr)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Sources of an address change.
+const (
+	sourceFritzBox = "fritzbox"
+	sourceDynDNS2  = "dyndns2"
+	sourceAdmin    = "admin"
+	sourceAPI      = "api"
+)
+
+// IPChange is an entry in the address history of a host.
+type IPChange struct {
+	Id         int64     `json:"-"`
+	HostId     int64     `db:"host_id" json:"-"`
+	OldIp4addr *string   `db:"old_ip4addr" json:"old_ip4addr"`
+	Ip4addr    *string   `json:"ip4addr"`
+	OldIp6addr *string   `db:"old_ip6addr" json:"old_ip6addr"`
+	Ip6addr    *string   `json:"ip6addr"`
+	Source     string    `json:"source"`
+	RemoteAddr string    `db:"remote_addr" json:"remote_addr"`
+	Changed    time.Time `json:"changed"`
+}
+
+// Ip4Changed reports whether the IPv4 address changed.
+func (c IPChange) Ip4Changed() bool {
+	return !equalAddr(c.OldIp4addr, c.Ip4addr)
+}
+
+// Ip6Changed reports whether the IPv6 address changed.
+func (c IPChange) Ip6Changed() bool {
+	return !equalAddr(c.OldIp6addr, c.Ip6addr)
+}
+
+// saveHost stores the settings and addresses of host, e.g. as edited in the
+// admin interface, and records a change of its addresses in the history.
+// It returns sql.ErrNoRows if there is no such host.
+func saveHost(ctx context.Context, db *sqlx.DB, host *Host, source, remote string) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var old Host
+	err = tx.GetContext(ctx, &old, "SELECT * FROM hosts WHERE id = ?", host.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE hosts SET name=?, domain=?, zone=?, ip4addr=?, ip6addr=?, checkin_interval=?, auto_addr=?, addr_policy=?,
+		allowed_sources=?, require_source=?, cert_fingerprint=? WHERE id=?`,
+		host.Name, host.Domain, host.Zone, host.Ip4addr, host.Ip6addr, host.CheckinInterval, host.AutoAddr, host.AddrPolicy,
+		host.AllowedSources, host.RequireSource, host.CertFingerprint, host.Id)
+	if err != nil {
+		return err
+	}
+	err = recordIPChange(ctx, tx, &old, host, source, remote)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordIPChange adds an entry to the address history if the addresses of
+// host differ from old. It is called in the transaction that updates the
+// hosts row.
+func recordIPChange(ctx context.Context, tx *sqlx.Tx, old, host *Host, source, remote string) error {
+	if equalAddr(old.Ip4addr, host.Ip4addr) && equalAddr(old.Ip6addr, host.Ip6addr) {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO ip_history (host_id, old_ip4addr, ip4addr, old_ip6addr, ip6addr, source, remote_addr, changed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		host.Id, old.Ip4addr, host.Ip4addr, old.Ip6addr, host.Ip6addr, source, remote, time.Now().UTC())
+	return err
+}
+
+// ipHistory returns up to limit entries of the address history of the host
+// with id, newest first, skipping the first offset. A limit below zero
+// returns all.
+func ipHistory(ctx context.Context, db *sqlx.DB, id int64, limit, offset int) ([]IPChange, error) {
+	var changes []IPChange
+	err := db.SelectContext(ctx, &changes, "SELECT * FROM ip_history WHERE host_id = ? ORDER BY id DESC LIMIT ? OFFSET ?",
+		id, limit, offset)
+	return changes, err
+}
+
+// optional returns nil for an empty s.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func equalAddr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// remoteHost returns the address of the client of r without the port,
+// behind a trusted proxy the address it forwarded.
+func remoteHost(r *http.Request) string {
+	if addr, ok := clientAddr(r); ok {
+		return addr.String()
+	}
+	return splitHost(r.RemoteAddr)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestHistory creates a host whose IPv4 address changed n times, from
+// 192.0.2.0 to 192.0.2.n, and a host without history. It returns both.
+func newTestHistory(t *testing.T, h *AdminHandler, n int) (*Host, *Host) {
+	t.Helper()
+	ctx := context.Background()
+	host := newTestHost(t, h.DB, Host{Name: "home, sweet", Domain: "home.example.org", Zone: "example.org",
+		Ip4addr: optional("192.0.2.0")}, testToken)
+	for i := 1; i <= n; i++ {
+		host.Ip4addr = optional(fmt.Sprintf("192.0.2.%d", i))
+		if err := saveHost(ctx, h.DB, host, sourceAdmin, "198.51.100.1"); err != nil {
+			t.Fatal(err)
+		}
+		// Saving without a change adds nothing.
+		if err := saveHost(ctx, h.DB, host, sourceAdmin, "198.51.100.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	empty := newTestHost(t, h.DB, Host{Name: "empty", Domain: "empty.example.org", Zone: "example.org"}, "")
+	return host, empty
+}
+
+func TestIPHistory(t *testing.T) {
+	ctx := context.Background()
+	h := newTestAdmin(t)
+	host, empty := newTestHistory(t, h, 5)
+	for _, tc := range []struct {
+		limit, offset int
+		want          []string
+	}{
+		{-1, 0, []string{"192.0.2.5", "192.0.2.4", "192.0.2.3", "192.0.2.2", "192.0.2.1"}},
+		{2, 0, []string{"192.0.2.5", "192.0.2.4"}},
+		{2, 2, []string{"192.0.2.3", "192.0.2.2"}},
+		{2, 4, []string{"192.0.2.1"}},
+		{2, 6, nil},
+	} {
+		history, err := ipHistory(ctx, h.DB, host.Id, tc.limit, tc.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range history {
+			got = append(got, deref(c.Ip4addr))
+			if !c.Ip4Changed() || c.Ip6Changed() || c.Source != sourceAdmin || c.RemoteAddr != "198.51.100.1" {
+				t.Errorf("limit %d offset %d: got change %+v", tc.limit, tc.offset, c)
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("limit %d offset %d: got %q, want %q", tc.limit, tc.offset, got, tc.want)
+		}
+	}
+	if history, err := ipHistory(ctx, h.DB, empty.Id, -1, 0); err != nil || len(history) != 0 {
+		t.Errorf("got %d changes, %v for the host without history, want none", len(history), err)
+	}
+}
+
+func TestHostHistoryExport(t *testing.T) {
+	h := newTestAdmin(t)
+	host, empty := newTestHistory(t, h, 3)
+	target := fmt.Sprintf("/admin/host/%d/history", host.Id)
+
+	w := serveAdmin(h, http.MethodGet, target+".csv", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("got %d %s, want CSV", w.Code, w.Header().Get("Content-Type"))
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="home, sweet-history.csv"` {
+		t.Errorf("got Content-Disposition %s", cd)
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || strings.Join(rows[0], ",") != "changed,old_ip4addr,ip4addr,old_ip6addr,ip6addr,source,remote_addr" {
+		t.Fatalf("got rows %q, want a header and 3 changes", rows)
+	}
+	if got := strings.Join(rows[1][1:], ","); got != "192.0.2.2,192.0.2.3,,,admin,198.51.100.1" {
+		t.Errorf("got newest change %s", got)
+	}
+
+	w = serveAdmin(h, http.MethodGet, target+".json", nil)
+	var changes []IPChange
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || len(changes) != 3 ||
+		deref(changes[2].OldIp4addr) != "192.0.2.0" || deref(changes[2].Ip4addr) != "192.0.2.1" {
+		t.Errorf("got %s %+v, want 3 changes as JSON", w.Header().Get("Content-Type"), changes)
+	}
+
+	w = serveAdmin(h, http.MethodGet, fmt.Sprintf("/admin/host/%d/history.json", empty.Id), nil)
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("got %s for the host without history, want []", got)
+	}
+	if w = serveAdmin(h, http.MethodGet, "/admin/host/999/history.csv", nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown host, want 404", w.Code)
+	}
+}
+
+func TestHostHistoryPages(t *testing.T) {
+	h := newTestAdmin(t)
+	host, _ := newTestHistory(t, h, historyPageSize+1)
+	for _, tc := range []struct {
+		page      int
+		want, not string
+		wantOlder bool
+	}{
+		{page: 1, want: "<strong>192.0.2.2</strong>", not: "<strong>192.0.2.1</strong>", wantOlder: true},
+		{page: 2, want: "<strong>192.0.2.1</strong>", not: "<strong>192.0.2.2</strong>"},
+	} {
+		w := serveAdmin(h, http.MethodGet, fmt.Sprintf("/admin/host/%d?page=%d", host.Id, tc.page), nil)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, tc.want) || strings.Contains(body, tc.not) {
+			t.Errorf("page %d: got %d, want %s and not %s", tc.page, w.Code, tc.want, tc.not)
+		}
+		older := strings.Contains(body, fmt.Sprintf(`<li class="page-item "><a class="page-link" href="?page=%d#history">Older</a>`, tc.page+1))
+		if older != tc.wantOlder || !strings.Contains(body, fmt.Sprintf("Page %d", tc.page)) {
+			t.Errorf("page %d: got older link %v, want %v", tc.page, older, tc.wantOlder)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// minTokenLength is the length a token chosen by hand must have at least.
+const minTokenLength = 16
+
+var (
+	errTokenInUse    = errors.New("token is in use")
+	errTokenTooShort = fmt.Errorf("token must have at least %d characters", minTokenLength)
+)
+
+// HostToken is a token a host authenticates with. Only its hash is stored,
+// the token itself is shown once when it is created.
+type HostToken struct {
+	Id        int64
+	HostId    int64  `db:"host_id"`
+	TokenHash string `db:"token_hash"`
+	// Expires is set on a token that was replaced by a rotation, it keeps
+	// working until then.
+	Expires *time.Time
+	Created time.Time
+}
+
+// tokenGracePeriod returns how long the old token of a host keeps working
+// after a rotation, TOKEN_GRACE_PERIOD or 7 days by default.
+func tokenGracePeriod() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("TOKEN_GRACE_PERIOD")); err == nil && d >= 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+// newToken returns a random token of 32 bytes, base64url encoded.
+func newToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// hostByToken returns the host token belongs to together with the matching
+// token row. Tokens past their grace period do not match.
+func hostByToken(ctx context.Context, q sqlx.QueryerContext, token string) (*Host, *HostToken, error) {
+	var ht HostToken
+	err := sqlx.GetContext(ctx, q, &ht, "SELECT * FROM host_tokens WHERE token_hash = ? AND (expires IS NULL OR expires > ?)",
+		hashToken(token), time.Now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, errNoHost
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var host Host
+	err = sqlx.GetContext(ctx, q, &host, "SELECT * FROM hosts WHERE id = ?", ht.HostId)
+	if errors.Is(err, sql.ErrNoRows) {
+		// A token left behind by a deleted host.
+		return nil, nil, errNoHost
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &host, &ht, nil
+}
+
+// hostTokens returns the tokens of the host with id, the current one first.
+func hostTokens(ctx context.Context, db *sqlx.DB, id int64) ([]HostToken, error) {
+	var tokens []HostToken
+	err := db.SelectContext(ctx, &tokens, `SELECT * FROM host_tokens WHERE host_id = ? AND (expires IS NULL OR expires > ?)
+		ORDER BY expires IS NOT NULL, expires DESC`, id, time.Now().UTC())
+	return tokens, err
+}
+
+// addHostToken stores token, or a new one if it is empty, as the current
+// token of the host with id and returns it.
+func addHostToken(ctx context.Context, tx *sqlx.Tx, id int64, token string) (string, error) {
+	if token == "" {
+		token = newToken()
+	} else if len(token) < minTokenLength {
+		return "", errTokenTooShort
+	}
+	var exists bool
+	err := tx.GetContext(ctx, &exists, "SELECT COUNT(*) > 0 FROM host_tokens WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", errTokenInUse
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO host_tokens (host_id, token_hash) VALUES (?, ?)", id, hashToken(token))
+	return token, err
+}
+
+// insertHost creates host with token, or a new random token if it is
+// empty, fills in the columns set by the database and returns the token.
+func insertHost(ctx context.Context, db *sqlx.DB, host *Host, token string) (string, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	err = tx.GetContext(ctx, host, `INSERT INTO hosts (name, domain, zone, ip4addr, ip6addr, checkin_interval, auto_addr, addr_policy,
+			allowed_sources, require_source, cert_fingerprint)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING *`,
+		host.Name, host.Domain, host.Zone, host.Ip4addr, host.Ip6addr, host.CheckinInterval, host.AutoAddr, host.AddrPolicy,
+		host.AllowedSources, host.RequireSource, host.CertFingerprint)
+	if err != nil {
+		return "", err
+	}
+	token, err = addHostToken(ctx, tx, host.Id, token)
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// deleteHost removes the host with id and everything that belongs to it.
+// Foreign keys are not enforced by every driver, so this does not rely on
+// them cascading: a token left behind would authenticate as the next host
+// created. It reports whether there was such a host.
+func deleteHost(ctx context.Context, db *sqlx.DB, id int64) (bool, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"DELETE FROM host_tokens WHERE host_id = ?",
+		"DELETE FROM jobs WHERE host_id = ?",
+		"DELETE FROM update_runs WHERE host_id = ?",
+		"DELETE FROM updates WHERE host_id = ?",
+		"DELETE FROM host_records WHERE host_id = ?",
+		"DELETE FROM lan_devices WHERE host_id = ?",
+		"DELETE FROM host_drift WHERE host_id = ?",
+		"DELETE FROM host_seen WHERE host_id = ?",
+		"DELETE FROM ip_history WHERE host_id = ?",
+	} {
+		_, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM hosts WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// rotateHostToken gives the host with id a new token and returns it. The
+// current token keeps working for grace, so that the router can be
+// reconfigured, tokens from earlier rotations are dropped.
+func rotateHostToken(ctx context.Context, db *sqlx.DB, id int64, grace time.Duration) (string, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var exists bool
+	err = tx.GetContext(ctx, &exists, "SELECT COUNT(*) > 0 FROM hosts WHERE id = ?", id)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errNoHost
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM host_tokens WHERE host_id = ? AND expires IS NOT NULL", id)
+	if err != nil {
+		return "", err
+	}
+	if grace > 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE host_tokens SET expires = ? WHERE host_id = ?", time.Now().UTC().Add(grace), id)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM host_tokens WHERE host_id = ?", id)
+	}
+	if err != nil {
+		return "", err
+	}
+	token, err := addHostToken(ctx, tx, id, "")
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// hashHostTokens replaces the plaintext tokens migration 11 moved into
+// host_tokens with their hashes.
+func hashHostTokens(ctx context.Context, tx *sqlx.Tx) error {
+	var tokens []HostToken
+	err := tx.SelectContext(ctx, &tokens, "SELECT * FROM host_tokens")
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		_, err = tx.ExecContext(ctx, "UPDATE host_tokens SET token_hash = ? WHERE id = ?", hashToken(t.TokenHash), t.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactURL returns u as a string with a token in the query replaced, for
+// logging.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if !q.Has("token") {
+		return u.String()
+	}
+	q.Set("token", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.String()
+}
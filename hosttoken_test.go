@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHostByToken(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	home := newTestHost(t, db, Host{Name: "home", Domain: "home.example.org"}, testToken)
+	office := newTestHost(t, db, Host{Name: "office", Domain: "office.example.org"}, "office-token-0123456789")
+	rotated, err := rotateHostToken(ctx, db, office.Id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lab := newTestHost(t, db, Host{Name: "lab", Domain: "lab.example.org"}, "lab-token-0123456789")
+	if _, err := rotateHostToken(ctx, db, lab.Id, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotateHostToken(ctx, db, 999, 0); !errors.Is(err, errNoHost) {
+		t.Errorf("got %v rotating the token of no host, want errNoHost", err)
+	}
+	// Leave the token of a deleted host behind, as older versions did.
+	_, err = db.ExecContext(ctx, "INSERT INTO host_tokens (host_id, token_hash) VALUES (999, ?)", hashToken("orphaned-token-0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO host_tokens (host_id, token_hash, expires) VALUES (?, ?, ?)",
+		home.Id, hashToken("expired-token-0123456789"), time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		token    string
+		wantHost string
+	}{
+		{name: "current token", token: testToken, wantHost: "home"},
+		{name: "rotated token", token: rotated, wantHost: "office"},
+		{name: "token in its grace period", token: "office-token-0123456789", wantHost: "office"},
+		{name: "token rotated without grace period", token: "lab-token-0123456789"},
+		{name: "expired token", token: "expired-token-0123456789"},
+		{name: "token of a deleted host", token: "orphaned-token-0123456789"},
+		{name: "unknown token", token: "unknown-token-0123456789"},
+		{name: "hash instead of the token", token: hashToken(testToken)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, _, err := hostByToken(ctx, db, tc.token)
+			if tc.wantHost == "" {
+				if !errors.Is(err, errNoHost) {
+					t.Errorf("got %v, %v, want errNoHost", host, err)
+				}
+				return
+			}
+			if err != nil || host.Name != tc.wantHost {
+				t.Errorf("got %v, %v, want host %s", host, err, tc.wantHost)
+			}
+		})
+	}
+}
+
+func TestAddHostToken(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	newTestHost(t, db, Host{Name: "home", Domain: "home.example.org"}, testToken)
+	for _, tc := range []struct {
+		token   string
+		wantErr error
+	}{
+		{"", nil},
+		{"another-token-0123456789", nil},
+		{"short", errTokenTooShort},
+		{testToken, errTokenInUse},
+	} {
+		host := Host{Name: "other", Domain: "other.example.org", AddrPolicy: policyReject}
+		token, err := insertHost(ctx, db, &host, tc.token)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%q: got error %v, want %v", tc.token, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (len(token) < minTokenLength || tc.token != "" && token != tc.token) {
+			t.Errorf("%q: got token %q", tc.token, token)
+		}
+	}
+}
+
+func TestDeleteHost(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	home := newTestHost(t, db, Host{Name: "home", Domain: "home.example.org"}, testToken)
+	_, err := db.ExecContext(ctx, "INSERT INTO updates (host_id, cmd, args) VALUES (?, 'GET', 'https://example.org/')", home.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := deleteHost(ctx, db, home.Id)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v, want the host deleted", ok, err)
+	}
+	for _, table := range []string{"host_tokens", "updates"} {
+		var n int
+		db.GetContext(ctx, &n, "SELECT COUNT(*) FROM "+table)
+		if n != 0 {
+			t.Errorf("%d rows left in %s", n, table)
+		}
+	}
+	// The id is not reused, the token does not come back either.
+	next := newTestHost(t, db, Host{Name: "next", Domain: "next.example.org"}, "")
+	if next.Id == home.Id {
+		t.Errorf("host id %d reused", next.Id)
+	}
+	if _, _, err := hostByToken(ctx, db, testToken); !errors.Is(err, errNoHost) {
+		t.Errorf("got %v for the token of the deleted host, want errNoHost", err)
+	}
+	if ok, err := deleteHost(ctx, db, home.Id); ok || err != nil {
+		t.Errorf("got %v, %v deleting the host again, want false", ok, err)
+	}
+}
+
+func TestHashHostTokens(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	if _, err := migrateUp(ctx, db, 10); err != nil {
+		t.Fatal(err)
+	}
+	const legacy = "legacy-token-0123456789"
+	_, err := db.ExecContext(ctx, "INSERT INTO hosts (token, name, domain, zone) VALUES (?, 'home', 'home.example.org', 'example.org')", legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO updates (token, cmd, args) VALUES (?, 'GET', 'https://example.org/')", legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	err = db.SelectContext(ctx, &hashes, "SELECT token_hash FROM host_tokens")
+	if err != nil || len(hashes) != 1 || hashes[0] != hashToken(legacy) {
+		t.Fatalf("got token hashes %q, %v, want the hash of the legacy token", hashes, err)
+	}
+	host, _, err := hostByToken(ctx, db, legacy)
+	if err != nil || host.Name != "home" {
+		t.Fatalf("got %v, %v for the legacy token, want host home", host, err)
+	}
+	var updates int
+	db.GetContext(ctx, &updates, "SELECT COUNT(*) FROM updates WHERE host_id = ?", host.Id)
+	if updates != 1 {
+		t.Errorf("got %d update methods for the host, want 1", updates)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Prefixes of the limiter keys. Tokens are only kept as their hash, the
+// same one host_tokens stores.
+const (
+	limitSource = "source:"
+	limitToken  = "token:"
+)
+
+// LimitState is what the limiter knows about a source address or token.
+type LimitState struct {
+	Key string
+	// WindowStart and Count are the current rate limit window and the
+	// requests in it.
+	WindowStart time.Time `db:"window_start"`
+	Count       int
+	// Failures counts the bad tokens since the last lockout, Lockouts
+	// the lockouts so far, each one twice as long as the one before.
+	Failures    int
+	Lockouts    int
+	LockedUntil *time.Time `db:"locked_until"`
+	Updated     time.Time
+}
+
+// Locked reports whether the key is locked out at now.
+func (st *LimitState) Locked(now time.Time) bool {
+	return st.LockedUntil != nil && now.Before(*st.LockedUntil)
+}
+
+// Subject returns the source address or token hash of the key.
+func (st *LimitState) Subject() string {
+	_, subject, _ := strings.Cut(st.Key, ":")
+	return subject
+}
+
+// IsToken reports whether the key is a token.
+func (st *LimitState) IsToken() bool {
+	return strings.HasPrefix(st.Key, limitToken)
+}
+
+// limitStore keeps the limiter state, in memory for the server and in
+// the database for the CGI program, where no process outlives a request.
+type limitStore interface {
+	// update applies fn to the state of key and stores the result.
+	update(ctx context.Context, key string, fn func(st *LimitState)) error
+	// list returns all states.
+	list(ctx context.Context) ([]LimitState, error)
+	// reset forgets key.
+	reset(ctx context.Context, key string) error
+	// prune forgets the states that were not updated for idle and are
+	// not locked out at now, unless they have bad tokens or lockouts:
+	// those are kept until they were not updated for keep.
+	prune(ctx context.Context, now time.Time, idle, keep time.Duration) error
+}
+
+// expired reports whether prune forgets st.
+func (st *LimitState) expired(now time.Time, idle, keep time.Duration) bool {
+	if now.Sub(st.Updated) < idle || st.Locked(now) {
+		return false
+	}
+	return st.Lockouts == 0 && st.Failures == 0 || now.Sub(st.Updated) > keep
+}
+
+// Limiter throttles update requests per source address and per token and
+// locks out source addresses sending bad tokens, for exponentially growing
+// periods.
+type Limiter struct {
+	store limitStore
+	// Window is the length of a rate limit window.
+	Window time.Duration
+	// SourceLimit and TokenLimit are the requests allowed per window from
+	// a source address and with a token, zero disables the limit.
+	SourceLimit int
+	TokenLimit  int
+	// LockoutFailures is the number of bad tokens from a source address
+	// that locks it out, zero disables lockouts.
+	LockoutFailures int
+	// LockoutBase is the first lockout, LockoutMax the longest one. The
+	// count of lockouts is forgotten after LockoutMax without one.
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// NewLimiter returns a limiter keeping its state in memory, configured
+// from the environment.
+func NewLimiter() *Limiter {
+	l := &Limiter{
+		store:           newMemLimitStore(),
+		Window:          time.Minute,
+		SourceLimit:     60,
+		TokenLimit:      10,
+		LockoutFailures: 5,
+		LockoutBase:     time.Minute,
+		LockoutMax:      24 * time.Hour,
+	}
+	if d, err := time.ParseDuration(os.Getenv("RATE_LIMIT_WINDOW")); err == nil && d > 0 {
+		l.Window = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("RATE_LIMIT_SOURCE")); err == nil && n >= 0 {
+		l.SourceLimit = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("RATE_LIMIT_TOKEN")); err == nil && n >= 0 {
+		l.TokenLimit = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOCKOUT_FAILURES")); err == nil && n >= 0 {
+		l.LockoutFailures = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOCKOUT_BASE")); err == nil && d > 0 {
+		l.LockoutBase = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOCKOUT_MAX")); err == nil && d > 0 {
+		l.LockoutMax = d
+	}
+	l.LockoutMax = max(l.LockoutMax, l.LockoutBase)
+	return l
+}
+
+// UseDB keeps the state of l in db, for processes living for a single
+// request.
+func (l *Limiter) UseDB(db *sqlx.DB) {
+	l.store = &dbLimitStore{db: db}
+}
+
+// dbView returns a limiter with the configuration of l working on the
+// state the CGI program keeps in db.
+func (l *Limiter) dbView(db *sqlx.DB) *Limiter {
+	return &Limiter{
+		store:           &dbLimitStore{db: db},
+		Window:          l.Window,
+		SourceLimit:     l.SourceLimit,
+		TokenLimit:      l.TokenLimit,
+		LockoutFailures: l.LockoutFailures,
+		LockoutBase:     l.LockoutBase,
+		LockoutMax:      l.LockoutMax,
+	}
+}
+
+// Allow counts a request from source with token and returns how long the
+// client has to wait if it is locked out or over one of the limits, zero
+// if the request may proceed.
+func (l *Limiter) Allow(ctx context.Context, source, token string) (time.Duration, error) {
+	now := time.Now().UTC()
+	err := l.prune(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	err = l.store.update(ctx, limitSource+source, func(st *LimitState) {
+		if st.Locked(now) {
+			wait = st.LockedUntil.Sub(now)
+			return
+		}
+		wait = l.count(st, now, l.SourceLimit)
+	})
+	if err != nil || wait > 0 {
+		l.limited(ctx, "source", source, wait)
+		return wait, err
+	}
+	if token == "" || l.TokenLimit == 0 {
+		return 0, nil
+	}
+	err = l.store.update(ctx, limitToken+hashToken(token), func(st *LimitState) {
+		wait = l.count(st, now, l.TokenLimit)
+	})
+	if wait > 0 {
+		l.limited(ctx, "token", source, wait)
+	}
+	return wait, err
+}
+
+// count adds a request to the window of st and returns the rest of the
+// window if it goes over limit.
+func (l *Limiter) count(st *LimitState, now time.Time, limit int) time.Duration {
+	if now.Sub(st.WindowStart) >= l.Window {
+		st.WindowStart = now
+		st.Count = 0
+	}
+	st.Count++
+	if limit == 0 || st.Count <= limit {
+		return 0
+	}
+	return st.WindowStart.Add(l.Window).Sub(now)
+}
+
+func (l *Limiter) limited(ctx context.Context, kind, source string, wait time.Duration) {
+	if wait <= 0 {
+		return
+	}
+	slog.DebugContext(ctx, "request limited", "limit", kind, "source", source, "retry", wait)
+	requestsLimited.Add(ctx, 1, metric.WithAttributes(attribute.String("limit", kind)))
+}
+
+// Fail records a bad token from source and locks it out if there were too
+// many.
+func (l *Limiter) Fail(ctx context.Context, source string) error {
+	if l.LockoutFailures == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	return l.store.update(ctx, limitSource+source, func(st *LimitState) {
+		if st.LockedUntil != nil && now.Sub(*st.LockedUntil) > l.LockoutMax {
+			st.Lockouts = 0
+		}
+		st.Failures++
+		if st.Failures < l.LockoutFailures {
+			return
+		}
+		d := l.LockoutMax
+		if st.Lockouts < 32 {
+			d = min(l.LockoutBase<<st.Lockouts, l.LockoutMax)
+		}
+		until := now.Add(d)
+		st.Failures = 0
+		st.Lockouts++
+		st.LockedUntil = &until
+		slog.WarnContext(ctx, "source locked out", "source", source, "lockouts", st.Lockouts, "until", until)
+		requestsLimited.Add(ctx, 1, metric.WithAttributes(attribute.String("limit", "lockout")))
+	})
+}
+
+// Succeed records a valid token from source. It forgets the bad tokens
+// counted for source, so that a single misconfigured client does not lock
+// out the others sharing its address, e.g. behind a CGNAT.
+func (l *Limiter) Succeed(ctx context.Context, source string) error {
+	if l.LockoutFailures == 0 {
+		return nil
+	}
+	return l.store.update(ctx, limitSource+source, func(st *LimitState) {
+		st.Failures = 0
+	})
+}
+
+// States returns the source addresses and tokens currently limited,
+// locked out or with bad tokens, locked out ones first.
+func (l *Limiter) States(ctx context.Context) ([]LimitState, error) {
+	now := time.Now().UTC()
+	states, err := l.store.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states = slices.DeleteFunc(states, func(st LimitState) bool {
+		limit := l.SourceLimit
+		if st.IsToken() {
+			limit = l.TokenLimit
+		}
+		overLimit := limit > 0 && st.Count > limit && now.Sub(st.WindowStart) < l.Window
+		return !st.Locked(now) && !overLimit && st.Failures == 0 && st.Lockouts == 0
+	})
+	slices.SortFunc(states, func(a, b LimitState) int {
+		if a.Locked(now) != b.Locked(now) {
+			if a.Locked(now) {
+				return -1
+			}
+			return 1
+		}
+		return b.Updated.Compare(a.Updated)
+	})
+	return states, nil
+}
+
+// Reset lifts the limits and the lockout of key.
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.store.reset(ctx, key)
+}
+
+// prune forgets the states that expired, at most once per window of the
+// process: those whose window is over, that are not locked out and had
+// their last bad token or lockout more than LockoutMax ago.
+func (l *Limiter) prune(ctx context.Context, now time.Time) error {
+	l.mu.Lock()
+	due := now.Sub(l.pruned) >= l.Window
+	if due {
+		l.pruned = now
+	}
+	l.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return l.store.prune(ctx, now, l.Window, l.LockoutMax)
+}
+
+// memLimitStore keeps the limiter state in memory.
+type memLimitStore struct {
+	mu     sync.Mutex
+	states map[string]*LimitState
+}
+
+func newMemLimitStore() *memLimitStore {
+	return &memLimitStore{states: make(map[string]*LimitState)}
+}
+
+func (s *memLimitStore) update(ctx context.Context, key string, fn func(st *LimitState)) error {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.states[key]
+	if !ok {
+		st = &LimitState{Key: key}
+		s.states[key] = st
+	}
+	fn(st)
+	st.Updated = now
+	return nil
+}
+
+func (s *memLimitStore) prune(ctx context.Context, now time.Time, idle, keep time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, st := range s.states {
+		if st.expired(now, idle, keep) {
+			delete(s.states, key)
+		}
+	}
+	return nil
+}
+
+func (s *memLimitStore) list(ctx context.Context) ([]LimitState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make([]LimitState, 0, len(s.states))
+	for _, st := range s.states {
+		states = append(states, *st)
+	}
+	return states, nil
+}
+
+func (s *memLimitStore) reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+	return nil
+}
+
+// dbLimitStore keeps the limiter state in the rate_limits table.
+type dbLimitStore struct {
+	db *sqlx.DB
+}
+
+func (s *dbLimitStore) update(ctx context.Context, key string, fn func(st *LimitState)) error {
+	now := time.Now().UTC()
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// A failed scan may leave a partly filled struct behind, so only use
+	// the row read if there is one.
+	st := LimitState{Key: key}
+	var row LimitState
+	err = tx.GetContext(ctx, &row, "SELECT * FROM rate_limits WHERE key = ?", key)
+	switch {
+	case err == nil:
+		st = row
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	fn(&st)
+	st.Updated = now
+	_, err = tx.ExecContext(ctx, `INSERT INTO rate_limits (key, window_start, count, failures, lockouts, locked_until, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET window_start = excluded.window_start, count = excluded.count,
+			failures = excluded.failures, lockouts = excluded.lockouts, locked_until = excluded.locked_until,
+			updated = excluded.updated`,
+		st.Key, st.WindowStart, st.Count, st.Failures, st.Lockouts, st.LockedUntil, st.Updated)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// prune deletes the expired states with a single statement, as the CGI
+// program prunes on every request.
+func (s *dbLimitStore) prune(ctx context.Context, now time.Time, idle, keep time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE updated <= ?1
+		AND (locked_until IS NULL OR locked_until <= ?2)
+		AND ((lockouts = 0 AND failures = 0) OR updated < ?3)`,
+		now.Add(-idle), now, now.Add(-keep))
+	return err
+}
+
+func (s *dbLimitStore) list(ctx context.Context) ([]LimitState, error) {
+	var states []LimitState
+	err := s.db.SelectContext(ctx, &states, "SELECT * FROM rate_limits")
+	return states, err
+}
+
+func (s *dbLimitStore) reset(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE key = ?", key)
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	type step struct {
+		op     string // "allow", "fail", "succeed" or "reset"
+		source string
+		token  string
+		// want is the wait Allow returns, checked to the second.
+		want time.Duration
+	}
+	for _, tc := range []struct {
+		name     string
+		failures int
+		steps    []step
+	}{
+		{
+			name: "source limit",
+			steps: []step{
+				{op: "allow", source: "a"}, {op: "allow", source: "a"}, {op: "allow", source: "a"},
+				{op: "allow", source: "a", want: time.Hour},
+				{op: "allow", source: "b"},
+			},
+		},
+		{
+			name: "token limit across sources",
+			steps: []step{
+				{op: "allow", source: "a", token: "t1"}, {op: "allow", source: "b", token: "t1"},
+				{op: "allow", source: "c", token: "t1", want: time.Hour},
+				{op: "allow", source: "c", token: "t2"},
+			},
+		},
+		{
+			name: "lockout after bad tokens",
+			steps: []step{
+				{op: "fail", source: "a"},
+				{op: "allow", source: "a"},
+				{op: "fail", source: "a"},
+				{op: "allow", source: "a", want: time.Minute},
+				{op: "allow", source: "b"},
+			},
+		},
+		{
+			name: "valid token clears bad tokens",
+			steps: []step{
+				{op: "fail", source: "a"},
+				{op: "succeed", source: "a"},
+				{op: "fail", source: "a"},
+				{op: "allow", source: "a"},
+				{op: "fail", source: "a"},
+				{op: "allow", source: "a", want: time.Minute},
+			},
+		},
+		{
+			name: "lockouts double",
+			steps: []step{
+				{op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "allow", source: "a", want: 2 * time.Minute},
+				{op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "allow", source: "a", want: 4 * time.Minute},
+			},
+		},
+		{
+			name: "lockout capped",
+			steps: []step{
+				{op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "allow", source: "a", want: time.Hour},
+			},
+		},
+		{
+			name: "reset lifts the lockout",
+			steps: []step{
+				{op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "allow", source: "a", want: time.Minute},
+				{op: "reset", source: "a"},
+				{op: "allow", source: "a"},
+			},
+		},
+		{
+			name:     "lockouts disabled",
+			failures: -1,
+			steps: []step{
+				{op: "fail", source: "a"}, {op: "fail", source: "a"}, {op: "fail", source: "a"},
+				{op: "allow", source: "a"},
+			},
+		},
+	} {
+		for _, store := range []string{"memory", "db"} {
+			t.Run(tc.name+"/"+store, func(t *testing.T) {
+				ctx := context.Background()
+				l := NewLimiter()
+				l.Window = time.Hour
+				l.SourceLimit = 3
+				l.TokenLimit = 2
+				l.LockoutFailures = 2
+				l.LockoutBase = time.Minute
+				l.LockoutMax = time.Hour
+				if tc.failures < 0 {
+					l.LockoutFailures = 0
+				}
+				if store == "db" {
+					l.UseDB(newTestDB(t))
+				}
+				for i, s := range tc.steps {
+					var wait time.Duration
+					var err error
+					switch s.op {
+					case "allow":
+						wait, err = l.Allow(ctx, s.source, s.token)
+					case "fail":
+						err = l.Fail(ctx, s.source)
+					case "succeed":
+						err = l.Succeed(ctx, s.source)
+					case "reset":
+						err = l.Reset(ctx, limitSource+s.source)
+					}
+					if err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if s.want == 0 && wait != 0 || s.want > 0 && (wait > s.want || wait <= s.want-time.Second) {
+						t.Errorf("step %d: %s %s got wait %v, want %v", i, s.op, s.source, wait, s.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLimiterStates(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter()
+	l.Window = time.Hour
+	l.SourceLimit = 1
+	l.LockoutFailures = 1
+	l.UseDB(newTestDB(t))
+	for _, source := range []string{"limited", "limited", "ok"} {
+		if _, err := l.Allow(ctx, source, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Fail(ctx, "locked"); err != nil {
+		t.Fatal(err)
+	}
+	states, err := l.States(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, st := range states {
+		keys = append(keys, st.Key)
+	}
+	if len(keys) != 2 || keys[0] != limitSource+"locked" || keys[1] != limitSource+"limited" {
+		t.Errorf("got states %q, want the locked and the limited source", keys)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	for _, store := range []string{"memory", "db"} {
+		t.Run(store, func(t *testing.T) {
+			ctx := context.Background()
+			l := NewLimiter()
+			l.LockoutFailures = 2
+			if store == "db" {
+				l.UseDB(newTestDB(t))
+			}
+			for _, source := range []string{"quiet", "failed", "locked", "locked"} {
+				if _, err := l.Allow(ctx, source, ""); err != nil {
+					t.Fatal(err)
+				}
+				if source != "quiet" {
+					if err := l.Fail(ctx, source); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			now := time.Now().UTC()
+			for _, tc := range []struct {
+				at   time.Duration
+				want []string
+			}{
+				{0, []string{"failed", "locked", "quiet"}},
+				{2 * time.Minute, []string{"failed", "locked"}},
+				{l.LockoutMax + time.Hour, nil},
+			} {
+				err := l.store.prune(ctx, now.Add(tc.at), l.Window, l.LockoutMax)
+				if err != nil {
+					t.Fatal(err)
+				}
+				states, err := l.store.list(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, st := range states {
+					got = append(got, st.Subject())
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, tc.want) {
+					t.Errorf("after %v got %q, want %q", tc.at, got, tc.want)
+				}
+			}
+		})
+	}
+}
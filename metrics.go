@@ -0,0 +1,30 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meter is used for all instruments of fritzdyn. It uses the global meter
+// provider, so the instruments are no-ops unless ENABLE_OTEL is set.
+var meter = otel.Meter("github.com/jum/fritzdyn")
+
+var (
+	driftChecks = mustInstrument(meter.Int64Counter("fritzdyn.drift.checks",
+		metric.WithDescription("Number of hosts checked for DNS drift")))
+	driftDetected = mustInstrument(meter.Int64Counter("fritzdyn.drift.detected",
+		metric.WithDescription("Number of times the published DNS records of a host did not match its addresses")))
+	guardRejections = mustInstrument(meter.Int64Counter("fritzdyn.updates.rejected",
+		metric.WithDescription("Number of update requests with a valid token rejected by the guards of the host")))
+	requestsLimited = mustInstrument(meter.Int64Counter("fritzdyn.requests.limited",
+		metric.WithDescription("Number of update requests over a rate limit or from a locked out source, and of lockouts")))
+)
+
+// mustInstrument returns inst, instrument creation only fails for invalid
+// names.
+func mustInstrument[T any](inst T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return inst
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// Migration is a versioned schema change embedded in the binary, read from
+// migrations/<version>_<name>.up.sql and the matching .down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// AppliedMigration is a row of the schema_migrations table.
+type AppliedMigration struct {
+	Version int
+	Name    string
+	Applied time.Time
+}
+
+// migrationHooks run in the transaction of the migration with their version,
+// after its SQL, for the parts that cannot be done in SQL.
+var migrationHooks = map[int]func(ctx context.Context, tx *sqlx.Tx) error{
+	11: hashHostTokens,
+	18: convertShellUpdates,
+}
+
+// migrations returns all embedded migrations ordered by version.
+var migrations = sync.OnceValues(func() ([]Migration, error) {
+	names, err := fs.Glob(migrationFS, "migrations/*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+	var all []Migration
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".up.sql")
+		num, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: name is not <version>_<name>.up.sql", name)
+		}
+		up, err := migrationFS.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		down, err := migrationFS.ReadFile("migrations/" + base + ".down.sql")
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", base, err)
+		}
+		all = append(all, Migration{Version: version, Name: label, Up: string(up), Down: string(down)})
+	}
+	slices.SortFunc(all, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range all {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s: versions must count up from 1 without gaps", m.Version, m.Name)
+		}
+	}
+	return all, nil
+})
+
+// appliedMigrations returns the migrations applied to the database, creating
+// the schema_migrations table first if needed. A database that was created
+// with create_tables.sql before there were migrations is adopted at
+// version 1.
+func appliedMigrations(ctx context.Context, db *sqlx.DB) ([]AppliedMigration, error) {
+	var exists bool
+	err := db.GetContext(ctx, &exists, "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+		if err != nil {
+			return nil, err
+		}
+		var legacy bool
+		err = tx.GetContext(ctx, &legacy, "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'hosts'")
+		if err != nil {
+			return nil, err
+		}
+		if legacy {
+			slog.InfoContext(ctx, "adopting database created by create_tables.sql as schema version 1")
+			_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO schema_migrations (version, name) VALUES (1, 'initial')")
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var applied []AppliedMigration
+	err = db.SelectContext(ctx, &applied, "SELECT * FROM schema_migrations ORDER BY version")
+	return applied, err
+}
+
+// schemaVersion returns the version of the last applied migration.
+func schemaVersion(applied []AppliedMigration) int {
+	if len(applied) == 0 {
+		return 0
+	}
+	return applied[len(applied)-1].Version
+}
+
+// migrateUp applies the pending migrations up to and including version
+// target, or all of them if target is 0. It returns the migrations applied.
+func migrateUp(ctx context.Context, db *sqlx.DB, target int) ([]Migration, error) {
+	all, err := migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		target = len(all)
+	}
+	if target > len(all) {
+		return nil, fmt.Errorf("no migration %d, the latest is %d", target, len(all))
+	}
+	version := schemaVersion(applied)
+	if version > len(all) {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary, it only knows %d", version, len(all))
+	}
+	var done []Migration
+	for _, m := range all[min(version, target):target] {
+		err = runMigration(ctx, db, m, true)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown reverts the applied migrations above version target, newest
+// first. It returns the migrations reverted.
+func migrateDown(ctx context.Context, db *sqlx.DB, target int) ([]Migration, error) {
+	all, err := migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	version := schemaVersion(applied)
+	if version > len(all) {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary, it only knows %d", version, len(all))
+	}
+	var done []Migration
+	for v := version; v > max(target, 0); v-- {
+		m := all[v-1]
+		err = runMigration(ctx, db, m, false)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// runMigration applies or reverts m in a transaction together with its
+// row in schema_migrations. Another process that got there first is not an
+// error.
+func runMigration(ctx context.Context, db *sqlx.DB, m Migration, up bool) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var version int
+	err = tx.GetContext(ctx, &version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	if up {
+		if version != m.Version-1 {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, m.Up)
+		if hook := migrationHooks[m.Version]; hook != nil && err == nil {
+			err = hook(ctx, tx)
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		}
+	} else {
+		if version != m.Version {
+			return nil
+		}
+		if !hasStatements(m.Down) {
+			return fmt.Errorf("migration %d_%s cannot be reverted", m.Version, m.Name)
+		}
+		_, err = tx.ExecContext(ctx, m.Down)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+// hasStatements reports whether the SQL in s is more than comments. A
+// migration with an empty down file cannot be reverted.
+func hasStatements(s string) bool {
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSchema brings the database up to date. It refuses a database that
+// has migrations applied this binary does not know, as they came from a
+// newer version of fritzdyn.
+func checkSchema(ctx context.Context, db *sqlx.DB) error {
+	all, err := migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	if version := schemaVersion(applied); version > len(all) {
+		return fmt.Errorf("database schema version %d is newer than this binary, it only knows %d", version, len(all))
+	}
+	done, err := migrateUp(ctx, db, 0)
+	for _, m := range done {
+		slog.InfoContext(ctx, "applied migration", "version", m.Version, "name", m.Name)
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// schema returns the definitions of the tables, indexes and triggers of db.
+func schema(t *testing.T, db *sqlx.DB) []string {
+	t.Helper()
+	var defs []string
+	err := db.SelectContext(context.Background(), &defs, `SELECT sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND name != 'sqlite_sequence' ORDER BY type, name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return defs
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	ctx := context.Background()
+	all, err := migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The migrations before the irreversible one go down to nothing,
+	// those after it back to it.
+	const irreversible = 11
+	for _, tc := range []struct {
+		name     string
+		from, to int
+	}{
+		{"before host ids", irreversible - 1, 0},
+		{"after host ids", len(all), irreversible},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := openTestDB(t)
+			// Migrating to 0 would apply all, only create schema_migrations.
+			_, err := appliedMigrations(ctx, db)
+			if err == nil && tc.to > 0 {
+				_, err = migrateUp(ctx, db, tc.to)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := schema(t, db)
+			done, err := migrateUp(ctx, db, tc.from)
+			if err != nil || len(done) != tc.from-tc.to {
+				t.Fatalf("up: got %d migrations, %v, want %d", len(done), err, tc.from-tc.to)
+			}
+			up := schema(t, db)
+			done, err = migrateDown(ctx, db, tc.to)
+			if err != nil || len(done) != tc.from-tc.to {
+				t.Fatalf("down: got %d migrations, %v, want %d", len(done), err, tc.from-tc.to)
+			}
+			if got := schema(t, db); strings.Join(got, "\n") != strings.Join(before, "\n") {
+				t.Errorf("down left schema\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(before, "\n"))
+			}
+			if _, err := migrateUp(ctx, db, tc.from); err != nil {
+				t.Fatalf("up again: %v", err)
+			}
+			if got := schema(t, db); strings.Join(got, "\n") != strings.Join(up, "\n") {
+				t.Errorf("up again gave schema\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(up, "\n"))
+			}
+		})
+	}
+	t.Run("up to an older version", func(t *testing.T) {
+		db := newTestDB(t)
+		done, err := migrateUp(ctx, db, 5)
+		if err != nil || len(done) != 0 {
+			t.Errorf("got %d migrations, %v, want none", len(done), err)
+		}
+	})
+	t.Run("irreversible", func(t *testing.T) {
+		db := newTestDB(t)
+		done, err := migrateDown(ctx, db, irreversible-1)
+		if err == nil || !strings.Contains(err.Error(), "cannot be reverted") || len(done) != len(all)-irreversible {
+			t.Errorf("got %d migrations, %v, want to stop at migration %d", len(done), err, irreversible)
+		}
+	})
+}
+
+func TestCheckSchema(t *testing.T) {
+	ctx := context.Background()
+	all, err := migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		setup   string
+		want    int
+		wantErr string
+	}{
+		{name: "empty database", want: len(all)},
+		{name: "adopts create_tables.sql", setup: all[0].Up, want: len(all)},
+		{name: "newer database", setup: `CREATE TABLE schema_migrations (version INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL, applied DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP);
+			INSERT INTO schema_migrations (version, name) VALUES (99, 'future')`,
+			wantErr: "database schema version 99 is newer than this binary"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if tc.setup != "" {
+				if _, err := db.ExecContext(ctx, tc.setup); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := checkSchema(ctx, db)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			applied, err := appliedMigrations(ctx, db)
+			if err != nil || schemaVersion(applied) != tc.want {
+				t.Errorf("got version %d, %v, want %d", schemaVersion(applied), err, tc.want)
+			}
+			// Checking again changes nothing.
+			if err := checkSchema(ctx, db); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestShellUpdatesMigration(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	if _, err := migrateUp(ctx, db, 17); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO hosts (name, domain, zone) VALUES ('home', 'home.example.org', 'example.org');
+		INSERT INTO updates (host_id, cmd, args, config) VALUES
+			(1, '/usr/local/bin/nsupdate.sh', '{{.Host.Ip4addr}}', NULL),
+			(1, '/usr/local/bin/notify.sh <&>', 'x', '{"timeout":"5s"}'),
+			(1, 'GET', 'https://example.org/', NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		Cmd    string
+		Config *string
+	}
+	rows := func() []row {
+		var rows []row
+		err := db.SelectContext(ctx, &rows, "SELECT cmd, config FROM updates ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+	old := rows()
+	if _, err := migrateUp(ctx, db, 18); err != nil {
+		t.Fatal(err)
+	}
+	want := []row{
+		{"shell", optional(`{"command":"/usr/local/bin/nsupdate.sh"}`)},
+		{"shell", optional(`{"command":"/usr/local/bin/notify.sh <&>","timeout":"5s"}`)},
+		{"GET", nil},
+	}
+	for i, got := range rows() {
+		if got.Cmd != want[i].Cmd || deref(got.Config) != deref(want[i].Config) {
+			t.Errorf("update %d: got %s %s, want %s %s", i+1, got.Cmd, deref(got.Config), want[i].Cmd, deref(want[i].Config))
+		}
+	}
+	if _, err := migrateDown(ctx, db, 17); err != nil {
+		t.Fatal(err)
+	}
+	for i, got := range rows() {
+		if got.Cmd != old[i].Cmd || deref(got.Config) != deref(old[i].Config) {
+			t.Errorf("update %d after down: got %s %s, want %s %s", i+1, got.Cmd, deref(got.Config), old[i].Cmd, deref(old[i].Config))
+		}
+	}
+}
+
+func TestShellUpdatesMigrationBadConfig(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	if _, err := migrateUp(ctx, db, 17); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO hosts (name, domain, zone) VALUES ('home', 'home.example.org', 'example.org');
+		INSERT INTO updates (host_id, cmd, args, config) VALUES (1, '/usr/local/bin/notify.sh', 'x', '{"timeout":')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(ctx, db, 18); err == nil || !strings.Contains(err.Error(), "config of update 1") {
+		t.Fatalf("got error %v, want the config of update 1 rejected", err)
+	}
+	var cmd string
+	db.GetContext(ctx, &cmd, "SELECT cmd FROM updates")
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil || schemaVersion(applied) != 17 || cmd != "/usr/local/bin/notify.sh" {
+		t.Errorf("got version %d, %v and command %q, want the migration rolled back", schemaVersion(applied), err, cmd)
+	}
+}
+
+func TestHasStatements(t *testing.T) {
+	for _, tc := range []struct {
+		sql  string
+		want bool
+	}{
+		{"", false},
+		{"-- Irreversible.\n\n", false},
+		{"-- Drop it.\nDROP TABLE jobs;\n", true},
+	} {
+		if got := hasStatements(tc.sql); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.sql, got, tc.want)
+		}
+	}
+}
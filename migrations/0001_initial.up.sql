@@ -1,11 +1,3 @@
-.read settings.sql
-BEGIN;
-DROP INDEX IF EXISTS updates_token_index;
-DROP TABLE IF EXISTS updates;
-DROP TABLE IF EXISTS hosts;
-DROP TRIGGER IF EXISTS hosts_update;
-DROP TRIGGER IF EXISTS updates_update;
-
 CREATE TABLE hosts (
 	token CHAR(43) PRIMARY KEY,
 	name VARCHAR(255) NOT NULL,
@@ -35,6 +27,7 @@ CREATE TABLE updates (
 	ON DELETE CASCADE
 	ON UPDATE RESTRICT
 );
+
 CREATE INDEX updates_token_index ON updates (token);
 
 CREATE TRIGGER updates_update AFTER UPDATE ON updates
@@ -42,5 +35,3 @@ CREATE TRIGGER updates_update AFTER UPDATE ON updates
 BEGIN
 	UPDATE updates SET modified = DATETIME() WHERE id = NEW.id;
 END;
-
-COMMIT;
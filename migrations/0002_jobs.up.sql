@@ -0,0 +1,24 @@
+CREATE TABLE jobs (
+	id INTEGER NOT NULL PRIMARY KEY,
+	update_id INTEGER NOT NULL,
+	token CHAR(43) NOT NULL,
+	old_ip4addr VARCHAR(255),
+	old_ip6addr VARCHAR(255),
+	form TEXT NOT NULL DEFAULT '',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_run DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_error TEXT,
+	state VARCHAR(16) NOT NULL DEFAULT 'pending',
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(update_id) REFERENCES updates(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+CREATE INDEX jobs_next_run_index ON jobs (state, next_run);
+
+CREATE TRIGGER jobs_update AFTER UPDATE ON jobs
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE jobs SET modified = DATETIME() WHERE id = NEW.id;
+END;
@@ -0,0 +1 @@
+DROP TABLE update_runs;
@@ -0,0 +1,21 @@
+CREATE TABLE update_runs (
+	id INTEGER NOT NULL PRIMARY KEY,
+	token CHAR(43) NOT NULL,
+	update_id INTEGER NOT NULL,
+	args TEXT NOT NULL,
+	old_ip4addr VARCHAR(255),
+	old_ip6addr VARCHAR(255),
+	ip4addr VARCHAR(255),
+	ip6addr VARCHAR(255),
+	started DATETIME NOT NULL,
+	finished DATETIME NOT NULL,
+	success BOOLEAN NOT NULL,
+	error TEXT,
+	status INTEGER,
+	output TEXT NOT NULL DEFAULT '',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(update_id) REFERENCES updates(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+CREATE INDEX update_runs_update_index ON update_runs (update_id, id);
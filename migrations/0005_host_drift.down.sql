@@ -0,0 +1 @@
+DROP TABLE host_drift;
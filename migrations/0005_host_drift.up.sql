@@ -0,0 +1,12 @@
+CREATE TABLE host_drift (
+	token CHAR(43) NOT NULL PRIMARY KEY,
+	checked DATETIME NOT NULL,
+	source VARCHAR(255) NOT NULL,
+	published TEXT NOT NULL DEFAULT '',
+	drift BOOLEAN NOT NULL,
+	error TEXT,
+	since DATETIME,
+	FOREIGN KEY(token) REFERENCES hosts(token)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
@@ -0,0 +1,2 @@
+DROP TABLE host_seen;
+ALTER TABLE hosts DROP COLUMN checkin_interval;
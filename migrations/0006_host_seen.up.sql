@@ -0,0 +1,12 @@
+ALTER TABLE hosts ADD COLUMN checkin_interval INTEGER;
+
+CREATE TABLE host_seen (
+	token CHAR(43) NOT NULL PRIMARY KEY,
+	last_seen DATETIME,
+	remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+	user_agent VARCHAR(255) NOT NULL DEFAULT '',
+	stale_since DATETIME,
+	FOREIGN KEY(token) REFERENCES hosts(token)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
@@ -0,0 +1,15 @@
+CREATE TABLE ip_history (
+	id INTEGER NOT NULL PRIMARY KEY,
+	token CHAR(43) NOT NULL,
+	old_ip4addr VARCHAR(255),
+	ip4addr VARCHAR(255),
+	old_ip6addr VARCHAR(255),
+	ip6addr VARCHAR(255),
+	source VARCHAR(32) NOT NULL,
+	remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+	changed DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(token) REFERENCES hosts(token)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+CREATE INDEX ip_history_token_index ON ip_history (token, id);
@@ -0,0 +1,23 @@
+CREATE TABLE users (
+	id INTEGER NOT NULL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	password_hash VARCHAR(255) NOT NULL,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER users_update AFTER UPDATE ON users
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE users SET modified = DATETIME() WHERE id = NEW.id;
+END;
+
+CREATE TABLE sessions (
+	id CHAR(64) NOT NULL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expires DATETIME NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
@@ -0,0 +1,2 @@
+ALTER TABLE updates DROP COLUMN enabled;
+ALTER TABLE updates DROP COLUMN position;
@@ -0,0 +1,3 @@
+ALTER TABLE updates ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE updates ADD COLUMN enabled BOOLEAN NOT NULL DEFAULT 1;
+UPDATE updates SET position = id;
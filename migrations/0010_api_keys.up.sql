@@ -0,0 +1,9 @@
+CREATE TABLE api_keys (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	key_hash CHAR(64) NOT NULL UNIQUE,
+	scopes VARCHAR(255) NOT NULL,
+	last_used DATETIME,
+	revoked DATETIME,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+-- Irreversible: only the hashes of the host tokens are left.
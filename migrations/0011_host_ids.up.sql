@@ -0,0 +1,184 @@
+-- Hosts get a stable id that the other tables refer to, the tokens move to
+-- host_tokens. token_hash holds the plaintext token until the migration
+-- hook replaces it with its hash. Host and update method ids are never
+-- reused, so that nothing left over from a deleted one can be mistaken
+-- for a new one.
+CREATE TABLE hosts_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	legacy_token CHAR(43),
+	name VARCHAR(255) NOT NULL,
+	domain VARCHAR(255),
+	zone VARCHAR(255),
+	ip4addr VARCHAR(255),
+	ip6addr VARCHAR(255),
+	checkin_interval INTEGER,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO hosts_new (legacy_token, name, domain, zone, ip4addr, ip6addr, checkin_interval, modified, created)
+	SELECT token, name, domain, zone, ip4addr, ip6addr, checkin_interval, modified, created FROM hosts ORDER BY created, token;
+
+CREATE TABLE host_tokens (
+	id INTEGER NOT NULL PRIMARY KEY,
+	host_id INTEGER NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	expires DATETIME,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(host_id) REFERENCES hosts_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO host_tokens (host_id, token_hash, created) SELECT id, legacy_token, created FROM hosts_new WHERE legacy_token IS NOT NULL;
+
+CREATE TABLE updates_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	api_key VARCHAR(255),
+	host_id INTEGER NOT NULL,
+	cmd VARCHAR(255) NOT NULL,
+	args VARCHAR(255) NOT NULL,
+	config TEXT,
+	position INTEGER NOT NULL DEFAULT 0,
+	enabled BOOLEAN NOT NULL DEFAULT 1,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(host_id) REFERENCES hosts_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO updates_new (id, api_key, host_id, cmd, args, config, position, enabled, modified, created)
+	SELECT u.id, u.api_key, h.id, u.cmd, u.args, u.config, u.position, u.enabled, u.modified, u.created
+	FROM updates u JOIN hosts_new h ON h.legacy_token = u.token;
+
+CREATE TABLE update_runs_new (
+	id INTEGER NOT NULL PRIMARY KEY,
+	host_id INTEGER NOT NULL,
+	update_id INTEGER NOT NULL,
+	args TEXT NOT NULL,
+	old_ip4addr VARCHAR(255),
+	old_ip6addr VARCHAR(255),
+	ip4addr VARCHAR(255),
+	ip6addr VARCHAR(255),
+	started DATETIME NOT NULL,
+	finished DATETIME NOT NULL,
+	success BOOLEAN NOT NULL,
+	error TEXT,
+	status INTEGER,
+	output TEXT NOT NULL DEFAULT '',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(update_id) REFERENCES updates_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO update_runs_new (id, host_id, update_id, args, old_ip4addr, old_ip6addr, ip4addr, ip6addr, started, finished, success, error, status, output, created)
+	SELECT r.id, h.id, r.update_id, r.args, r.old_ip4addr, r.old_ip6addr, r.ip4addr, r.ip6addr, r.started, r.finished, r.success, r.error, r.status, r.output, r.created
+	FROM update_runs r JOIN hosts_new h ON h.legacy_token = r.token JOIN updates_new u ON u.id = r.update_id;
+
+CREATE TABLE jobs_new (
+	id INTEGER NOT NULL PRIMARY KEY,
+	update_id INTEGER NOT NULL,
+	host_id INTEGER NOT NULL,
+	old_ip4addr VARCHAR(255),
+	old_ip6addr VARCHAR(255),
+	form TEXT NOT NULL DEFAULT '',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_run DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_error TEXT,
+	state VARCHAR(16) NOT NULL DEFAULT 'pending',
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(update_id) REFERENCES updates_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO jobs_new (id, update_id, host_id, old_ip4addr, old_ip6addr, form, attempts, next_run, last_error, state, modified, created)
+	SELECT j.id, j.update_id, h.id, j.old_ip4addr, j.old_ip6addr, j.form, j.attempts, j.next_run, j.last_error, j.state, j.modified, j.created
+	FROM jobs j JOIN hosts_new h ON h.legacy_token = j.token JOIN updates_new u ON u.id = j.update_id;
+
+CREATE TABLE host_drift_new (
+	host_id INTEGER NOT NULL PRIMARY KEY,
+	checked DATETIME NOT NULL,
+	source VARCHAR(255) NOT NULL,
+	published TEXT NOT NULL DEFAULT '',
+	drift BOOLEAN NOT NULL,
+	error TEXT,
+	since DATETIME,
+	FOREIGN KEY(host_id) REFERENCES hosts_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO host_drift_new (host_id, checked, source, published, drift, error, since)
+	SELECT h.id, d.checked, d.source, d.published, d.drift, d.error, d.since
+	FROM host_drift d JOIN hosts_new h ON h.legacy_token = d.token;
+
+CREATE TABLE host_seen_new (
+	host_id INTEGER NOT NULL PRIMARY KEY,
+	last_seen DATETIME,
+	remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+	user_agent VARCHAR(255) NOT NULL DEFAULT '',
+	stale_since DATETIME,
+	FOREIGN KEY(host_id) REFERENCES hosts_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO host_seen_new (host_id, last_seen, remote_addr, user_agent, stale_since)
+	SELECT h.id, s.last_seen, s.remote_addr, s.user_agent, s.stale_since
+	FROM host_seen s JOIN hosts_new h ON h.legacy_token = s.token;
+
+CREATE TABLE ip_history_new (
+	id INTEGER NOT NULL PRIMARY KEY,
+	host_id INTEGER NOT NULL,
+	old_ip4addr VARCHAR(255),
+	ip4addr VARCHAR(255),
+	old_ip6addr VARCHAR(255),
+	ip6addr VARCHAR(255),
+	source VARCHAR(32) NOT NULL,
+	remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+	changed DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(host_id) REFERENCES hosts_new(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+INSERT INTO ip_history_new (id, host_id, old_ip4addr, ip4addr, old_ip6addr, ip6addr, source, remote_addr, changed)
+	SELECT i.id, h.id, i.old_ip4addr, i.ip4addr, i.old_ip6addr, i.ip6addr, i.source, i.remote_addr, i.changed
+	FROM ip_history i JOIN hosts_new h ON h.legacy_token = i.token;
+
+DROP TABLE update_runs;
+DROP TABLE jobs;
+DROP TABLE host_drift;
+DROP TABLE host_seen;
+DROP TABLE ip_history;
+DROP TABLE updates;
+DROP TABLE hosts;
+ALTER TABLE hosts_new DROP COLUMN legacy_token;
+
+ALTER TABLE hosts_new RENAME TO hosts;
+ALTER TABLE updates_new RENAME TO updates;
+ALTER TABLE update_runs_new RENAME TO update_runs;
+ALTER TABLE jobs_new RENAME TO jobs;
+ALTER TABLE host_drift_new RENAME TO host_drift;
+ALTER TABLE host_seen_new RENAME TO host_seen;
+ALTER TABLE ip_history_new RENAME TO ip_history;
+
+CREATE INDEX host_tokens_host_index ON host_tokens (host_id);
+CREATE INDEX updates_host_index ON updates (host_id);
+CREATE INDEX update_runs_update_index ON update_runs (update_id, id);
+CREATE INDEX jobs_next_run_index ON jobs (state, next_run);
+CREATE INDEX ip_history_host_index ON ip_history (host_id, id);
+
+CREATE TRIGGER hosts_update AFTER UPDATE ON hosts
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE hosts SET modified = DATETIME() WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER updates_update AFTER UPDATE ON updates
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE updates SET modified = DATETIME() WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER jobs_update AFTER UPDATE ON jobs
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE jobs SET modified = DATETIME() WHERE id = NEW.id;
+END;
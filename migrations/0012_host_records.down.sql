@@ -0,0 +1,6 @@
+DELETE FROM updates WHERE record_id IS NOT NULL;
+DELETE FROM jobs WHERE record_id IS NOT NULL;
+ALTER TABLE update_runs DROP COLUMN domain;
+ALTER TABLE jobs DROP COLUMN record_id;
+ALTER TABLE updates DROP COLUMN record_id;
+DROP TABLE host_records;
@@ -0,0 +1,24 @@
+CREATE TABLE host_records (
+	id INTEGER NOT NULL PRIMARY KEY,
+	host_id INTEGER NOT NULL,
+	domain VARCHAR(255) NOT NULL,
+	zone VARCHAR(255) NOT NULL DEFAULT '',
+	inherit BOOLEAN NOT NULL DEFAULT 1,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(host_id) REFERENCES hosts(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+CREATE UNIQUE INDEX host_records_domain_index ON host_records (host_id, domain);
+
+CREATE TRIGGER host_records_update AFTER UPDATE ON host_records
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE host_records SET modified = DATETIME() WHERE id = NEW.id;
+END;
+
+-- NULL for the update methods of the host itself.
+ALTER TABLE updates ADD COLUMN record_id INTEGER;
+ALTER TABLE jobs ADD COLUMN record_id INTEGER;
+ALTER TABLE update_runs ADD COLUMN domain VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Use the source address of the request if the host does not report one.
+ALTER TABLE hosts ADD COLUMN auto_addr BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE host_seen DROP COLUMN addr_warning;
+ALTER TABLE hosts DROP COLUMN addr_policy;
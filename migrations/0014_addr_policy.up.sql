@@ -0,0 +1,7 @@
+-- What to do with addresses in private, CGNAT, link-local, ULA,
+-- documentation and loopback ranges: reject, ignore or accept.
+ALTER TABLE hosts ADD COLUMN addr_policy VARCHAR(16) NOT NULL DEFAULT 'reject';
+-- Existing hosts keep publishing whatever they report, new ones reject.
+UPDATE hosts SET addr_policy = 'accept';
+-- The last address rejected or ignored for the host.
+ALTER TABLE host_seen ADD COLUMN addr_warning VARCHAR(255);
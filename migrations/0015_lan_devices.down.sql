@@ -0,0 +1,4 @@
+DELETE FROM jobs WHERE device_id IS NOT NULL;
+ALTER TABLE jobs DROP COLUMN device_id;
+DROP TABLE lan_devices;
+ALTER TABLE hosts DROP COLUMN ip6lanprefix;
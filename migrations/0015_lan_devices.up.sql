@@ -0,0 +1,27 @@
+-- The IPv6 prefix delegated to the LAN of the host, as last reported.
+ALTER TABLE hosts ADD COLUMN ip6lanprefix VARCHAR(64);
+
+CREATE TABLE lan_devices (
+	id INTEGER NOT NULL PRIMARY KEY,
+	host_id INTEGER NOT NULL,
+	domain VARCHAR(255) NOT NULL,
+	zone VARCHAR(255) NOT NULL DEFAULT '',
+	ether VARCHAR(32),
+	iface_id VARCHAR(64),
+	ip6addr VARCHAR(64),
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(host_id) REFERENCES hosts(id)
+	ON DELETE CASCADE
+	ON UPDATE RESTRICT
+);
+CREATE UNIQUE INDEX lan_devices_domain_index ON lan_devices (host_id, domain);
+
+CREATE TRIGGER lan_devices_update AFTER UPDATE ON lan_devices
+	FOR EACH ROW WHEN OLD.modified != DATETIME()
+BEGIN
+	UPDATE lan_devices SET modified = DATETIME() WHERE id = NEW.id;
+END;
+
+-- NULL for the jobs of the host and its records.
+ALTER TABLE jobs ADD COLUMN device_id INTEGER;
@@ -0,0 +1,3 @@
+ALTER TABLE hosts DROP COLUMN cert_fingerprint;
+ALTER TABLE hosts DROP COLUMN require_source;
+ALTER TABLE hosts DROP COLUMN allowed_sources;
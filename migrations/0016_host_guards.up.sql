@@ -0,0 +1,6 @@
+-- Comma separated CIDR prefixes updates are accepted from, any if empty.
+ALTER TABLE hosts ADD COLUMN allowed_sources VARCHAR(1024) NOT NULL DEFAULT '';
+-- Only accept updates reporting the source address of the request.
+ALTER TABLE hosts ADD COLUMN require_source BOOLEAN NOT NULL DEFAULT 0;
+-- SHA-256 fingerprint of the client certificate updates must present.
+ALTER TABLE hosts ADD COLUMN cert_fingerprint VARCHAR(64);
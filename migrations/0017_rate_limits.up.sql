@@ -0,0 +1,11 @@
+-- Rate limits and lockouts of the CGI program, the server keeps them in
+-- memory. key is "source:<address>" or "token:<sha256 hash>".
+CREATE TABLE rate_limits (
+	key VARCHAR(128) NOT NULL PRIMARY KEY,
+	window_start DATETIME NOT NULL,
+	count INTEGER NOT NULL DEFAULT 0,
+	failures INTEGER NOT NULL DEFAULT 0,
+	lockouts INTEGER NOT NULL DEFAULT 0,
+	locked_until DATETIME,
+	updated DATETIME NOT NULL
+);
@@ -0,0 +1,2 @@
+UPDATE updates SET cmd = json_extract(config, '$.command'), config = NULLIF(json_remove(config, '$.command'), '{}')
+	WHERE cmd = 'shell' AND json_extract(config, '$.command') IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Update methods of older versions with a command line in cmd become shell
+-- update methods with the command in their config, see convertShellUpdates.
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Event is a notification about a host.
+type Event struct {
+	// Kind is "stale" or "recovered".
+	Kind    string    `json:"kind"`
+	Host    string    `json:"host"`
+	Domain  string    `json:"domain"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// notify sends event to all configured notification channels:
+//
+//	NOTIFY_WEBHOOK_URL: the event is POSTed as JSON to the URL.
+//	NOTIFY_COMMAND: the command is run with the event as JSON on stdin,
+//	e.g. a script sending a mail. It is split at white space, not run
+//	by a shell.
+//
+// The event is always logged.
+func notify(ctx context.Context, event Event) error {
+	slog.WarnContext(ctx, "notify", "kind", event.Kind, "host", event.Host, "message", event.Message)
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var errs []error
+	if webhook := os.Getenv("NOTIFY_WEBHOOK_URL"); webhook != "" {
+		errs = append(errs, notifyWebhook(ctx, webhook, buf))
+	}
+	if command := strings.Fields(os.Getenv("NOTIFY_COMMAND")); len(command) > 0 {
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin = bytes.NewReader(buf)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("notify command: %w: %s", err, out)
+		}
+		errs = append(errs, err)
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		slog.ErrorContext(ctx, "notify failed", "kind", event.Kind, "host", event.Host, "err", err)
+	}
+	return err
+}
+
+func notifyWebhook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("notify webhook: unexpected status %s", res.Status)
+	}
+	return nil
+}
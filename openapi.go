@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// queryParamDocs describes the query parameters operations may take.
+var queryParamDocs = map[string]map[string]any{
+	"limit":     {"description": "Maximum number of entries, 1 to 1000, default 100.", "schema": map[string]any{"type": "integer"}},
+	"offset":    {"description": "Number of entries to skip.", "schema": map[string]any{"type": "integer"}},
+	"update_id": {"description": "Only the runs of this update method.", "schema": map[string]any{"type": "integer"}},
+}
+
+// openAPI serves the OpenAPI 3 document of the API, generated from the
+// operations it is routed by.
+func (h *APIHandler) openAPI(r *http.Request, _ *noBody) (map[string]any, error) {
+	schemas := make(map[string]any)
+	paths := make(map[string]any)
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content":     jsonContent(schemaFor(reflect.TypeFor[APIError](), schemas)),
+	}
+	for _, op := range h.ops {
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[op.Path] = item
+		}
+		var params []any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, name := range op.Query {
+			param := map[string]any{"name": name, "in": "query"}
+			for k, v := range queryParamDocs[name] {
+				param[k] = v
+			}
+			params = append(params, param)
+		}
+		response := map[string]any{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			response["content"] = jsonContent(schemaFor(op.Response, schemas))
+		}
+		operation := map[string]any{
+			"operationId": op.Id,
+			"summary":     op.Summary,
+			"responses": map[string]any{
+				strconv.Itoa(op.Status): response,
+				"default":               errorResponse,
+			},
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(schemaFor(op.Request, schemas)),
+			}
+		}
+		if op.Scope != "" {
+			operation["description"] = "Requires an API key with the " + op.Scope + " scope."
+			operation["security"] = []any{map[string]any{"apiKey": []any{}}}
+		} else {
+			operation["security"] = []any{}
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "fritzdyn API",
+			"version": "1",
+		},
+		"servers": []any{map[string]any{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}, nil
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// schemaFor returns the JSON schema of values of type t as encoded by
+// encoding/json. Named structs are added to schemas and referenced.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[json.RawMessage]():
+		return map[string]any{"description": "Any JSON value."}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaFor(t.Elem(), schemas)
+		if _, ref := schema["$ref"]; !ref {
+			schema["nullable"] = true
+		}
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; ok && t.Name() != "" {
+			return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		}
+		properties := make(map[string]any)
+		var required []string
+		schema := map[string]any{"type": "object", "properties": properties}
+		if t.Name() != "" {
+			// Register before descending, so recursive types terminate.
+			schemas[t.Name()] = schema
+		}
+		for field := range t.Fields() {
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type, schemas)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		if required != nil {
+			schema["required"] = required
+		}
+		if t.Name() != "" {
+			return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		}
+		return schema
+	}
+	return map[string]any{}
+}
@@ -8,8 +8,10 @@ import (
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
@@ -56,7 +58,16 @@ func setupOTEL(ctx context.Context) (shutdown func(context.Context) error, prop
 	shutdownFuncs = append(shutdownFuncs, tracerProvider.Shutdown)
 	otel.SetTracerProvider(tracerProvider)
 
-	// Instrument the default transport so that all clients (including libdns/cloudflare) are instrumented
+	// Set up meter provider.
+	meterProvider, err := newMeterProvider(ctx)
+	if err != nil {
+		handleErr(err)
+		return
+	}
+	shutdownFuncs = append(shutdownFuncs, meterProvider.Shutdown)
+	otel.SetMeterProvider(meterProvider)
+
+	// Instrument the default transport so that all clients (including the Cloudflare client) are instrumented
 	oldTransport := http.DefaultTransport
 	http.DefaultTransport = otelhttp.NewTransport(oldTransport)
 	shutdownFuncs = append(shutdownFuncs, func(context.Context) error {
@@ -74,19 +85,23 @@ func newPropagator() propagation.TextMapPropagator {
 	)
 }
 
-func newTraceProvider(ctx context.Context) (*trace.TracerProvider, error) {
-	traceExporter, err := otlptracehttp.New(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	res, err := resource.Merge(
+func newResource() (*resource.Resource, error) {
+	return resource.Merge(
 		resource.NewWithAttributes(
 			"",
 			semconv.ServiceName("fritzdyn"), // Fallback service name
 		),
 		resource.Default(), // Contains OTEL_SERVICE_NAME if set
 	)
+}
+
+func newTraceProvider(ctx context.Context) (*trace.TracerProvider, error) {
+	traceExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource()
 	if err != nil {
 		return nil, err
 	}
@@ -97,3 +112,21 @@ func newTraceProvider(ctx context.Context) (*trace.TracerProvider, error) {
 	)
 	return traceProvider, nil
 }
+
+func newMeterProvider(ctx context.Context) (*sdkmetric.MeterProvider, error) {
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource()
+	if err != nil {
+		return nil, err
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+		sdkmetric.WithResource(res),
+	)
+	return meterProvider, nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Job is a pending execution of an update method, created whenever the
+// addresses of a host change.
+type Job struct {
+	Id         int64
+	UpdateId   int64   `db:"update_id"`
+	HostId     int64   `db:"host_id"`
+	RecordId   *int64  `db:"record_id"`
+	DeviceId   *int64  `db:"device_id"`
+	OldIp4addr *string `db:"old_ip4addr"`
+	OldIp6addr *string `db:"old_ip6addr"`
+	Form       string
+	Attempts   int
+	NextRun    time.Time `db:"next_run"`
+	LastError  *string   `db:"last_error"`
+	State      string
+	Modified   time.Time
+	Created    time.Time
+}
+
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobFailed  = "failed"
+)
+
+// Queue runs the update methods of changed hosts outside of the request
+// that reported the change. Jobs are stored in the jobs table, so they
+// survive restarts, and failed jobs are retried with exponential backoff.
+type Queue struct {
+	DB           *sqlx.DB
+	Workers      int
+	MaxAttempts  int
+	RetryBase    time.Duration
+	RetryMax     time.Duration
+	PollInterval time.Duration
+	wake         chan struct{}
+}
+
+func NewQueue(db *sqlx.DB) *Queue {
+	q := &Queue{
+		DB:           db,
+		Workers:      4,
+		MaxAttempts:  10,
+		RetryBase:    30 * time.Second,
+		RetryMax:     time.Hour,
+		PollInterval: 10 * time.Second,
+		wake:         make(chan struct{}, 1),
+	}
+	if n, err := strconv.Atoi(os.Getenv("UPDATE_WORKERS")); err == nil && n > 0 {
+		q.Workers = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("UPDATE_MAX_ATTEMPTS")); err == nil && n > 0 {
+		q.MaxAttempts = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("UPDATE_RETRY_BASE")); err == nil && d > 0 {
+		q.RetryBase = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("UPDATE_RETRY_MAX")); err == nil && d > 0 {
+		q.RetryMax = d
+	}
+	return q
+}
+
+// Enqueue adds a job for every enabled update method of host inside tx. The host
+// passed in carries the addresses before the change, the update methods
+// will see the addresses current at the time they run. A job still waiting
+// for the same update method is replaced, the new job keeps the addresses
+// before the change of the replaced one, as the provider has not seen the
+// change in between. The update methods of the host are queued once for
+// the host and once for every record inheriting them, those of a record
+// once for the record. Credentials in form are not stored with the jobs.
+func (q *Queue) Enqueue(ctx context.Context, tx *sqlx.Tx, old *Host, form url.Values) error {
+	var last int64
+	err := tx.GetContext(ctx, &last, "SELECT COALESCE(MAX(id), 0) FROM jobs")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO jobs (update_id, host_id, record_id, old_ip4addr, old_ip6addr, form)
+		SELECT u.id, u.host_id, t.id, IIF(p.id IS NULL, ?1, p.old_ip4addr), IIF(p.id IS NULL, ?2, p.old_ip6addr), ?3
+		FROM updates u
+		JOIN (SELECT NULL AS id, NULL AS inherit UNION ALL SELECT id, inherit FROM host_records WHERE host_id = ?4) t
+		ON (u.record_id IS NULL AND (t.id IS NULL OR t.inherit)) OR u.record_id = t.id
+		LEFT JOIN jobs p ON p.update_id = u.id AND p.record_id IS t.id AND p.device_id IS NULL AND p.state = ?5
+		WHERE u.host_id = ?4 AND u.enabled ORDER BY t.id IS NOT NULL, t.id, u.position, u.id`,
+		old.Ip4addr, old.Ip6addr, jobForm(form).Encode(), old.Id, jobPending)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM jobs WHERE host_id = ? AND device_id IS NULL AND state = ? AND id <= ?",
+		old.Id, jobPending, last)
+	return err
+}
+
+// credentialParams are the request parameters jobForm leaves out.
+var credentialParams = []string{"token", "password", "pass"}
+
+// jobForm returns a copy of the request form without the credentials, as
+// jobs are kept in the database and their form is passed to templates.
+func jobForm(form url.Values) url.Values {
+	form = maps.Clone(form)
+	for _, name := range credentialParams {
+		form.Del(name)
+	}
+	return form
+}
+
+// EnqueueDevice adds a job for every enabled update method of host for
+// its LAN device dev inside tx. old is the address of the device before
+// the change. A job still waiting for the device is replaced, keeping the
+// address before the change of the replaced job like Enqueue.
+func (q *Queue) EnqueueDevice(ctx context.Context, tx *sqlx.Tx, host *Host, dev *LanDevice, old *string) error {
+	var last int64
+	err := tx.GetContext(ctx, &last, "SELECT COALESCE(MAX(id), 0) FROM jobs")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO jobs (update_id, host_id, device_id, old_ip6addr, form)
+		SELECT u.id, u.host_id, ?1, IIF(p.id IS NULL, ?2, p.old_ip6addr), ?3 FROM updates u
+		LEFT JOIN jobs p ON p.update_id = u.id AND p.device_id = ?1 AND p.state = ?5
+		WHERE u.host_id = ?4 AND u.record_id IS NULL AND u.enabled ORDER BY u.position, u.id`,
+		dev.Id, old, hostForm(dev.Host(host)).Encode(), host.Id, jobPending)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM jobs WHERE device_id = ? AND state = ? AND id <= ?", dev.Id, jobPending, last)
+	return err
+}
+
+// Notify wakes up a waiting worker.
+func (q *Queue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the worker pool and blocks until ctx is cancelled and all
+// workers are finished. Jobs left running by a previous instance are
+// rescheduled first.
+func (q *Queue) Run(ctx context.Context) {
+	_, err := q.DB.ExecContext(ctx, "UPDATE jobs SET state = ? WHERE state = ?", jobPending, jobRunning)
+	if err != nil {
+		slog.ErrorContext(ctx, "reset running jobs", "err", err)
+	}
+	var wg sync.WaitGroup
+	for range q.Workers {
+		wg.Go(func() {
+			q.worker(ctx)
+		})
+	}
+	q.Notify()
+	wg.Wait()
+}
+
+// Drain runs all jobs that are due once and returns. It is used by the CGI
+// build, where no process lives long enough to wait for retries. Jobs that
+// have been running for a long time are considered abandoned by a crashed
+// invocation and are rescheduled.
+func (q *Queue) Drain(ctx context.Context) error {
+	_, err := q.DB.ExecContext(ctx, "UPDATE jobs SET state = ? WHERE state = ? AND modified < DATETIME('now', '-10 minutes')", jobPending, jobRunning)
+	if err != nil {
+		return err
+	}
+	for {
+		job, err := q.claim(ctx)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return nil
+		}
+		q.process(ctx, job)
+	}
+}
+
+func (q *Queue) worker(ctx context.Context) {
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := q.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "claim job", "err", err)
+		}
+		if job != nil {
+			// There might be more work, let another worker look.
+			q.Notify()
+			q.process(ctx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim marks the next due job as running and returns it, or nil if there
+// is nothing to do.
+func (q *Queue) claim(ctx context.Context) (*Job, error) {
+	var job Job
+	err := q.DB.GetContext(ctx, &job, `UPDATE jobs SET state = ?, attempts = attempts + 1
+		WHERE id = (SELECT id FROM jobs WHERE state = ? AND next_run <= DATETIME('now') ORDER BY next_run, id LIMIT 1)
+		RETURNING *`, jobRunning, jobPending)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *Queue) process(ctx context.Context, job *Job) {
+	err := q.execute(ctx, job)
+	if err == nil {
+		_, err = q.DB.ExecContext(ctx, "DELETE FROM jobs WHERE id = ?", job.Id)
+		if err != nil {
+			slog.ErrorContext(ctx, "delete job", "job", job.Id, "err", err)
+		}
+		return
+	}
+	msg := err.Error()
+	if job.Attempts >= q.MaxAttempts {
+		slog.ErrorContext(ctx, "update failed permanently", "job", job.Id, "update", job.UpdateId, "attempts", job.Attempts, "err", err)
+		_, err = q.DB.ExecContext(ctx, "UPDATE jobs SET state = ?, last_error = ? WHERE id = ?", jobFailed, msg, job.Id)
+	} else {
+		delay := q.backoff(job.Attempts)
+		slog.WarnContext(ctx, "update failed, retrying", "job", job.Id, "update", job.UpdateId, "attempts", job.Attempts, "delay", delay, "err", err)
+		_, err = q.DB.ExecContext(ctx, "UPDATE jobs SET state = ?, last_error = ?, next_run = DATETIME('now', ?) WHERE id = ?",
+			jobPending, msg, strconv.Itoa(int(delay/time.Second))+" seconds", job.Id)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "reschedule job", "job", job.Id, "err", err)
+	}
+}
+
+// backoff returns the delay before the next attempt after the given number
+// of failed attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.RetryBase
+	for i := 1; i < attempts && delay < q.RetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, q.RetryMax)
+}
+
+// execute runs the update method of job against the current state of its
+// host.
+func (q *Queue) execute(ctx context.Context, job *Job) error {
+	var host Host
+	err := q.DB.GetContext(ctx, &host, "SELECT * FROM hosts WHERE id = ?", job.HostId)
+	if err != nil {
+		return err
+	}
+	var u Update
+	err = q.DB.GetContext(ctx, &u, "SELECT * FROM updates WHERE id = ?", job.UpdateId)
+	if err != nil {
+		return err
+	}
+	if !u.Enabled {
+		// Disabled after the job was queued.
+		slog.InfoContext(ctx, "skip disabled update", "job", job.Id, "update", u.Id)
+		return nil
+	}
+	form, err := url.ParseQuery(job.Form)
+	if err != nil {
+		return err
+	}
+	target := &host
+	switch {
+	case job.DeviceId != nil:
+		dev, err := lanDevice(ctx, q.DB, *job.DeviceId)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted after the job was queued.
+			slog.InfoContext(ctx, "skip deleted LAN device", "job", job.Id, "device", *job.DeviceId)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target = dev.Host(&host)
+	case job.RecordId != nil:
+		rec, err := hostRecord(ctx, q.DB, *job.RecordId)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted after the job was queued.
+			slog.InfoContext(ctx, "skip deleted record", "job", job.Id, "record", *job.RecordId)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target = rec.Host(&host)
+	}
+	old := *target
+	old.Ip4addr = job.OldIp4addr
+	old.Ip6addr = job.OldIp6addr
+	_, err = applyUpdate(ctx, q.DB, target, &u, &old, form, false)
+	return err
+}
+
+// hostForm returns the form values a FRITZ!Box would send for the current
+// addresses of host, except for the token that is only stored hashed.
+func hostForm(host *Host) url.Values {
+	form := url.Values{
+		"domain": {host.Domain},
+	}
+	if host.Ip4addr != nil {
+		form.Set("ipaddr", *host.Ip4addr)
+	}
+	if host.Ip6addr != nil {
+		form.Set("ip6addr", *host.Ip6addr)
+	}
+	return form
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	q := &Queue{RetryBase: 30 * time.Second, RetryMax: 5 * time.Minute}
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	} {
+		if got := q.backoff(tc.attempts); got != tc.want {
+			t.Errorf("attempt %d: got %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+// enqueue queues the update methods of host for a change from old inside
+// a transaction.
+func enqueue(t *testing.T, q *Queue, old *Host) {
+	t.Helper()
+	ctx := context.Background()
+	tx, err := q.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := q.Enqueue(ctx, tx, old, url.Values{"token": {testToken}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnqueueReplaces(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	q := NewQueue(db)
+	host := newTestHost(t, db, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	_, err := db.ExecContext(ctx, `INSERT INTO host_records (host_id, domain, zone) VALUES (?1, 'www.example.org', 'example.org');
+		INSERT INTO updates (host_id, cmd, args) VALUES (?1, 'GET', 'https://example.org/')`, host.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two changes before the jobs ran, the first from 192.0.2.1 to
+	// 192.0.2.2, the second on to 192.0.2.3.
+	enqueue(t, q, &Host{Id: host.Id, Ip4addr: optional("192.0.2.1")})
+	enqueue(t, q, &Host{Id: host.Id, Ip4addr: optional("192.0.2.2"), Ip6addr: optional("2001:db8::2")})
+	var jobs []Job
+	if err := db.SelectContext(ctx, &jobs, "SELECT * FROM jobs ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want one for the host and one for the record", len(jobs))
+	}
+	for _, job := range jobs {
+		if deref(job.OldIp4addr) != "192.0.2.1" || job.OldIp6addr != nil {
+			t.Errorf("job for record %v: got old addresses %s %s, want those before the first change",
+				job.RecordId, deref(job.OldIp4addr), deref(job.OldIp6addr))
+		}
+		if job.Form != "" {
+			t.Errorf("job for record %v: got form %q, want the token dropped", job.RecordId, job.Form)
+		}
+	}
+	// A job already running is not replaced, the next one starts from
+	// the addresses it was queued with.
+	_, err = db.ExecContext(ctx, "UPDATE jobs SET state = ?", jobRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, q, &Host{Id: host.Id, Ip4addr: optional("192.0.2.3")})
+	var pending []Job
+	if err := db.SelectContext(ctx, &pending, "SELECT * FROM jobs WHERE state = ?", jobPending); err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || deref(pending[0].OldIp4addr) != "192.0.2.3" {
+		t.Errorf("got %d pending jobs, want 2 from 192.0.2.3", len(pending))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	q := NewQueue(db)
+	q.MaxAttempts = 2
+	q.RetryBase = time.Minute
+	host := newTestHost(t, db, Host{Name: "home", Domain: "home.example.org", Zone: "example.org"}, testToken)
+	// An update method without updater fails every attempt.
+	_, err := db.ExecContext(ctx, "INSERT INTO updates (host_id, cmd, args) VALUES (?, 'broken', '')", host.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, q, &Host{Id: host.Id})
+	job := func() (job Job, delay int) {
+		t.Helper()
+		err := db.GetContext(ctx, &job, "SELECT * FROM jobs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.GetContext(ctx, &delay, "SELECT UNIXEPOCH(next_run) - UNIXEPOCH('now') FROM jobs")
+		return job, delay
+	}
+	if err := q.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, delay := job()
+	if got.State != jobPending || got.Attempts != 1 || got.LastError == nil || delay < 55 || delay > 60 {
+		t.Fatalf("got %s after %d attempts, retry in %ds, want pending with a retry in a minute", got.State, got.Attempts, delay)
+	}
+	// Not due yet.
+	if err := q.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = job(); got.Attempts != 1 {
+		t.Errorf("got %d attempts, want the retry to wait", got.Attempts)
+	}
+	// Left running by a crashed invocation. The trigger would keep
+	// modified current.
+	_, err = db.ExecContext(ctx, `DROP TRIGGER jobs_update;
+		UPDATE jobs SET state = ?, next_run = DATETIME('now', '-1 minute'), modified = DATETIME('now', '-5 minutes')`, jobRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = job(); got.State != jobRunning || got.Attempts != 1 {
+		t.Errorf("got %s after %d attempts, want a recently running job left alone", got.State, got.Attempts)
+	}
+	_, err = db.ExecContext(ctx, "UPDATE jobs SET modified = DATETIME('now', '-11 minutes')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = job(); got.State != jobFailed || got.Attempts != 2 {
+		t.Errorf("got %s after %d attempts, want the abandoned job run again and failed", got.State, got.Attempts)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// driftUnknown is the source of hosts whose records cannot be read, see
+// errNoLookup.
+const driftUnknown = "unknown"
+
+// errNoLookup is returned by lookup for hosts that have no update method
+// implementing RecordLookuper and whose zone has no name servers to ask.
+var errNoLookup = errors.New("no update method reads the records back and the zone has no name servers")
+
+// HostDrift is the result of the last drift check of a host.
+type HostDrift struct {
+	HostId int64 `db:"host_id"`
+	// Checked is the time of the check.
+	Checked time.Time
+	// Source describes where the published records were read from.
+	Source string
+	// Published lists the records found, e.g. "A 192.0.2.1, AAAA 2001:db8::1".
+	Published string
+	// Drift is set if the published records did not match the host.
+	Drift bool
+	Error *string
+	// Since is the first check that found the current drift.
+	Since *time.Time
+}
+
+// Unknown reports whether the records of the host could not be read at
+// all, so whether it drifted is unknown.
+func (d *HostDrift) Unknown() bool {
+	return d.Source == driftUnknown
+}
+
+// Reconciler periodically compares the published DNS records of all hosts
+// with their addresses in the hosts table and runs the update methods of
+// hosts that drifted apart again. The records are read through the first
+// update method that implements RecordLookuper, otherwise they are queried
+// from DNS.
+type Reconciler struct {
+	DB    *sqlx.DB
+	Queue *Queue
+	// Interval between checks, the reconciler is disabled if it is zero.
+	Interval time.Duration
+	// Resolver is the DNS server, host:port, to query. If it is empty, the
+	// name servers of the zone are queried directly.
+	Resolver string
+	// Timeout for a single lookup.
+	Timeout time.Duration
+}
+
+func NewReconciler(db *sqlx.DB, queue *Queue) *Reconciler {
+	r := &Reconciler{
+		DB:       db,
+		Queue:    queue,
+		Resolver: os.Getenv("RECONCILE_RESOLVER"),
+		Timeout:  10 * time.Second,
+	}
+	if d, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil && d > 0 {
+		r.Interval = d
+	}
+	if r.Resolver != "" {
+		if _, _, err := net.SplitHostPort(r.Resolver); err != nil {
+			r.Resolver = net.JoinHostPort(r.Resolver, "53")
+		}
+	}
+	return r
+}
+
+// Run checks all hosts every Interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.Interval <= 0 {
+		return
+	}
+	slog.InfoContext(ctx, "drift reconciler started", "interval", r.Interval, "resolver", r.Resolver)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.CheckAll(ctx)
+		}
+	}
+}
+
+// CheckAll checks every host with a domain and zone. Hosts that changed
+// within the last interval are skipped, their records might still be on
+// their way.
+func (r *Reconciler) CheckAll(ctx context.Context) {
+	var hosts []Host
+	err := r.DB.SelectContext(ctx, &hosts, "SELECT * FROM hosts WHERE domain != '' AND zone != ''")
+	if err != nil {
+		slog.ErrorContext(ctx, "reconcile select hosts", "err", err)
+		return
+	}
+	for _, host := range hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(host.Modified) < r.Interval {
+			continue
+		}
+		r.Check(ctx, &host)
+	}
+}
+
+// Check compares the published records of host with its addresses, records
+// the result and queues the update methods of the host on drift. Hosts
+// whose records cannot be read are recorded as unknown and left alone.
+func (r *Reconciler) Check(ctx context.Context, host *Host) {
+	drift := HostDrift{HostId: host.Id, Checked: time.Now().UTC()}
+	published, source, err := r.lookup(ctx, host)
+	drift.Source = source
+	drift.Published = formatPublished(published)
+	if err != nil {
+		msg := err.Error()
+		drift.Error = &msg
+	}
+	switch {
+	case errors.Is(err, errNoLookup):
+		slog.InfoContext(ctx, "drift unknown", "host", host.Name, "err", err)
+	case err != nil:
+		slog.WarnContext(ctx, "drift check failed", "host", host.Name, "source", source, "err", err)
+	default:
+		drift.Drift = !matchesPublished(host, published)
+	}
+	driftChecks.Add(ctx, 1)
+	_, err = r.DB.NamedExecContext(ctx, `INSERT INTO host_drift (host_id, checked, source, published, drift, error, since)
+		VALUES (:host_id, :checked, :source, :published, :drift, :error, CASE WHEN :drift THEN :checked END)
+		ON CONFLICT (host_id) DO UPDATE SET checked = excluded.checked, source = excluded.source,
+			published = excluded.published, drift = excluded.drift, error = excluded.error,
+			since = CASE WHEN NOT excluded.drift THEN NULL WHEN host_drift.drift THEN host_drift.since ELSE excluded.checked END`, drift)
+	if err != nil {
+		slog.ErrorContext(ctx, "record drift", "host", host.Name, "err", err)
+	}
+	if !drift.Drift {
+		return
+	}
+	driftDetected.Add(ctx, 1, metric.WithAttributes(attribute.String("host", host.Name)))
+	slog.WarnContext(ctx, "DNS drift", "host", host.Name, "domain", host.Domain, "source", source,
+		"published", drift.Published, "ip4addr", host.Ip4addr, "ip6addr", host.Ip6addr)
+	err = r.retrigger(ctx, host)
+	if err != nil {
+		slog.ErrorContext(ctx, "retrigger updates", "host", host.Name, "err", err)
+	}
+}
+
+// retrigger queues all update methods of host, unless some are queued
+// already.
+func (r *Reconciler) retrigger(ctx context.Context, host *Host) error {
+	tx, err := r.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var queued int
+	err = tx.GetContext(ctx, &queued, "SELECT COUNT(*) FROM jobs WHERE host_id = ? AND state IN (?, ?)", host.Id, jobPending, jobRunning)
+	if err != nil {
+		return err
+	}
+	if queued > 0 {
+		slog.InfoContext(ctx, "updates already queued", "host", host.Name, "jobs", queued)
+		return nil
+	}
+	err = r.Queue.Enqueue(ctx, tx, host, hostForm(host))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	r.Queue.Notify()
+	return nil
+}
+
+// lookup returns the published records of host by record type and where
+// they were read from. Only the domain of the host itself is checked, not
+// those of its records.
+func (r *Reconciler) lookup(ctx context.Context, host *Host) (map[string][]string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	var updates []Update
+	err := r.DB.SelectContext(ctx, &updates, "SELECT * FROM updates WHERE host_id = ? AND record_id IS NULL AND enabled ORDER BY position, id", host.Id)
+	if err != nil {
+		return nil, "database", err
+	}
+	for _, u := range updates {
+		updater, err := LookupUpdater(u.Cmd)
+		if err != nil {
+			continue
+		}
+		if lookuper, ok := updater.(RecordLookuper); ok {
+			published, err := lookuper.Lookup(ctx, host, &u)
+			return published, fmt.Sprintf("#%d %s", u.Id, u.Cmd), err
+		}
+	}
+	servers := []string{r.Resolver}
+	if r.Resolver == "" {
+		nss, err := net.DefaultResolver.LookupNS(ctx, host.Zone)
+		if err != nil {
+			return nil, driftUnknown, fmt.Errorf("%w: %w", errNoLookup, err)
+		}
+		if len(nss) == 0 {
+			return nil, driftUnknown, errNoLookup
+		}
+		servers = servers[:0]
+		for _, ns := range nss {
+			servers = append(servers, net.JoinHostPort(strings.TrimSuffix(ns.Host, "."), "53"))
+		}
+	}
+	var errs []error
+	for _, server := range servers {
+		published, err := r.query(ctx, server, host.Domain)
+		if err == nil {
+			return published, "dns " + server, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	return nil, "dns", errors.Join(errs...)
+}
+
+// query asks server for the A and AAAA records of name. Name servers of
+// the zone are asked without recursion.
+func (r *Reconciler) query(ctx context.Context, server, name string) (map[string][]string, error) {
+	client := &dns.Client{Timeout: r.Timeout}
+	published := make(map[string][]string)
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), rrtype)
+		msg.RecursionDesired = r.Resolver != ""
+		res, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			return nil, err
+		}
+		if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("query %s %s: %s", name, dns.TypeToString[rrtype], dns.RcodeToString[res.Rcode])
+		}
+		rtype := dns.TypeToString[rrtype]
+		published[rtype] = []string{}
+		for _, rr := range res.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				published[rtype] = append(published[rtype], rr.A.String())
+			case *dns.AAAA:
+				published[rtype] = append(published[rtype], rr.AAAA.String())
+			}
+		}
+	}
+	return published, nil
+}
+
+// matchesPublished reports whether every record type in published holds
+// exactly the address of host of that family, or nothing if the host has
+// none.
+func matchesPublished(host *Host, published map[string][]string) bool {
+	for rtype, addrs := range published {
+		want := host.Ip4addr
+		if rtype == "AAAA" {
+			want = host.Ip6addr
+		}
+		var got []netip.Addr
+		for _, s := range addrs {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return false
+			}
+			got = append(got, addr.Unmap())
+		}
+		got = slices.Compact(slices.SortedFunc(slices.Values(got), netip.Addr.Compare))
+		if want == nil {
+			if len(got) > 0 {
+				return false
+			}
+			continue
+		}
+		addr, err := netip.ParseAddr(*want)
+		if err != nil || len(got) != 1 || got[0] != addr.Unmap() {
+			return false
+		}
+	}
+	return true
+}
+
+func formatPublished(published map[string][]string) string {
+	var parts []string
+	for _, rtype := range []string{"A", "AAAA"} {
+		addrs, ok := published[rtype]
+		if !ok {
+			continue
+		}
+		if len(addrs) == 0 {
+			parts = append(parts, rtype+" -")
+		}
+		for _, addr := range addrs {
+			parts = append(parts, rtype+" "+addr)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// hostDrift returns the last drift check of the host with id, or nil if
+// there was none.
+func hostDrift(ctx context.Context, db *sqlx.DB, id int64) (*HostDrift, error) {
+	var drift HostDrift
+	err := db.GetContext(ctx, &drift, "SELECT * FROM host_drift WHERE host_id = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &drift, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterUpdater(lookupUpdater{})
+}
+
+// testPublished holds the records lookupUpdater reads back by domain.
+var testPublished = map[string]map[string][]string{}
+
+// lookupUpdater publishes nothing and reads the records back from
+// testPublished.
+type lookupUpdater struct{}
+
+func (lookupUpdater) Name() string {
+	return "test-lookup"
+}
+
+func (lookupUpdater) Validate(u *Update) error {
+	return nil
+}
+
+func (lookupUpdater) Apply(ctx context.Context, host *Host, change *Change) error {
+	return nil
+}
+
+func (lookupUpdater) Lookup(ctx context.Context, host *Host, u *Update) (map[string][]string, error) {
+	return testPublished[host.Domain], nil
+}
+
+func TestMatchesPublished(t *testing.T) {
+	host := &Host{Ip4addr: optional("192.0.2.1"), Ip6addr: optional("2001:db8::1")}
+	for _, tc := range []struct {
+		name      string
+		published map[string][]string
+		want      bool
+	}{
+		{"same", map[string][]string{"A": {"192.0.2.1"}, "AAAA": {"2001:db8:0::1"}}, true},
+		{"only A managed", map[string][]string{"A": {"192.0.2.1"}}, true},
+		{"duplicates", map[string][]string{"A": {"192.0.2.1", "192.0.2.1"}}, true},
+		{"other address", map[string][]string{"A": {"192.0.2.2"}}, false},
+		{"additional address", map[string][]string{"A": {"192.0.2.1", "192.0.2.2"}}, false},
+		{"missing", map[string][]string{"AAAA": {}}, false},
+		{"garbage", map[string][]string{"A": {"home"}}, false},
+	} {
+		if got := matchesPublished(host, tc.published); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if !matchesPublished(&Host{}, map[string][]string{"A": {}, "AAAA": {}}) {
+		t.Error("no records for a host without addresses do not match")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	r := NewReconciler(db, NewQueue(db))
+	r.Resolver = ""
+	r.Timeout = 5 * time.Second
+	match := newTestHost(t, db, Host{Name: "match", Domain: "match.example.org", Zone: "example.org",
+		Ip4addr: optional("192.0.2.1")}, "")
+	drifted := newTestHost(t, db, Host{Name: "drifted", Domain: "drifted.example.org", Zone: "example.org",
+		Ip4addr: optional("192.0.2.2")}, "")
+	unknown := newTestHost(t, db, Host{Name: "unknown", Domain: "nas.fritzdyn.invalid", Zone: "fritzdyn.invalid",
+		Ip4addr: optional("192.0.2.3")}, "")
+	_, err := db.ExecContext(ctx, `INSERT INTO updates (host_id, cmd, args) VALUES
+		(?1, 'test-lookup', ''), (?2, 'GET', 'https://example.org/'), (?2, 'test-lookup', ''), (?3, 'GET', 'https://example.org/')`,
+		match.Id, drifted.Id, unknown.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPublished = map[string]map[string][]string{
+		"match.example.org":   {"A": {"192.0.2.1"}},
+		"drifted.example.org": {"A": {"192.0.2.9"}},
+	}
+	t.Cleanup(func() { testPublished = map[string]map[string][]string{} })
+	jobs := func() map[int64]int {
+		t.Helper()
+		var rows []struct {
+			HostId int64 `db:"host_id"`
+			N      int
+		}
+		err := db.SelectContext(ctx, &rows, "SELECT host_id, COUNT(*) AS n FROM jobs GROUP BY host_id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs := make(map[int64]int)
+		for _, row := range rows {
+			jobs[row.HostId] = row.N
+		}
+		return jobs
+	}
+	for _, check := range []string{"first", "second"} {
+		r.CheckAll(ctx)
+		for _, tc := range []struct {
+			host        *Host
+			wantDrift   bool
+			wantUnknown bool
+			wantSource  string
+			wantJobs    int
+		}{
+			{host: match, wantSource: "#1 test-lookup"},
+			{host: drifted, wantDrift: true, wantSource: "#3 test-lookup", wantJobs: 2},
+			{host: unknown, wantUnknown: true, wantSource: driftUnknown},
+		} {
+			drift, err := hostDrift(ctx, db, tc.host.Id)
+			if err != nil || drift == nil {
+				t.Fatalf("%s check, %s: got %v, %v, want a drift check", check, tc.host.Name, drift, err)
+			}
+			if drift.Drift != tc.wantDrift || drift.Unknown() != tc.wantUnknown || drift.Source != tc.wantSource ||
+				(drift.Since != nil) != tc.wantDrift {
+				t.Errorf("%s check, %s: got drift %v since %v, unknown %v from %q, want drift %v, unknown %v from %q", check,
+					tc.host.Name, drift.Drift, drift.Since, drift.Unknown(), drift.Source, tc.wantDrift, tc.wantUnknown, tc.wantSource)
+			}
+			// Queued once, not again while the jobs are waiting.
+			if n := jobs()[tc.host.Id]; n != tc.wantJobs {
+				t.Errorf("%s check, %s: got %d jobs, want %d", check, tc.host.Name, n, tc.wantJobs)
+			}
+		}
+	}
+}
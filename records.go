@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errRecordExists = errors.New("domain is already a record of the host")
+	errNoDomain     = errors.New("domain is required")
+)
+
+// HostRecord is a further DNS name published with the addresses of a host,
+// e.g. a second name in another zone. It is updated by its own update
+// methods and, if Inherit is set, by those of the host as well.
+type HostRecord struct {
+	Id       int64
+	HostId   int64 `db:"host_id"`
+	Domain   string
+	Zone     string
+	Inherit  bool
+	Modified time.Time
+	Created  time.Time
+}
+
+// Host returns host as the update methods of the record see it: with the
+// domain and zone of the record. An empty zone is taken from the host.
+func (rec *HostRecord) Host(host *Host) *Host {
+	h := *host
+	h.Domain = rec.Domain
+	if rec.Zone != "" {
+		h.Zone = rec.Zone
+	}
+	return &h
+}
+
+// hostRecords returns the records of the host with id, sorted by domain.
+func hostRecords(ctx context.Context, q sqlx.QueryerContext, id int64) ([]HostRecord, error) {
+	var recs []HostRecord
+	err := sqlx.SelectContext(ctx, q, &recs, "SELECT * FROM host_records WHERE host_id = ? ORDER BY domain", id)
+	return recs, err
+}
+
+// hostRecord returns the record with id. It returns sql.ErrNoRows if there
+// is no such record.
+func hostRecord(ctx context.Context, q sqlx.QueryerContext, id int64) (*HostRecord, error) {
+	var rec HostRecord
+	err := sqlx.GetContext(ctx, q, &rec, "SELECT * FROM host_records WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// insertRecord adds rec to its host and fills in the columns set by the
+// database. The domain of the host itself can not be added again.
+func insertRecord(ctx context.Context, db *sqlx.DB, rec *HostRecord) error {
+	rec.Domain = strings.TrimSpace(rec.Domain)
+	rec.Zone = strings.TrimSpace(rec.Zone)
+	if rec.Domain == "" {
+		return errNoDomain
+	}
+	var taken bool
+	err := db.GetContext(ctx, &taken, `SELECT EXISTS (SELECT 1 FROM hosts WHERE id = ? AND domain = ?)
+		OR EXISTS (SELECT 1 FROM host_records WHERE host_id = ? AND domain = ?)`,
+		rec.HostId, rec.Domain, rec.HostId, rec.Domain)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errRecordExists
+	}
+	return db.GetContext(ctx, rec, `INSERT INTO host_records (host_id, domain, zone, inherit)
+		VALUES (?, ?, ?, ?) RETURNING *`, rec.HostId, rec.Domain, rec.Zone, rec.Inherit)
+}
+
+// saveRecord stores the zone and inherit setting of rec.
+func saveRecord(ctx context.Context, db *sqlx.DB, rec *HostRecord) error {
+	rec.Zone = strings.TrimSpace(rec.Zone)
+	return db.GetContext(ctx, rec, "UPDATE host_records SET zone = ?, inherit = ? WHERE id = ? RETURNING *",
+		rec.Zone, rec.Inherit, rec.Id)
+}
+
+// deleteRecord removes the record with id together with its update
+// methods, their runs and pending jobs.
+func deleteRecord(ctx context.Context, db *sqlx.DB, id int64) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"DELETE FROM jobs WHERE record_id = ?1 OR update_id IN (SELECT id FROM updates WHERE record_id = ?1)",
+		"DELETE FROM update_runs WHERE update_id IN (SELECT id FROM updates WHERE record_id = ?1)",
+		"DELETE FROM updates WHERE record_id = ?1",
+		"DELETE FROM host_records WHERE id = ?1",
+	} {
+		_, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// servesDomain reports whether domain is the domain of host or of one of
+// its records.
+func servesDomain(ctx context.Context, q sqlx.QueryerContext, host *Host, domain string) (bool, error) {
+	if domain == host.Domain {
+		return true, nil
+	}
+	var found bool
+	err := sqlx.GetContext(ctx, q, &found, "SELECT EXISTS (SELECT 1 FROM host_records WHERE host_id = ? AND domain = ?)",
+		host.Id, domain)
+	return found, err
+}
+
+// updateTargets returns the hosts u is applied to: for an update method of
+// a record the host as seen by the record, otherwise the host itself and
+// the records inheriting its update methods.
+func updateTargets(ctx context.Context, q sqlx.QueryerContext, host *Host, u *Update) ([]*Host, error) {
+	if u.RecordId != nil {
+		rec, err := hostRecord(ctx, q, *u.RecordId)
+		if err != nil {
+			return nil, err
+		}
+		return []*Host{rec.Host(host)}, nil
+	}
+	recs, err := hostRecords(ctx, q, host.Id)
+	if err != nil {
+		return nil, err
+	}
+	targets := []*Host{host}
+	for _, rec := range recs {
+		if rec.Inherit {
+			targets = append(targets, rec.Host(host))
+		}
+	}
+	return targets, nil
+}
+
+// checkRecord makes sure the record u is bound to, if any, belongs to the
+// host of u. It returns sql.ErrNoRows if it does not.
+func checkRecord(ctx context.Context, q sqlx.QueryerContext, u *Update) error {
+	if u.RecordId == nil {
+		return nil
+	}
+	rec, err := hostRecord(ctx, q, *u.RecordId)
+	if err != nil {
+		return err
+	}
+	if rec.HostId != u.HostId {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestRecords creates a host with a record inheriting its update
+// methods and one that does not. The host gets update method 1, the
+// records update methods 2 and 3. It returns the host and the records.
+func newTestRecords(t *testing.T, db *sqlx.DB) (*Host, *HostRecord, *HostRecord) {
+	t.Helper()
+	ctx := context.Background()
+	host := newTestHost(t, db, Host{Name: "home", Domain: "home.example.org", Zone: "example.org",
+		Ip4addr: optional("192.0.2.1")}, testToken)
+	inherit := &HostRecord{HostId: host.Id, Domain: "www.example.org", Inherit: true}
+	own := &HostRecord{HostId: host.Id, Domain: "home.example.net", Zone: "example.net"}
+	for _, rec := range []*HostRecord{inherit, own} {
+		if err := insertRecord(ctx, db, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO updates (host_id, record_id, cmd, args) VALUES
+		(?1, NULL, 'GET', 'https://example.org/'), (?1, ?2, 'GET', 'https://example.org/www'),
+		(?1, ?3, 'GET', 'https://example.net/')`,
+		host.Id, inherit.Id, own.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, inherit, own
+}
+
+func TestServesDomain(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	host, _, _ := newTestRecords(t, db)
+	other := newTestHost(t, db, Host{Name: "office", Domain: "office.example.org", Zone: "example.org"}, "")
+	if err := insertRecord(ctx, db, &HostRecord{HostId: other.Id, Domain: "mail.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		domain string
+		want   bool
+	}{
+		{"home.example.org", true},
+		{"www.example.org", true},
+		{"home.example.net", true},
+		{"office.example.org", false},
+		{"mail.example.org", false},
+		{"example.org", false},
+		{"", false},
+	} {
+		got, err := servesDomain(ctx, db, host, tc.domain)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %v, %v, want %v", tc.domain, got, err, tc.want)
+		}
+	}
+}
+
+func TestUpdateTargets(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	host, inherit, _ := newTestRecords(t, db)
+	targets := func(id int64) []string {
+		t.Helper()
+		var u Update
+		if err := db.GetContext(ctx, &u, "SELECT * FROM updates WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+		hosts, err := updateTargets(ctx, db, host, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hosts {
+			got = append(got, h.Domain+" in "+h.Zone)
+			if h.Id != host.Id || deref(h.Ip4addr) != "192.0.2.1" {
+				t.Errorf("update %d: got target %+v, want the addresses of the host", id, h)
+			}
+		}
+		return got
+	}
+	for _, tc := range []struct {
+		update int64
+		want   []string
+	}{
+		// The update methods of the host also update the inheriting
+		// record, which takes the zone of the host.
+		{1, []string{"home.example.org in example.org", "www.example.org in example.org"}},
+		{2, []string{"www.example.org in example.org"}},
+		{3, []string{"home.example.net in example.net"}},
+	} {
+		if got := targets(tc.update); !slices.Equal(got, tc.want) {
+			t.Errorf("update %d: got targets %q, want %q", tc.update, got, tc.want)
+		}
+	}
+	inherit.Inherit = false
+	if err := saveRecord(ctx, db, inherit); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(1); !slices.Equal(got, []string{"home.example.org in example.org"}) {
+		t.Errorf("got targets %q without inheritance, want only the host", got)
+	}
+	if got := targets(2); !slices.Equal(got, []string{"www.example.org in example.org"}) {
+		t.Errorf("got targets %q for the own update method of the record", got)
+	}
+}
+
+func TestDeleteRecord(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	q := NewQueue(db)
+	host, inherit, own := newTestRecords(t, db)
+	enqueue(t, q, &Host{Id: host.Id})
+	_, err := db.ExecContext(ctx, `INSERT INTO update_runs (host_id, update_id, domain, args, started, finished, success)
+		VALUES (?1, 1, 'home.example.org', '', ?2, ?2, 1), (?1, 3, 'home.example.net', '', ?2, ?2, 1)`,
+		host.Id, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteRecord(ctx, db, own.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		what  string
+		query string
+		arg   int64
+		want  int
+	}{
+		{"records", "SELECT COUNT(*) FROM host_records WHERE id = ?", own.Id, 0},
+		{"other records", "SELECT COUNT(*) FROM host_records WHERE id = ?", inherit.Id, 1},
+		{"update methods", "SELECT COUNT(*) FROM updates WHERE record_id = ?", own.Id, 0},
+		{"other update methods", "SELECT COUNT(*) FROM updates WHERE id <> ?", 3, 2},
+		{"runs", "SELECT COUNT(*) FROM update_runs WHERE update_id = ?", 3, 0},
+		{"other runs", "SELECT COUNT(*) FROM update_runs WHERE update_id <> ?", 3, 1},
+		{"jobs", "SELECT COUNT(*) FROM jobs WHERE record_id = ?1 OR update_id = 3", own.Id, 0},
+		{"jobs of the inheriting record", "SELECT COUNT(*) FROM jobs WHERE record_id = ?", inherit.Id, 2},
+	} {
+		var n int
+		if err := db.GetContext(ctx, &n, tc.query, tc.arg); err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.want {
+			t.Errorf("got %d %s, want %d", n, tc.what, tc.want)
+		}
+	}
+}
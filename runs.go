@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxRunOutput limits the output stored for a single run.
+	maxRunOutput = 4096
+	// keepRuns is the number of runs kept per update method.
+	keepRuns = 100
+)
+
+// Run records one execution of an update method.
+type Run struct {
+	Id         int64     `json:"id"`
+	HostId     int64     `db:"host_id" json:"-"`
+	UpdateId   int64     `db:"update_id" json:"update_id"`
+	Domain     string    `json:"domain"`
+	Args       string    `json:"args"`
+	OldIp4addr *string   `db:"old_ip4addr" json:"old_ip4addr"`
+	OldIp6addr *string   `db:"old_ip6addr" json:"old_ip6addr"`
+	Ip4addr    *string   `json:"ip4addr"`
+	Ip6addr    *string   `json:"ip6addr"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Success    bool      `json:"success"`
+	Error      *string   `json:"error"`
+	Status     *int      `json:"status"`
+	Output     string    `json:"output"`
+	Created    time.Time `json:"-"`
+}
+
+// SetOutput stores buf as the output of the run, truncated to maxRunOutput
+// bytes.
+func (r *Run) SetOutput(buf []byte) {
+	if len(buf) > maxRunOutput {
+		buf = buf[:maxRunOutput]
+	}
+	r.Output = string(buf)
+}
+
+// Duration returns how long the run took.
+func (r Run) Duration() time.Duration {
+	return r.Finished.Sub(r.Started).Round(time.Millisecond)
+}
+
+// applyUpdate runs the update method u for host, old holds the addresses
+// before the change. Unless dryRun is set the run is recorded. With dryRun
+// the updater only renders what it would do into the run.
+func applyUpdate(ctx context.Context, db *sqlx.DB, host *Host, u *Update, old *Host, form url.Values, dryRun bool) (*Run, error) {
+	run := Run{
+		HostId:     host.Id,
+		UpdateId:   u.Id,
+		Domain:     host.Domain,
+		OldIp4addr: old.Ip4addr,
+		OldIp6addr: old.Ip6addr,
+		Ip4addr:    host.Ip4addr,
+		Ip6addr:    host.Ip6addr,
+		Started:    time.Now().UTC(),
+	}
+	change := &Change{Update: u, Old: old, Form: form, Run: &run, DryRun: dryRun}
+	updater, err := LookupUpdater(u.Cmd)
+	if err == nil {
+		err = updater.Apply(ctx, host, change)
+	}
+	run.Finished = time.Now().UTC()
+	run.Success = err == nil
+	if err != nil {
+		msg := err.Error()
+		run.Error = &msg
+	}
+	if !dryRun {
+		if rerr := recordRun(ctx, db, &run); rerr != nil {
+			slog.ErrorContext(ctx, "recordRun", "err", rerr)
+		}
+	}
+	return &run, err
+}
+
+// recordRun stores run and drops the oldest runs of the same update method
+// beyond keepRuns.
+func recordRun(ctx context.Context, db *sqlx.DB, run *Run) error {
+	res, err := db.NamedExecContext(ctx, `INSERT INTO update_runs
+		(host_id, update_id, domain, args, old_ip4addr, old_ip6addr, ip4addr, ip6addr, started, finished, success, error, status, output)
+		VALUES (:host_id, :update_id, :domain, :args, :old_ip4addr, :old_ip6addr, :ip4addr, :ip6addr, :started, :finished, :success, :error, :status, :output)`, run)
+	if err != nil {
+		return err
+	}
+	run.Id, _ = res.LastInsertId()
+	_, err = db.ExecContext(ctx, `DELETE FROM update_runs WHERE update_id = ? AND id NOT IN
+		(SELECT id FROM update_runs WHERE update_id = ? ORDER BY id DESC LIMIT ?)`, run.UpdateId, run.UpdateId, keepRuns)
+	return err
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
@@ -75,6 +76,9 @@ func main() {
 	}
 	logger := slog.New(shandler)
 	slog.SetDefault(logger)
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCLI(context.Background(), os.Args[1:]))
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -104,8 +108,25 @@ func main() {
 		os.Exit(1)
 	}
 	defer fh.Close()
-	ah := NewAdminHandler(fh.DB)
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	queueDone := make(chan struct{})
+	go func() {
+		fh.Queue.Run(queueCtx)
+		close(queueDone)
+	}()
+	reconcilerDone := make(chan struct{})
+	go func() {
+		NewReconciler(fh.DB, fh.Queue).Run(queueCtx)
+		close(reconcilerDone)
+	}()
+	staleDone := make(chan struct{})
+	go func() {
+		runStaleChecks(queueCtx, fh.DB)
+		close(staleDone)
+	}()
+	ah := NewAdminHandler(fh.DB, fh.Queue, fh.Limiter)
 	mux.Handle("/admin/", ah)
+	mux.Handle(apiPrefix+"/", NewAPIHandler(fh.DB, fh.Queue))
 	mux.Handle("/", fh)
 	checker := health.NewChecker(
 		health.WithCheck(health.Check{
@@ -120,7 +141,7 @@ func main() {
 		h := handler
 		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			m := httpsnoop.CaptureMetrics(h, w, r)
-			slog.InfoContext(r.Context(), "handled request", "method", r.Method, "URL", r.URL.String(), "status", m.Code, "duration", float64(m.Duration)/float64(time.Second), "size", m.Written)
+			slog.InfoContext(r.Context(), "handled request", "method", r.Method, "URL", redactURL(r.URL), "status", m.Code, "duration", float64(m.Duration)/float64(time.Second), "size", m.Written)
 		})
 	}
 	handler = traceMiddleware(handler)
@@ -136,6 +157,13 @@ func main() {
 		Addr:    addr,
 		Handler: handler,
 	}
+	// With TLS_CERT_FILE and TLS_KEY_FILE the server terminates TLS
+	// itself. Client certificates are requested but not verified against
+	// a CA, a host requiring one is bound to its fingerprint.
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" {
+		srv.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
 	listener, err := net.Listen(network, addr)
 	if err != nil {
 		slog.Error("Listen", "err", err)
@@ -151,7 +179,13 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		if err := srv.Serve(listener); err != nil {
+		var err error
+		if certFile != "" {
+			err = srv.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil {
 			if err != http.ErrServerClosed {
 				slog.Error("Serve", "err", err)
 				os.Exit(1)
@@ -166,4 +200,8 @@ func main() {
 		slog.Error("Shutdown", "err", err)
 		os.Exit(1)
 	}
+	stopQueue()
+	<-queueDone
+	<-reconcilerDone
+	<-staleDone
 }
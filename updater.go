@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Updater is an update method, e.g. a DNS provider. Updaters are
+// registered by name with RegisterUpdater, the name is what is stored in
+// the cmd column of the updates table. Additional updaters can be added
+// from a separate file in package main:
+//
+//	func init() {
+//		RegisterUpdater(myUpdater{})
+//	}
+type Updater interface {
+	// Name returns the name the updater is registered under.
+	Name() string
+	// Validate checks the args, api_key and config of u before it is
+	// stored.
+	Validate(u *Update) error
+	// Apply publishes the current addresses of host. If change.DryRun is
+	// set it must only describe what it would do in change.Run.
+	Apply(ctx context.Context, host *Host, change *Change) error
+}
+
+// RecordLookuper is implemented by updaters that can read the records they
+// manage back from the provider. The drift reconciler prefers it over a DNS
+// query.
+type RecordLookuper interface {
+	// Lookup returns the published addresses of host by record type, "A"
+	// or "AAAA". Types the update method does not manage are left out.
+	Lookup(ctx context.Context, host *Host, u *Update) (map[string][]string, error)
+}
+
+// Change describes the address change an update method is applied for.
+type Change struct {
+	// Update is the update method being applied.
+	Update *Update
+	// Old is the host with the addresses before the change.
+	Old *Host
+	// Form holds the form values of the request that reported the change.
+	Form url.Values
+	// Run records the args, status and output of the execution.
+	Run *Run
+	// DryRun asks the updater to only record what it would do in Run,
+	// without contacting anything.
+	DryRun bool
+}
+
+var (
+	updatersMu sync.RWMutex
+	updaters   = make(map[string]Updater)
+)
+
+// RegisterUpdater makes an updater available under its name. It panics if
+// an updater with the same name is already registered.
+func RegisterUpdater(u Updater) {
+	updatersMu.Lock()
+	defer updatersMu.Unlock()
+	name := u.Name()
+	if _, dup := updaters[name]; dup {
+		panic("RegisterUpdater called twice for " + name)
+	}
+	updaters[name] = u
+}
+
+// LookupUpdater returns the updater registered under name.
+func LookupUpdater(name string) (Updater, error) {
+	updatersMu.RLock()
+	defer updatersMu.RUnlock()
+	u, ok := updaters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown update method %q", name)
+	}
+	return u, nil
+}
+
+// UpdaterNames returns the names of all registered updaters, sorted.
+func UpdaterNames() []string {
+	updatersMu.RLock()
+	defer updatersMu.RUnlock()
+	var names []string
+	for name := range updaters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// validateUpdate checks u against the updater it names.
+func validateUpdate(u *Update) error {
+	upd, err := LookupUpdater(u.Cmd)
+	if err != nil {
+		return err
+	}
+	return upd.Validate(u)
+}
+
+// insertUpdate adds u as the last update method of its host and fills in
+// the columns set by the database.
+func insertUpdate(ctx context.Context, db *sqlx.DB, u *Update) error {
+	var id int64
+	err := db.GetContext(ctx, &id, `INSERT INTO updates (host_id, record_id, cmd, args, api_key, config, enabled, position)
+		SELECT ?, ?, ?, ?, ?, ?, ?, COALESCE(MAX(position), 0) + 1 FROM updates WHERE host_id = ? RETURNING id`,
+		u.HostId, u.RecordId, u.Cmd, u.Args, u.ApiKey, u.Config, u.Enabled, u.HostId)
+	if err != nil {
+		return err
+	}
+	return db.GetContext(ctx, u, "SELECT * FROM updates WHERE id = ?", id)
+}
+
+// deleteUpdate removes the update method with id together with its jobs
+// and runs. Foreign keys are not enforced by every driver, so this does
+// not rely on them cascading. It reports whether there was such a method.
+func deleteUpdate(ctx context.Context, db *sqlx.DB, id int64) (bool, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"DELETE FROM jobs WHERE update_id = ?",
+		"DELETE FROM update_runs WHERE update_id = ?",
+	} {
+		_, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM updates WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// decodeConfig decodes the JSON config of u into cfg. Unknown fields are
+// rejected so that typos do not go unnoticed. A missing config leaves cfg
+// untouched.
+func decodeConfig(u *Update, cfg any) error {
+	if u.Config == nil || strings.TrimSpace(*u.Config) == "" {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(*u.Config))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// checkTemplate reports whether text parses as a template.
+func checkTemplate(name, text string) error {
+	_, err := template.New(name).Parse(text)
+	return err
+}
+
+// Render executes the template text with the data of the change for host.
+// Templates see the host as .Host, the host before the change as .Old, the
+// update method as .Upd and the reporting request as .Req.
+func (c *Change) Render(name, text string, host *Host) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, c.data(host))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderText is like Render, but does not apply HTML escaping to the
+// values. It is used where the result is not interpreted any further, like
+// the argv of a command.
+func (c *Change) RenderText(name, text string, host *Host) (string, error) {
+	tmpl, err := texttemplate.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, c.data(host))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// data returns the values templates see. Update methods run from the job
+// queue, after the reporting request is gone, so .Req is rebuilt from the
+// form stored with the job: it only has Method, URL.RawQuery and Form, the
+// latter without the token and other credentials. Headers, RemoteAddr and
+// the body of the original request are not available.
+func (c *Change) data(host *Host) map[string]any {
+	return map[string]any{
+		"Host": host,
+		"Old":  c.Old,
+		"Upd":  c.Update,
+		"Req":  &http.Request{Method: http.MethodGet, URL: &url.URL{RawQuery: c.Form.Encode()}, Form: c.Form},
+	}
+}
+
+// Args renders the args of the update method and records them in the run.
+func (c *Change) Args(host *Host) (string, error) {
+	args, err := c.Render("args", c.Update.Args, host)
+	if err != nil {
+		return "", err
+	}
+	c.Run.Args = args
+	return args, nil
+}
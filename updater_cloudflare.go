@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterUpdater(cloudflareUpdater{})
+}
+
+// cloudflareAPI is the Cloudflare API endpoint. It is not configurable per
+// update method, as the API token is sent there, tests point it to a fake.
+var cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareHTTP sends the API requests, with the same default timeout as
+// the http update method, so a hanging API does not block a queue worker.
+var cloudflareHTTP = &http.Client{Timeout: 30 * time.Second}
+
+// cloudflareConfig is the config of the cloudflare update method.
+type cloudflareConfig struct {
+	// Publish selects the address families to publish: "both" (default),
+	// "ipv4" or "ipv6". Records of a published family the host has no
+	// address for are removed, records of other families are left alone.
+	Publish string `json:"publish"`
+	// TTL of the records in seconds, 1 (default) means automatic.
+	TTL int `json:"ttl"`
+	// Proxied routes traffic to the records through Cloudflare.
+	Proxied bool `json:"proxied"`
+	// Comment is stored with the records, it is processed as a text
+	// template.
+	Comment string `json:"comment"`
+}
+
+// cloudflareUpdater sets the address records of the host domain in its
+// Cloudflare zone. The api_key names the environment variable holding the
+// Cloudflare API token.
+type cloudflareUpdater struct{}
+
+func (cloudflareUpdater) Name() string {
+	return "cloudflare"
+}
+
+func (cloudflareUpdater) config(u *Update) (*cloudflareConfig, error) {
+	cfg := cloudflareConfig{
+		Publish: "both",
+		TTL:     1,
+	}
+	err := decodeConfig(u, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Publish {
+	case "both", "ipv4", "ipv6":
+	default:
+		return nil, fmt.Errorf("config: publish must be both, ipv4 or ipv6, not %q", cfg.Publish)
+	}
+	if cfg.TTL != 1 && (cfg.TTL < 30 || cfg.TTL > 86400) {
+		return nil, fmt.Errorf("config: ttl must be 1 (automatic) or between 30 and 86400, not %d", cfg.TTL)
+	}
+	if err := checkTemplate("comment", cfg.Comment); err != nil {
+		return nil, fmt.Errorf("config: comment: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (c cloudflareUpdater) Validate(u *Update) error {
+	if u.ApiKey == nil || *u.ApiKey == "" {
+		return errors.New("api_key must name the environment variable with the API token")
+	}
+	_, err := c.config(u)
+	return errors.Join(err, checkTemplate("args", u.Args))
+}
+
+func (c cloudflareUpdater) Apply(ctx context.Context, host *Host, change *Change) error {
+	u := change.Update
+	cfg, err := c.config(u)
+	if err != nil {
+		return err
+	}
+	if u.ApiKey == nil {
+		slog.ErrorContext(ctx, "api_key not set")
+		return errors.New("api_key not set")
+	}
+	apiKey := os.Getenv(*u.ApiKey)
+	if len(apiKey) == 0 {
+		slog.ErrorContext(ctx, "api_key ENV variable not set")
+		return errors.New("api_key ENV variable not set")
+	}
+	comment, err := change.RenderText("comment", cfg.Comment, host)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]string)
+	if cfg.Publish != "ipv6" {
+		want["A"] = ""
+		if host.Ip4addr != nil {
+			addr, err := netip.ParseAddr(*host.Ip4addr)
+			if err != nil || !addr.Unmap().Is4() {
+				return fmt.Errorf("invalid IPv4 address %q", *host.Ip4addr)
+			}
+			want["A"] = addr.Unmap().String()
+		}
+	}
+	if cfg.Publish != "ipv4" {
+		want["AAAA"] = ""
+		if host.Ip6addr != nil {
+			addr, err := netip.ParseAddr(*host.Ip6addr)
+			if err != nil || !addr.Is6() || addr.Is4In6() {
+				return fmt.Errorf("invalid IPv6 address %q", *host.Ip6addr)
+			}
+			want["AAAA"] = addr.String()
+		}
+	}
+	change.Run.Args = fmt.Sprintf("%s in %s: A=%q AAAA=%q", host.Domain, host.Zone, want["A"], want["AAAA"])
+	if change.DryRun {
+		return nil
+	}
+
+	cf := &cloudflareClient{apiURL: cloudflareAPI, token: apiKey, run: change.Run}
+	zoneID, err := cf.zoneID(ctx, host.Zone)
+	if err != nil {
+		slog.ErrorContext(ctx, "cloudflare zone", "zone", host.Zone, "err", err)
+		return err
+	}
+	var log []string
+	for _, rtype := range []string{"A", "AAAA"} {
+		content, ok := want[rtype]
+		if !ok {
+			continue
+		}
+		recs, err := cf.records(ctx, zoneID, rtype, host.Domain)
+		if err != nil {
+			slog.ErrorContext(ctx, "cloudflare records", "type", rtype, "err", err)
+			return err
+		}
+		if content != "" {
+			rec := cloudflareRecord{
+				Type:    rtype,
+				Name:    host.Domain,
+				Content: content,
+				TTL:     cfg.TTL,
+				Proxied: cfg.Proxied,
+				Comment: comment,
+			}
+			if len(recs) == 0 {
+				err = cf.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", rec, nil)
+				log = append(log, "create "+rtype+" "+content)
+			} else if !recs[0].matches(rec) {
+				err = cf.do(ctx, http.MethodPatch, "/zones/"+zoneID+"/dns_records/"+recs[0].ID, rec, nil)
+				log = append(log, "update "+rtype+" "+recs[0].Content+" -> "+content)
+			} else {
+				log = append(log, "keep "+rtype+" "+content)
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "cloudflare set record", "type", rtype, "err", err)
+				return err
+			}
+			if len(recs) > 0 {
+				recs = recs[1:]
+			}
+		}
+		// Whatever is left is either a duplicate or belongs to an
+		// address family the host no longer has.
+		for _, stale := range recs {
+			err = cf.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+stale.ID, nil, nil)
+			if err != nil {
+				slog.ErrorContext(ctx, "cloudflare delete record", "type", rtype, "err", err)
+				return err
+			}
+			log = append(log, "delete "+rtype+" "+stale.Content)
+		}
+	}
+	change.Run.SetOutput([]byte(strings.Join(log, "\n")))
+	slog.InfoContext(ctx, "cloudflare", "domain", host.Domain, "zone", host.Zone, "changes", log)
+	return nil
+}
+
+// Lookup returns the contents of the records of the published families.
+func (c cloudflareUpdater) Lookup(ctx context.Context, host *Host, u *Update) (map[string][]string, error) {
+	cfg, err := c.config(u)
+	if err != nil {
+		return nil, err
+	}
+	if u.ApiKey == nil || os.Getenv(*u.ApiKey) == "" {
+		return nil, errors.New("api_key ENV variable not set")
+	}
+	cf := &cloudflareClient{apiURL: cloudflareAPI, token: os.Getenv(*u.ApiKey), run: &Run{}}
+	zoneID, err := cf.zoneID(ctx, host.Zone)
+	if err != nil {
+		return nil, err
+	}
+	published := make(map[string][]string)
+	for _, rtype := range []string{"A", "AAAA"} {
+		if (rtype == "A" && cfg.Publish == "ipv6") || (rtype == "AAAA" && cfg.Publish == "ipv4") {
+			continue
+		}
+		recs, err := cf.records(ctx, zoneID, rtype, host.Domain)
+		if err != nil {
+			return nil, err
+		}
+		published[rtype] = []string{}
+		for _, rec := range recs {
+			published[rtype] = append(published[rtype], rec.Content)
+		}
+	}
+	return published, nil
+}
+
+// cloudflareRecord is a DNS record as seen by the Cloudflare API.
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+	Comment string `json:"comment"`
+}
+
+// matches reports whether r already has the settings of want.
+func (r cloudflareRecord) matches(want cloudflareRecord) bool {
+	return r.Content == want.Content && r.TTL == want.TTL && r.Proxied == want.Proxied && r.Comment == want.Comment
+}
+
+// cloudflareClient is a minimal client for the Cloudflare DNS API.
+type cloudflareClient struct {
+	apiURL string
+	token  string
+	run    *Run
+}
+
+func (cf *cloudflareClient) zoneID(ctx context.Context, zone string) (string, error) {
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	err := cf.do(ctx, http.MethodGet, "/zones?"+url.Values{"name": {zone}}.Encode(), nil, &zones)
+	if err != nil {
+		return "", err
+	}
+	if len(zones) != 1 {
+		return "", fmt.Errorf("zone %s not found", zone)
+	}
+	return zones[0].ID, nil
+}
+
+func (cf *cloudflareClient) records(ctx context.Context, zoneID, rtype, name string) ([]cloudflareRecord, error) {
+	var recs []cloudflareRecord
+	q := url.Values{"type": {rtype}, "name": {name}, "per_page": {"100"}}
+	err := cf.do(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+q.Encode(), nil, &recs)
+	return recs, err
+}
+
+// do sends a request to the API and decodes the result into result if it
+// is not nil.
+func (cf *cloudflareClient) do(ctx context.Context, method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(cf.apiURL, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cf.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := cloudflareHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	cf.run.Status = &res.StatusCode
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&envelope)
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %w", method, req.URL.Path, res.Status, err)
+	}
+	if !envelope.Success || res.StatusCode/100 != 2 {
+		var msgs []string
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, res.Status, strings.Join(msgs, ", "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
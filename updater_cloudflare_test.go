@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCloudflareToken = "cf-test-token"
+
+// fakeCloudflare serves the parts of the Cloudflare API the updater uses
+// for the zone example.org, keeping the records in memory.
+type fakeCloudflare struct {
+	mu       sync.Mutex
+	records  []cloudflareRecord
+	nextID   int
+	requests []string
+	// fail makes requests with this method answer with an API error.
+	fail string
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	reply := func(status int, result any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"success": status == http.StatusOK, "result": result,
+			"errors": []map[string]any{}})
+	}
+	apiError := func(status, code int, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"success": false, "result": nil,
+			"errors": []map[string]any{{"code": code, "message": msg}}})
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testCloudflareToken {
+		apiError(http.StatusForbidden, 10000, "Authentication error")
+		return
+	}
+	if r.Method == f.fail {
+		apiError(http.StatusBadRequest, 81057, "Record already exists.")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/zones")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		zones := []map[string]string{}
+		if r.URL.Query().Get("name") == "example.org" {
+			zones = append(zones, map[string]string{"id": "zone1"})
+		}
+		reply(http.StatusOK, zones)
+	case path == "/zone1/dns_records" && r.Method == http.MethodGet:
+		recs := []cloudflareRecord{}
+		for _, rec := range f.records {
+			if rec.Type == r.URL.Query().Get("type") && rec.Name == r.URL.Query().Get("name") {
+				recs = append(recs, rec)
+			}
+		}
+		reply(http.StatusOK, recs)
+	case path == "/zone1/dns_records" && r.Method == http.MethodPost:
+		var rec cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		f.nextID++
+		rec.ID = fmt.Sprintf("new%d", f.nextID)
+		f.records = append(f.records, rec)
+		reply(http.StatusOK, rec)
+	case strings.HasPrefix(path, "/zone1/dns_records/"):
+		id := strings.TrimPrefix(path, "/zone1/dns_records/")
+		i := slices.IndexFunc(f.records, func(rec cloudflareRecord) bool { return rec.ID == id })
+		if i < 0 {
+			apiError(http.StatusNotFound, 81044, "Record does not exist.")
+			return
+		}
+		switch r.Method {
+		case http.MethodPatch:
+			json.NewDecoder(r.Body).Decode(&f.records[i])
+			f.records[i].ID = id
+			reply(http.StatusOK, f.records[i])
+		case http.MethodDelete:
+			f.records = slices.Delete(f.records, i, i+1)
+			reply(http.StatusOK, map[string]string{"id": id})
+		default:
+			apiError(http.StatusMethodNotAllowed, 10000, "Method not allowed")
+		}
+	default:
+		apiError(http.StatusNotFound, 7003, "No route for that URI")
+	}
+}
+
+// recordStrings returns the records as "<id> <type> <content> <comment>".
+func recordStrings(recs []cloudflareRecord) []string {
+	var s []string
+	for _, rec := range recs {
+		s = append(s, strings.Join([]string{rec.ID, rec.Type, rec.Content, rec.Comment}, " "))
+	}
+	return s
+}
+
+func TestCloudflareApply(t *testing.T) {
+	t.Setenv("TEST_CF_TOKEN", testCloudflareToken)
+	for _, tc := range []struct {
+		name         string
+		config       string
+		ip4, ip6     string
+		zone         string
+		records      []cloudflareRecord
+		fail         string
+		token        string
+		wantRecords  []string
+		wantRequests []string
+		wantErr      string
+	}{
+		{
+			name: "create",
+			ip4:  "8.8.8.8", ip6: "2001:4860::1",
+			wantRecords: []string{"new1 A 8.8.8.8 fritzdyn home", "new2 AAAA 2001:4860::1 fritzdyn home"},
+			wantRequests: []string{
+				"GET /zones",
+				"GET /zones/zone1/dns_records", "POST /zones/zone1/dns_records",
+				"GET /zones/zone1/dns_records", "POST /zones/zone1/dns_records",
+			},
+		},
+		{
+			name: "update, keep and remove duplicates",
+			ip4:  "8.8.8.8", ip6: "2001:4860::1",
+			records: []cloudflareRecord{
+				{ID: "a1", Type: "A", Name: "home.example.org", Content: "8.8.4.4", TTL: 1, Comment: "fritzdyn home"},
+				{ID: "a2", Type: "A", Name: "home.example.org", Content: "8.8.4.4", TTL: 1, Comment: "fritzdyn home"},
+				{ID: "aaaa1", Type: "AAAA", Name: "home.example.org", Content: "2001:4860::1", TTL: 1, Comment: "fritzdyn home"},
+			},
+			wantRecords: []string{"a1 A 8.8.8.8 fritzdyn home", "aaaa1 AAAA 2001:4860::1 fritzdyn home"},
+			wantRequests: []string{
+				"GET /zones",
+				"GET /zones/zone1/dns_records", "PATCH /zones/zone1/dns_records/a1", "DELETE /zones/zone1/dns_records/a2",
+				"GET /zones/zone1/dns_records",
+			},
+		},
+		{
+			name: "IPv6 only removes the A record",
+			ip6:  "2001:4860::1",
+			records: []cloudflareRecord{
+				{ID: "a1", Type: "A", Name: "home.example.org", Content: "8.8.4.4", TTL: 1, Comment: "fritzdyn home"},
+				{ID: "other", Type: "A", Name: "www.example.org", Content: "8.8.4.4", TTL: 1},
+			},
+			wantRecords: []string{"other A 8.8.4.4 ", "new1 AAAA 2001:4860::1 fritzdyn home"},
+			wantRequests: []string{
+				"GET /zones",
+				"GET /zones/zone1/dns_records", "DELETE /zones/zone1/dns_records/a1",
+				"GET /zones/zone1/dns_records", "POST /zones/zone1/dns_records",
+			},
+		},
+		{
+			name:   "publish ipv4 leaves AAAA alone",
+			config: `{"publish": "ipv4", "comment": "fritzdyn {{.Host.Name}}"}`,
+			ip4:    "8.8.8.8",
+			records: []cloudflareRecord{
+				{ID: "aaaa1", Type: "AAAA", Name: "home.example.org", Content: "2001:4860::2", TTL: 1},
+			},
+			wantRecords: []string{"aaaa1 AAAA 2001:4860::2 ", "new1 A 8.8.8.8 fritzdyn home"},
+			wantRequests: []string{
+				"GET /zones",
+				"GET /zones/zone1/dns_records", "POST /zones/zone1/dns_records",
+			},
+		},
+		{
+			name:        "comment is not HTML escaped",
+			config:      `{"comment": "{{.Host.Name}} <fritz&box>"}`,
+			ip4:         "8.8.8.8",
+			wantRecords: []string{"new1 A 8.8.8.8 home <fritz&box>"},
+		},
+		{
+			name:    "zone not found",
+			ip4:     "8.8.8.8",
+			zone:    "example.net",
+			wantErr: "zone example.net not found",
+		},
+		{
+			name:    "API error",
+			ip4:     "8.8.8.8",
+			fail:    http.MethodPost,
+			wantErr: "81057: Record already exists.",
+		},
+		{
+			name:    "bad token",
+			ip4:     "8.8.8.8",
+			token:   "wrong",
+			wantErr: "403 Forbidden: 10000: Authentication error",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeCloudflare{records: tc.records, fail: tc.fail}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			defer func(api string) { cloudflareAPI = api }(cloudflareAPI)
+			cloudflareAPI = srv.URL
+			if tc.token != "" {
+				t.Setenv("TEST_CF_TOKEN", tc.token)
+			}
+			config := tc.config
+			if config == "" {
+				config = `{"comment": "fritzdyn {{.Host.Name}}"}`
+			}
+			apiKey := "TEST_CF_TOKEN"
+			u := &Update{Cmd: "cloudflare", ApiKey: &apiKey, Config: &config}
+			err := cloudflareUpdater{}.Validate(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zone := tc.zone
+			if zone == "" {
+				zone = "example.org"
+			}
+			host := &Host{Name: "home", Domain: "home.example.org", Zone: zone, Ip4addr: optional(tc.ip4), Ip6addr: optional(tc.ip6)}
+			change := &Change{Update: u, Old: &Host{}, Run: &Run{}}
+			err = cloudflareUpdater{}.Apply(context.Background(), host, change)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recordStrings(fake.records); !slices.Equal(got, tc.wantRecords) {
+				t.Errorf("got records %q, want %q", got, tc.wantRecords)
+			}
+			if tc.wantRequests != nil && !slices.Equal(fake.requests, tc.wantRequests) {
+				t.Errorf("got requests %q, want %q", fake.requests, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCloudflareTimeout(t *testing.T) {
+	t.Setenv("TEST_CF_TOKEN", testCloudflareToken)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	defer func(api string, client *http.Client) { cloudflareAPI, cloudflareHTTP = api, client }(cloudflareAPI, cloudflareHTTP)
+	cloudflareAPI = srv.URL
+	cloudflareHTTP = &http.Client{Timeout: 50 * time.Millisecond}
+	apiKey := "TEST_CF_TOKEN"
+	u := &Update{Cmd: "cloudflare", ApiKey: &apiKey}
+	host := &Host{Name: "home", Domain: "home.example.org", Zone: "example.org", Ip4addr: optional("8.8.8.8")}
+	change := &Change{Update: u, Old: &Host{}, Run: &Run{}}
+	err := cloudflareUpdater{}.Apply(context.Background(), host, change)
+	if err == nil || !strings.Contains(err.Error(), "Client.Timeout") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+}
+
+func TestCloudflareConfig(t *testing.T) {
+	apiKey := "TEST_CF_TOKEN"
+	for _, tc := range []struct {
+		config  string
+		wantErr string
+	}{
+		{`{"publish": "ipv6", "ttl": 300, "proxied": true}`, ""},
+		{`{"publish": "all"}`, "publish must be both, ipv4 or ipv6"},
+		{`{"ttl": 10}`, "ttl must be 1 (automatic) or between 30 and 86400"},
+		{`{"comment": "{{.Host"}`, "comment"},
+		// The API token must not be sent anywhere else.
+		{`{"api_url": "http://attacker.example"}`, `unknown field "api_url"`},
+	} {
+		u := &Update{Cmd: "cloudflare", ApiKey: &apiKey, Config: &tc.config}
+		err := cloudflareUpdater{}.Validate(u)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tc.config, err, tc.wantErr)
+		}
+	}
+}
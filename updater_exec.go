@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterUpdater(execUpdater{})
+}
+
+// commandConfig holds the settings shared by the exec and shell update
+// methods.
+type commandConfig struct {
+	// Timeout after which the command is killed, 30s if not set.
+	Timeout string `json:"timeout"`
+	// Dir is the working directory of the command.
+	Dir string `json:"dir"`
+	// Env holds additional environment variables, the values are
+	// templates.
+	Env map[string]string `json:"env"`
+}
+
+// execConfig is the config of the exec update method.
+type execConfig struct {
+	commandConfig
+	// Argv is the program and its arguments, each one is a template.
+	Argv []string `json:"argv"`
+}
+
+// execUpdater runs a program with a templated argument list, without
+// involving a shell.
+type execUpdater struct{}
+
+func (execUpdater) Name() string {
+	return "exec"
+}
+
+func (execUpdater) config(u *Update) (*execConfig, error) {
+	cfg := execConfig{commandConfig: commandConfig{Timeout: "30s"}}
+	err := decodeConfig(u, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Argv) == 0 || cfg.Argv[0] == "" {
+		return nil, errors.New("config: argv must contain the program to run")
+	}
+	for i, arg := range cfg.Argv {
+		if err := checkTemplate("argv", arg); err != nil {
+			return nil, fmt.Errorf("config: argv[%d]: %w", i, err)
+		}
+	}
+	return &cfg, cfg.commandConfig.check()
+}
+
+func (e execUpdater) Validate(u *Update) error {
+	_, err := e.config(u)
+	return err
+}
+
+func (e execUpdater) Apply(ctx context.Context, host *Host, change *Change) error {
+	cfg, err := e.config(change.Update)
+	if err != nil {
+		return err
+	}
+	argv := make([]string, len(cfg.Argv))
+	for i, arg := range cfg.Argv {
+		argv[i], err = change.RenderText("argv", arg, host)
+		if err != nil {
+			return fmt.Errorf("argv[%d]: %w", i, err)
+		}
+	}
+	change.Run.Args = strings.Join(argv, " ")
+	return runCommand(ctx, &cfg.commandConfig, argv, host, change)
+}
+
+func (cfg *commandConfig) check() error {
+	if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+		return fmt.Errorf("config: timeout: %w", err)
+	}
+	for name, value := range cfg.Env {
+		if err := checkTemplate(name, value); err != nil {
+			return fmt.Errorf("config: env %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// runCommand runs argv with the timeout, working directory and environment
+// of cfg and records exit code and output in the run of change. The
+// command does not inherit the environment of the server, it only gets
+// PATH and the FRITZDYN_ variables describing the change:
+//
+//	FRITZDYN_HOST, FRITZDYN_DOMAIN, FRITZDYN_ZONE
+//	FRITZDYN_IP4, FRITZDYN_IP6, FRITZDYN_OLD_IP4, FRITZDYN_OLD_IP6
+//	FRITZDYN_SECRET (the variable named by api_key, if set)
+func runCommand(ctx context.Context, cfg *commandConfig, argv []string, host *Host, change *Change) error {
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"FRITZDYN_HOST=" + host.Name,
+		"FRITZDYN_DOMAIN=" + host.Domain,
+		"FRITZDYN_ZONE=" + host.Zone,
+		"FRITZDYN_IP4=" + deref(host.Ip4addr),
+		"FRITZDYN_IP6=" + deref(host.Ip6addr),
+		"FRITZDYN_OLD_IP4=" + deref(change.Old.Ip4addr),
+		"FRITZDYN_OLD_IP6=" + deref(change.Old.Ip6addr),
+	}
+	if change.Update.ApiKey != nil && *change.Update.ApiKey != "" {
+		env = append(env, "FRITZDYN_SECRET="+os.Getenv(*change.Update.ApiKey))
+	}
+	for name, value := range cfg.Env {
+		v, err := change.RenderText(name, value, host)
+		if err != nil {
+			return fmt.Errorf("env %s: %w", name, err)
+		}
+		env = append(env, name+"="+v)
+	}
+	if change.DryRun {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = cfg.Dir
+	cmd.Env = env
+	stdoutStderr, err := cmd.CombinedOutput()
+	change.Run.SetOutput(stdoutStderr)
+	if cmd.ProcessState != nil {
+		exitCode := cmd.ProcessState.ExitCode()
+		change.Run.Status = &exitCode
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %v", timeout)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cmd", "argv", argv, "err", err)
+		return err
+	}
+	slog.DebugContext(ctx, "exec", "argv", argv, "outerr", string(stdoutStderr))
+	return nil
+}
+
+// deref returns the string s points to, or "" for nil.
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExecApply(t *testing.T) {
+	t.Setenv("TEST_EXEC_SECRET", "secret")
+	t.Setenv("TEST_EXEC_LEAK", "leaked")
+	for _, tc := range []struct {
+		name       string
+		config     string
+		apiKey     string
+		wantArgs   string
+		wantOutput string
+		wantStatus int
+		wantErr    string
+	}{
+		{
+			name:       "argv",
+			config:     `{"argv": ["echo", "{{.Host.Name}}", "{{.Host.Ip4addr}}", "{{.Old.Ip4addr}}"]}`,
+			wantArgs:   "echo " + testHostName + " 8.8.8.8 8.8.4.4",
+			wantOutput: testHostName + " 8.8.8.8 8.8.4.4\n",
+		},
+		{
+			name:   "env",
+			config: `{"argv": ["env"], "env": {"DOMAIN": "{{.Host.Domain}}"}}`,
+			apiKey: "TEST_EXEC_SECRET",
+			wantOutput: strings.Join([]string{
+				"DOMAIN=home.example.org",
+				"FRITZDYN_DOMAIN=home.example.org",
+				"FRITZDYN_HOST=" + testHostName,
+				"FRITZDYN_IP4=8.8.8.8",
+				"FRITZDYN_IP6=",
+				"FRITZDYN_OLD_IP4=8.8.4.4",
+				"FRITZDYN_OLD_IP6=",
+				"FRITZDYN_SECRET=secret",
+				"FRITZDYN_ZONE=example.org",
+				"PATH=" + os.Getenv("PATH"),
+			}, "\n"),
+		},
+		{
+			name:       "exit status",
+			config:     `{"argv": ["false"]}`,
+			wantStatus: 1,
+			wantErr:    "exit status 1",
+		},
+		{
+			name:       "timeout",
+			config:     `{"argv": ["sleep", "5"], "timeout": "50ms"}`,
+			wantStatus: -1,
+			wantErr:    "killed after 50ms",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			u := &Update{Cmd: "exec", Config: &config}
+			if tc.apiKey != "" {
+				u.ApiKey = &tc.apiKey
+			}
+			if err := (execUpdater{}).Validate(u); err != nil {
+				t.Fatal(err)
+			}
+			host := &Host{Name: testHostName, Domain: "home.example.org", Zone: "example.org", Ip4addr: optional("8.8.8.8")}
+			change := &Change{Update: u, Old: &Host{Ip4addr: optional("8.8.4.4")}, Run: &Run{}}
+			err := execUpdater{}.Apply(context.Background(), host, change)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want %q", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantArgs != "" && change.Run.Args != tc.wantArgs {
+				t.Errorf("got args %q, want %q", change.Run.Args, tc.wantArgs)
+			}
+			output := change.Run.Output
+			if tc.name == "env" {
+				lines := strings.Split(strings.TrimSpace(output), "\n")
+				slices.Sort(lines)
+				output = strings.Join(lines, "\n")
+			}
+			if output != tc.wantOutput {
+				t.Errorf("got output %q, want %q", output, tc.wantOutput)
+			}
+			if change.Run.Status == nil || *change.Run.Status != tc.wantStatus {
+				t.Errorf("got status %v, want %d", change.Run.Status, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestExecValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config  string
+		wantErr string
+	}{
+		{`{"argv": ["/usr/local/bin/update", "{{.Host.Domain}}"], "timeout": "5s"}`, ""},
+		{`{"argv": []}`, "argv must contain the program"},
+		{`{"argv": ["update", "{{.Host.Domain"]}`, "argv[1]"},
+		{`{"argv": ["update"], "timeout": "soon"}`, "timeout"},
+		{`{"argv": ["update"], "env": {"X": "{{.Nope"}}`, "env X"},
+	} {
+		config := tc.config
+		err := execUpdater{}.Validate(&Update{Cmd: "exec", Config: &config})
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tc.config, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+func init() {
+	RegisterUpdater(getUpdater{})
+}
+
+// getUpdater performs an HTTP GET request to the URL in args.
+type getUpdater struct{}
+
+func (getUpdater) Name() string {
+	return "GET"
+}
+
+func (getUpdater) Validate(u *Update) error {
+	if u.Args == "" {
+		return errors.New("args must contain the URL")
+	}
+	return errors.Join(checkTemplate("args", u.Args), decodeConfig(u, &struct{}{}))
+}
+
+func (getUpdater) Apply(ctx context.Context, host *Host, change *Change) error {
+	url, err := change.Args(host)
+	if err != nil {
+		slog.ErrorContext(ctx, "Execute", "err", err)
+		return err
+	}
+	if change.DryRun {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "NewRequestWithContext", "err", err)
+		return err
+	}
+	// The same default timeout as the http update method.
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Do", "err", err)
+		return err
+	}
+	defer res.Body.Close()
+	change.Run.Status = &res.StatusCode
+	buf, err := io.ReadAll(io.LimitReader(res.Body, maxRunOutput))
+	change.Run.SetOutput(buf)
+	if res.StatusCode/100 != 2 {
+		slog.ErrorContext(ctx, "Get", "status", res.Status, "code", res.StatusCode)
+		return errors.New(res.Status)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "ReadAll", "err", err)
+		return err
+	}
+	slog.InfoContext(ctx, "Get", "url", url, "resp", string(buf))
+	return nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterUpdater(httpUpdater{})
+}
+
+// httpConfig is the config of the http update method. The URL is taken
+// from args, header values, form values, JSON strings and the body are
+// processed as text templates, without HTML escaping.
+type httpConfig struct {
+	// Method is GET (default), POST, PUT or PATCH.
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// Form is sent as an application/x-www-form-urlencoded body.
+	Form map[string]string `json:"form"`
+	// JSON is sent as an application/json body.
+	JSON json.RawMessage `json:"json"`
+	// Body is sent as is with ContentType.
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+	// Auth is "basic" or "bearer", the password or token is read from
+	// the environment variable named by api_key.
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	// Timeout of the request, 30s if not set.
+	Timeout string `json:"timeout"`
+	// CAFile is a PEM file with the CA certificates to trust instead of
+	// the system ones.
+	CAFile string `json:"ca_file"`
+	// ClientCert and ClientKey are PEM files for TLS client
+	// authentication.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	// Success decides whether the response means the update worked.
+	Success httpSuccess `json:"success"`
+}
+
+// httpSuccess describes a successful response. Without any setting every
+// 2xx status is a success.
+type httpSuccess struct {
+	// Status lists the accepted status codes instead of 2xx.
+	Status []int `json:"status"`
+	// Regex must match the response body.
+	Regex string `json:"regex"`
+	// JSONPath is a dotted path into a JSON response body, e.g.
+	// "result.0.ok". The value found must equal JSONValue, or be true
+	// if JSONValue is empty.
+	JSONPath  string `json:"json_path"`
+	JSONValue string `json:"json_value"`
+}
+
+// httpUpdater sends a configurable HTTP request to the URL in args.
+type httpUpdater struct{}
+
+func (httpUpdater) Name() string {
+	return "http"
+}
+
+func (httpUpdater) config(u *Update) (*httpConfig, error) {
+	cfg := httpConfig{
+		Method:  http.MethodGet,
+		Timeout: "30s",
+	}
+	err := decodeConfig(u, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Method = strings.ToUpper(cfg.Method)
+	if !slices.Contains([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch}, cfg.Method) {
+		return nil, fmt.Errorf("config: unsupported method %q", cfg.Method)
+	}
+	bodies := 0
+	for _, set := range []bool{len(cfg.Form) > 0, len(cfg.JSON) > 0, cfg.Body != ""} {
+		if set {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return nil, errors.New("config: only one of form, json and body can be set")
+	}
+	if bodies > 0 && cfg.Method == http.MethodGet {
+		return nil, errors.New("config: GET requests cannot have a body")
+	}
+	switch cfg.Auth {
+	case "", "basic", "bearer":
+	default:
+		return nil, fmt.Errorf("config: auth must be basic or bearer, not %q", cfg.Auth)
+	}
+	if cfg.Auth != "" && (u.ApiKey == nil || *u.ApiKey == "") {
+		return nil, errors.New("api_key must name the environment variable with the password or token")
+	}
+	if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+		return nil, fmt.Errorf("config: timeout: %w", err)
+	}
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return nil, errors.New("config: client_cert and client_key must be set together")
+	}
+	if _, err := regexp.Compile(cfg.Success.Regex); err != nil {
+		return nil, fmt.Errorf("config: success regex: %w", err)
+	}
+	for name, value := range cfg.Headers {
+		if err := checkTemplate(name, value); err != nil {
+			return nil, fmt.Errorf("config: header %s: %w", name, err)
+		}
+	}
+	for name, value := range cfg.Form {
+		if err := checkTemplate(name, value); err != nil {
+			return nil, fmt.Errorf("config: form %s: %w", name, err)
+		}
+	}
+	if len(cfg.JSON) > 0 {
+		var v any
+		err := json.Unmarshal(cfg.JSON, &v)
+		if err == nil {
+			_, err = renderJSON(v, func(s string) (string, error) { return s, checkTemplate("json", s) })
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config: json: %w", err)
+		}
+	}
+	if err := checkTemplate("body", cfg.Body); err != nil {
+		return nil, fmt.Errorf("config: body: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (h httpUpdater) Validate(u *Update) error {
+	if u.Args == "" {
+		return errors.New("args must contain the URL")
+	}
+	_, err := h.config(u)
+	return errors.Join(err, checkTemplate("args", u.Args))
+}
+
+func (h httpUpdater) Apply(ctx context.Context, host *Host, change *Change) error {
+	cfg, err := h.config(change.Update)
+	if err != nil {
+		return err
+	}
+	reqURL, err := change.Args(host)
+	if err != nil {
+		return err
+	}
+	body, contentType, err := h.body(cfg, host, change)
+	if err != nil {
+		return err
+	}
+	client, err := h.client(cfg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, cfg.Method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range cfg.Headers {
+		v, err := change.RenderText(name, value, host)
+		if err != nil {
+			return fmt.Errorf("header %s: %w", name, err)
+		}
+		req.Header.Set(name, v)
+	}
+	if cfg.Auth != "" {
+		secret := os.Getenv(*change.Update.ApiKey)
+		if secret == "" {
+			return errors.New("api_key ENV variable not set")
+		}
+		if cfg.Auth == "basic" {
+			req.SetBasicAuth(cfg.Username, secret)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+	}
+	change.Run.Args = cfg.Method + " " + reqURL
+	if change.DryRun {
+		if body != nil {
+			buf, _ := io.ReadAll(body)
+			change.Run.SetOutput(buf)
+		}
+		return nil
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "http Do", "url", reqURL, "err", err)
+		return err
+	}
+	defer res.Body.Close()
+	change.Run.Status = &res.StatusCode
+	// Read a little more than is kept so a JSON check can still look at
+	// slightly larger bodies.
+	buf, err := io.ReadAll(io.LimitReader(res.Body, 16*maxRunOutput))
+	change.Run.SetOutput(buf)
+	if err != nil {
+		return err
+	}
+	err = cfg.Success.check(res.StatusCode, buf)
+	if err != nil {
+		slog.ErrorContext(ctx, "http update failed", "url", reqURL, "status", res.StatusCode, "err", err)
+		return err
+	}
+	slog.InfoContext(ctx, "http update", "method", cfg.Method, "url", reqURL, "status", res.StatusCode)
+	return nil
+}
+
+// body renders the request body and returns it with its content type.
+func (httpUpdater) body(cfg *httpConfig, host *Host, change *Change) (io.Reader, string, error) {
+	switch {
+	case len(cfg.Form) > 0:
+		form := url.Values{}
+		for name, value := range cfg.Form {
+			v, err := change.RenderText(name, value, host)
+			if err != nil {
+				return nil, "", fmt.Errorf("form %s: %w", name, err)
+			}
+			form.Set(name, v)
+		}
+		return strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", nil
+	case len(cfg.JSON) > 0:
+		var v any
+		err := json.Unmarshal(cfg.JSON, &v)
+		if err != nil {
+			return nil, "", err
+		}
+		v, err = renderJSON(v, func(s string) (string, error) { return change.RenderText("json", s, host) })
+		if err != nil {
+			return nil, "", err
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return bytes.NewReader(buf), "application/json", nil
+	case cfg.Body != "":
+		body, err := change.RenderText("body", cfg.Body, host)
+		if err != nil {
+			return nil, "", err
+		}
+		return strings.NewReader(body), cfg.ContentType, nil
+	}
+	return nil, "", nil
+}
+
+// renderJSON replaces every string in the decoded JSON value v with the
+// result of render. Rendering the strings one by one keeps the document
+// valid whatever the values contain.
+func renderJSON(v any, render func(s string) (string, error)) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return render(v)
+	case []any:
+		for i := range v {
+			r, err := renderJSON(v[i], render)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = r
+		}
+	case map[string]any:
+		for k := range v {
+			r, err := renderJSON(v[k], render)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = r
+		}
+	}
+	return v, nil
+}
+
+// client returns an HTTP client with the timeout and TLS settings of cfg.
+func (httpUpdater) client(cfg *httpConfig) (*http.Client, error) {
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	client := &http.Client{Timeout: timeout}
+	if cfg.CAFile == "" && cfg.ClientCert == "" {
+		return client, nil
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
+
+// check reports why a response with status and body is not a success.
+func (s httpSuccess) check(status int, body []byte) error {
+	if len(s.Status) > 0 {
+		if !slices.Contains(s.Status, status) {
+			return fmt.Errorf("unexpected status %d", status)
+		}
+	} else if status/100 != 2 {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	if s.Regex != "" && !regexp.MustCompile(s.Regex).Match(body) {
+		return fmt.Errorf("response does not match %q", s.Regex)
+	}
+	if s.JSONPath != "" {
+		var v any
+		err := json.Unmarshal(body, &v)
+		if err != nil {
+			return fmt.Errorf("response is not JSON: %w", err)
+		}
+		for _, key := range strings.Split(s.JSONPath, ".") {
+			switch node := v.(type) {
+			case map[string]any:
+				v = node[key]
+			case []any:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(node) {
+					return fmt.Errorf("response has no %s", s.JSONPath)
+				}
+				v = node[i]
+			default:
+				return fmt.Errorf("response has no %s", s.JSONPath)
+			}
+		}
+		if s.JSONValue == "" {
+			if v != true {
+				return fmt.Errorf("%s is %v, not true", s.JSONPath, v)
+			}
+		} else if fmt.Sprint(v) != s.JSONValue {
+			return fmt.Errorf("%s is %v, not %s", s.JSONPath, v, s.JSONValue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHostName has the characters HTML escaping would change.
+const testHostName = `a+b&c'd"<e>`
+
+func TestHTTPApply(t *testing.T) {
+	t.Setenv("TEST_HTTP_TOKEN", "secret")
+	for _, tc := range []struct {
+		name        string
+		config      string
+		status      int
+		response    string
+		wantMethod  string
+		wantType    string
+		wantBody    string
+		wantHeaders map[string]string
+		wantErr     string
+	}{
+		{
+			name:        "headers",
+			config:      `{"headers": {"X-Host": "{{.Host.Name}}"}, "auth": "bearer"}`,
+			wantMethod:  http.MethodGet,
+			wantHeaders: map[string]string{"X-Host": testHostName, "Authorization": "Bearer secret"},
+		},
+		{
+			name:       "form",
+			config:     `{"method": "post", "form": {"name": "{{.Host.Name}}", "ip": "{{.Host.Ip4addr}}"}}`,
+			wantMethod: http.MethodPost,
+			wantType:   "application/x-www-form-urlencoded",
+			wantBody:   "ip=8.8.8.8&name=a%2Bb%26c%27d%22%3Ce%3E",
+		},
+		{
+			name:       "json",
+			config:     `{"method": "PUT", "json": {"name": "{{.Host.Name}}", "addrs": ["{{.Host.Ip4addr}}"], "ttl": 60}}`,
+			wantMethod: http.MethodPut,
+			wantType:   "application/json",
+			wantBody:   `{"addrs":["8.8.8.8"],"name":"a+b&c'd\"<e>","ttl":60}`,
+		},
+		{
+			name:       "body",
+			config:     `{"method": "PATCH", "body": "name={{.Host.Name}}", "content_type": "text/plain"}`,
+			wantMethod: http.MethodPatch,
+			wantType:   "text/plain",
+			wantBody:   "name=" + testHostName,
+		},
+		{
+			name:     "success regex",
+			config:   `{"success": {"regex": "^(good|nochg)"}}`,
+			response: "badauth",
+			wantErr:  `response does not match "^(good|nochg)"`,
+		},
+		{
+			name:     "success json",
+			config:   `{"success": {"json_path": "result.0.ok"}}`,
+			response: `{"result": [{"ok": false}]}`,
+			wantErr:  "result.0.ok is false, not true",
+		},
+		{
+			name:    "status",
+			status:  http.StatusInternalServerError,
+			wantErr: "unexpected status 500",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *http.Request
+			var gotBody string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				buf, _ := io.ReadAll(r.Body)
+				got, gotBody = r, string(buf)
+				if tc.status != 0 {
+					w.WriteHeader(tc.status)
+				}
+				io.WriteString(w, tc.response)
+			}))
+			defer srv.Close()
+			config := tc.config
+			apiKey := "TEST_HTTP_TOKEN"
+			u := &Update{Cmd: "http", Args: srv.URL + "/update", ApiKey: &apiKey, Config: &config}
+			err := httpUpdater{}.Validate(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := &Host{Name: testHostName, Domain: "home.example.org", Ip4addr: optional("8.8.8.8")}
+			change := &Change{Update: u, Old: &Host{}, Run: &Run{}}
+			err = httpUpdater{}.Apply(context.Background(), host, change)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Method != tc.wantMethod {
+				t.Errorf("got method %s, want %s", got.Method, tc.wantMethod)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != tc.wantType {
+				t.Errorf("got content type %q, want %q", ct, tc.wantType)
+			}
+			if tc.wantType == "application/json" {
+				// The encoder escapes <, > and & in JSON strings.
+				var gotJSON, wantJSON any
+				json.Unmarshal([]byte(gotBody), &gotJSON)
+				json.Unmarshal([]byte(tc.wantBody), &wantJSON)
+				if !reflect.DeepEqual(gotJSON, wantJSON) {
+					t.Errorf("got body %s, want %s", gotBody, tc.wantBody)
+				}
+			} else if gotBody != tc.wantBody {
+				t.Errorf("got body %q, want %q", gotBody, tc.wantBody)
+			}
+			for name, want := range tc.wantHeaders {
+				if v := got.Header.Get(name); v != want {
+					t.Errorf("got header %s %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config  string
+		wantErr string
+	}{
+		{`{"method": "POST", "json": {"ip": "{{.Host.Ip4addr}}"}}`, ""},
+		{`{"method": "DELETE"}`, `unsupported method "DELETE"`},
+		{`{"method": "POST", "form": {"a": "1"}, "body": "b"}`, "only one of form, json and body"},
+		{`{"body": "b"}`, "GET requests cannot have a body"},
+		{`{"auth": "digest"}`, "auth must be basic or bearer"},
+		{`{"auth": "basic"}`, "api_key must name"},
+		{`{"client_cert": "c.pem"}`, "client_cert and client_key"},
+		{`{"success": {"regex": "("}}`, "success regex"},
+		{`{"headers": {"X-Host": "{{.Host.Name"}}`, "header X-Host"},
+		{`{"method": "POST", "form": {"name": "{{.Host.Name"}}`, "form name"},
+		{`{"method": "POST", "json": {"a": ["{{.Host.Name"]}}`, "json"},
+		{`{"method": "POST", "body": "{{if}}"}`, "body"},
+	} {
+		u := &Update{Cmd: "http", Args: "https://example.org/", Config: &tc.config}
+		err := httpUpdater{}.Validate(u)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tc.config, err, tc.wantErr)
+		}
+	}
+}
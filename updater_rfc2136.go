@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	RegisterUpdater(rfc2136Updater{})
+}
+
+// rfc2136Config is the config of the rfc2136 update method. The TSIG
+// secret is read from the environment variable named by api_key.
+type rfc2136Config struct {
+	// Server is the primary name server, host:port with port 53 as default.
+	Server string `json:"server"`
+	// TsigName is the name of the TSIG key, updates are unsigned if empty.
+	TsigName string `json:"tsig_name"`
+	// TsigAlgorithm is hmac-sha256 (default) or hmac-sha512.
+	TsigAlgorithm string `json:"tsig_algorithm"`
+	// TTL of the address records, 300 seconds if not set.
+	TTL uint32 `json:"ttl"`
+	// TCP sends the update over TCP instead of UDP.
+	TCP bool `json:"tcp"`
+	// Timeout for the exchange with the server, 10s if not set.
+	Timeout string `json:"timeout"`
+}
+
+// rfc2136Updater sends a DNS UPDATE (RFC 2136) to the primary server of the
+// zone, replacing the A and AAAA RRsets of the host domain.
+type rfc2136Updater struct{}
+
+func (rfc2136Updater) Name() string {
+	return "rfc2136"
+}
+
+func (rfc2136Updater) config(u *Update) (*rfc2136Config, error) {
+	cfg := rfc2136Config{
+		TsigAlgorithm: "hmac-sha256",
+		TTL:           300,
+		Timeout:       "10s",
+	}
+	err := decodeConfig(u, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server == "" {
+		return nil, errors.New("config: server is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		cfg.Server = net.JoinHostPort(cfg.Server, "53")
+	}
+	if cfg.TsigName != "" {
+		cfg.TsigName = dns.Fqdn(cfg.TsigName)
+		switch dns.Fqdn(strings.ToLower(cfg.TsigAlgorithm)) {
+		case dns.HmacSHA256, dns.HmacSHA512:
+			cfg.TsigAlgorithm = dns.Fqdn(strings.ToLower(cfg.TsigAlgorithm))
+		default:
+			return nil, fmt.Errorf("config: unsupported tsig_algorithm %q", cfg.TsigAlgorithm)
+		}
+		if u.ApiKey == nil || *u.ApiKey == "" {
+			return nil, errors.New("api_key must name the environment variable with the TSIG secret")
+		}
+	}
+	if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+		return nil, fmt.Errorf("config: timeout: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (r rfc2136Updater) Validate(u *Update) error {
+	_, err := r.config(u)
+	return errors.Join(err, checkTemplate("args", u.Args))
+}
+
+func (r rfc2136Updater) Apply(ctx context.Context, host *Host, change *Change) error {
+	cfg, err := r.config(change.Update)
+	if err != nil {
+		return err
+	}
+	if host.Zone == "" || host.Domain == "" {
+		return errors.New("host has no domain or zone")
+	}
+	zone := dns.Fqdn(host.Zone)
+	name := dns.Fqdn(host.Domain)
+	msg := new(dns.Msg)
+	msg.SetUpdate(zone)
+	var rrs []string
+	for _, fam := range []struct {
+		rrtype   uint16
+		addr     *string
+		old      *string
+		makeRR   func(hdr dns.RR_Header, addr netip.Addr) dns.RR
+		isFamily func(netip.Addr) bool
+	}{
+		{dns.TypeA, host.Ip4addr, change.Old.Ip4addr, func(hdr dns.RR_Header, addr netip.Addr) dns.RR {
+			return &dns.A{Hdr: hdr, A: addr.AsSlice()}
+		}, netip.Addr.Is4},
+		{dns.TypeAAAA, host.Ip6addr, change.Old.Ip6addr, func(hdr dns.RR_Header, addr netip.Addr) dns.RR {
+			return &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}
+		}, netip.Addr.Is6},
+	} {
+		hdr := dns.RR_Header{Name: name, Rrtype: fam.rrtype, Class: dns.ClassINET, Ttl: cfg.TTL}
+		if fam.addr == nil {
+			// Only remove records of a family the host used to have.
+			if fam.old != nil {
+				msg.RemoveRRset([]dns.RR{&dns.ANY{Hdr: hdr}})
+				rrs = append(rrs, "delete "+name+" "+dns.TypeToString[fam.rrtype])
+			}
+			continue
+		}
+		addr, err := netip.ParseAddr(*fam.addr)
+		if err != nil || !fam.isFamily(addr.Unmap()) {
+			return fmt.Errorf("invalid %s address %q", dns.TypeToString[fam.rrtype], *fam.addr)
+		}
+		rr := fam.makeRR(hdr, addr.Unmap())
+		msg.RemoveRRset([]dns.RR{&dns.ANY{Hdr: hdr}})
+		msg.Insert([]dns.RR{rr})
+		rrs = append(rrs, rr.String())
+	}
+	if len(msg.Ns) == 0 {
+		return errors.New("host has no addresses")
+	}
+	change.Run.Args = cfg.Server + ": " + strings.Join(rrs, "; ")
+	if change.DryRun {
+		return nil
+	}
+
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	client := &dns.Client{Timeout: timeout}
+	if cfg.TCP {
+		client.Net = "tcp"
+	}
+	if cfg.TsigName != "" {
+		secret := os.Getenv(*change.Update.ApiKey)
+		if secret == "" {
+			return errors.New("api_key ENV variable not set")
+		}
+		client.TsigSecret = map[string]string{cfg.TsigName: secret}
+		msg.SetTsig(cfg.TsigName, cfg.TsigAlgorithm, 300, time.Now().Unix())
+	}
+	slog.DebugContext(ctx, "rfc2136 update", "server", cfg.Server, "msg", msg.String())
+	res, _, err := client.ExchangeContext(ctx, msg, cfg.Server)
+	if err != nil {
+		slog.ErrorContext(ctx, "rfc2136 Exchange", "server", cfg.Server, "err", err)
+		return err
+	}
+	rcode := res.Rcode
+	change.Run.Status = &rcode
+	change.Run.SetOutput([]byte(res.String()))
+	if res.Rcode != dns.RcodeSuccess {
+		slog.ErrorContext(ctx, "rfc2136 update refused", "server", cfg.Server, "rcode", dns.RcodeToString[res.Rcode])
+		return fmt.Errorf("update refused: %s", dns.RcodeToString[res.Rcode])
+	}
+	slog.InfoContext(ctx, "rfc2136 update", "server", cfg.Server, "name", name, "rrs", rrs)
+	return nil
+}
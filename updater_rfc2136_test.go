@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTsigName   = "fritzdyn."
+	testTsigSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0MTI="
+)
+
+// startDNSServer starts a DNS server on localhost that accepts updates
+// signed with testTsigName and secret and passes the updates it receives
+// on the returned channel.
+func startDNSServer(t *testing.T, secret string) (string, <-chan *dns.Msg) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *dns.Msg, 1)
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{testTsigName: secret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default refuses updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			if req.IsTsig() == nil || w.TsigStatus() != nil {
+				res.Rcode = dns.RcodeNotAuth
+			} else {
+				res.SetTsig(testTsigName, dns.HmacSHA256, 300, time.Now().Unix())
+				received <- req
+			}
+			w.WriteMsg(res)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	<-started
+	return pc.LocalAddr().String(), received
+}
+
+// rrStrings returns the records of the update section of msg, RRset
+// deletions as "delete <name> ANY <type>".
+func rrStrings(msg *dns.Msg) []string {
+	var rrs []string
+	for _, rr := range msg.Ns {
+		hdr := rr.Header()
+		if hdr.Class == dns.ClassANY {
+			rrs = append(rrs, "delete "+hdr.Name+" ANY "+dns.TypeToString[hdr.Rrtype])
+			continue
+		}
+		rrs = append(rrs, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	return rrs
+}
+
+func TestRFC2136Apply(t *testing.T) {
+	t.Setenv("TEST_TSIG_SECRET", testTsigSecret)
+	for _, tc := range []struct {
+		name         string
+		ip4, ip6     string
+		old4, old6   string
+		serverSecret string
+		want         []string
+		wantErr      string
+	}{
+		{
+			name: "both families",
+			ip4:  "8.8.8.8", ip6: "2001:4860::1",
+			old4: "8.8.4.4", old6: "2001:4860::2",
+			want: []string{
+				"delete home.example.org. ANY A",
+				"home.example.org. 300 IN A 8.8.8.8",
+				"delete home.example.org. ANY AAAA",
+				"home.example.org. 300 IN AAAA 2001:4860::1",
+			},
+		},
+		{
+			name: "IPv6 gone",
+			ip4:  "8.8.8.8",
+			old4: "8.8.4.4", old6: "2001:4860::2",
+			want: []string{
+				"delete home.example.org. ANY A",
+				"home.example.org. 300 IN A 8.8.8.8",
+				"delete home.example.org. ANY AAAA",
+			},
+		},
+		{
+			name: "IPv6 only",
+			ip6:  "2001:4860::1",
+			want: []string{
+				"delete home.example.org. ANY AAAA",
+				"home.example.org. 300 IN AAAA 2001:4860::1",
+			},
+		},
+		{
+			name:         "rejected TSIG",
+			ip4:          "8.8.8.8",
+			serverSecret: "b3RoZXJvdGhlcm90aGVyb3RoZXJvdGhlcm90aGVyMTI=",
+			wantErr:      "NOTAUTH",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := tc.serverSecret
+			if secret == "" {
+				secret = testTsigSecret
+			}
+			addr, received := startDNSServer(t, secret)
+			config := `{"server": "` + addr + `", "tsig_name": "fritzdyn", "timeout": "2s"}`
+			apiKey := "TEST_TSIG_SECRET"
+			u := &Update{Cmd: "rfc2136", ApiKey: &apiKey, Config: &config}
+			err := rfc2136Updater{}.Validate(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := &Host{Domain: "home.example.org", Zone: "example.org", Ip4addr: optional(tc.ip4), Ip6addr: optional(tc.ip6)}
+			old := &Host{Ip4addr: optional(tc.old4), Ip6addr: optional(tc.old6)}
+			change := &Change{Update: u, Old: old, Run: &Run{}}
+			err = rfc2136Updater{}.Apply(context.Background(), host, change)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := <-received
+			if msg.Opcode != dns.OpcodeUpdate || msg.Question[0].Name != "example.org." {
+				t.Errorf("got opcode %d for zone %q, want an update of example.org.", msg.Opcode, msg.Question[0].Name)
+			}
+			if got := rrStrings(msg); !slices.Equal(got, tc.want) {
+				t.Errorf("got update\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	RegisterUpdater(shellUpdater{})
+}
+
+// shellUpdater runs args as a command line with sh -c. Since template
+// values end up in a shell command line, it is only available if
+// ALLOW_SHELL_UPDATES is set to true, exec is the safe alternative.
+type shellUpdater struct{}
+
+func (shellUpdater) Name() string {
+	return "shell"
+}
+
+func (shellUpdater) enabled() error {
+	if os.Getenv("ALLOW_SHELL_UPDATES") != "true" {
+		return errors.New("shell update methods are disabled, set ALLOW_SHELL_UPDATES=true or use exec")
+	}
+	return nil
+}
+
+// shellConfig is the config of the shell update method.
+type shellConfig struct {
+	commandConfig
+	// Command is a template the args are appended to in double quotes.
+	// This is how older versions ran a command line stored in cmd,
+	// migration 18 moves those here.
+	Command string `json:"command"`
+}
+
+func (s shellUpdater) config(u *Update) (*shellConfig, error) {
+	cfg := shellConfig{commandConfig: commandConfig{Timeout: "30s"}}
+	err := decodeConfig(u, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplate("command", cfg.Command); err != nil {
+		return nil, err
+	}
+	return &cfg, cfg.commandConfig.check()
+}
+
+func (s shellUpdater) Validate(u *Update) error {
+	if err := s.enabled(); err != nil {
+		return err
+	}
+	cfg, err := s.config(u)
+	if err != nil {
+		return err
+	}
+	if u.Args == "" && cfg.Command == "" {
+		return errors.New("args must contain the command line")
+	}
+	return checkTemplate("args", u.Args)
+}
+
+func (s shellUpdater) Apply(ctx context.Context, host *Host, change *Change) error {
+	if err := s.enabled(); err != nil {
+		return err
+	}
+	cfg, err := s.config(change.Update)
+	if err != nil {
+		return err
+	}
+	cmdLine, err := change.Args(host)
+	if err != nil {
+		return err
+	}
+	if cfg.Command != "" {
+		command, err := change.Render("command", cfg.Command, host)
+		if err != nil {
+			return err
+		}
+		cmdLine = command + ` "` + cmdLine + `"`
+		change.Run.Args = cmdLine
+	}
+	return runCommand(ctx, &cfg.commandConfig, []string{"sh", "-c", cmdLine}, host, change)
+}
+
+// convertShellUpdates turns update methods from older versions that have a
+// command line in cmd instead of the name of an updater into shell update
+// methods with the command in their config. They only run if shell update
+// methods are allowed.
+func convertShellUpdates(ctx context.Context, tx *sqlx.Tx) error {
+	var updates []struct {
+		Id     int64
+		Cmd    string
+		Config *string
+	}
+	err := tx.SelectContext(ctx, &updates, "SELECT id, cmd, config FROM updates")
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		if _, err := LookupUpdater(u.Cmd); err == nil {
+			continue
+		}
+		cfg := make(map[string]any)
+		if u.Config != nil {
+			err = json.Unmarshal([]byte(*u.Config), &cfg)
+			if err != nil {
+				return fmt.Errorf("config of update %d: %w", u.Id, err)
+			}
+		}
+		cfg["command"] = u.Cmd
+		var config strings.Builder
+		enc := json.NewEncoder(&config)
+		enc.SetEscapeHTML(false)
+		err = enc.Encode(cfg)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE updates SET cmd = 'shell', config = ? WHERE id = ?",
+			strings.TrimSpace(config.String()), u.Id)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "converted command line to shell update method", "update", u.Id)
+	}
+	return nil
+}
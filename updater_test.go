@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestChangeReq(t *testing.T) {
+	form := url.Values{"token": {testToken}, "domain": {"home.example.org"}, "ip6lanprefix": {"2001:db8:1::/64"}}
+	change := &Change{Update: &Update{}, Old: &Host{}, Run: &Run{}, Form: jobForm(form)}
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{`{{.Req.Form.Get "ip6lanprefix"}}`, "2001:db8:1::/64"},
+		{`{{.Req.FormValue "domain"}}`, "home.example.org"},
+		{`{{.Req.Form.Get "token"}}`, ""},
+		{`{{.Req.URL.RawQuery}}`, "domain=home.example.org&ip6lanprefix=2001%3Adb8%3A1%3A%3A%2F64"},
+		{`{{.Req.Method}}`, "GET"},
+	} {
+		got, err := change.RenderText("test", tc.text, &Host{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.text, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.text, got, tc.want)
+		}
+	}
+	if form.Get("token") == "" {
+		t.Error("jobForm changed the request form")
+	}
+}